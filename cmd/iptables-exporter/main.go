@@ -0,0 +1,142 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Command iptables-exporter periodically collects the per-rule and
+// per-chain-policy counters of iptables and ip6tables and serves them in the
+// Prometheus text format.
+//
+// Usage:
+//
+//	iptables-exporter -listen 127.0.0.1:9455 -tables filter,nat -interval 15s
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coreos/go-iptables/iptables"
+)
+
+// family is an iptables instance to collect from.
+type family struct {
+	name string
+	ipt  *iptables.IPTables
+}
+
+// collector keeps the rendering of the last collection.
+type collector struct {
+	families []family
+	tables   []string
+
+	mu   sync.Mutex
+	page []byte
+}
+
+// collect lists every table of every family and renders the result. A table
+// that can't be listed is reported as failed; the others are still exported.
+func (c *collector) collect() {
+	var samples []tableSample
+	for _, f := range c.families {
+		for _, table := range c.tables {
+			start := time.Now()
+			chains, err := f.ipt.TableStats(table)
+			if err != nil {
+				log.Printf("collecting %s table %s: %v", f.name, table, err)
+			}
+			samples = append(samples, tableSample{
+				Family:   f.name,
+				Table:    table,
+				Chains:   chains,
+				Err:      err,
+				Duration: time.Since(start),
+			})
+		}
+	}
+
+	var page bytes.Buffer
+	if err := writeMetrics(&page, samples); err != nil {
+		log.Printf("rendering metrics: %v", err)
+		return
+	}
+	c.mu.Lock()
+	c.page = page.Bytes()
+	c.mu.Unlock()
+}
+
+// run collects every interval, forever.
+func (c *collector) run(interval time.Duration) {
+	for range time.Tick(interval) {
+		c.collect()
+	}
+}
+
+func (c *collector) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	c.mu.Lock()
+	page := c.page
+	c.mu.Unlock()
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	if _, err := w.Write(page); err != nil {
+		log.Printf("writing metrics: %v", err)
+	}
+}
+
+func main() {
+	var (
+		listen   = flag.String("listen", "127.0.0.1:9455", "address to serve metrics on")
+		path     = flag.String("path", "/metrics", "HTTP path of the metrics")
+		tables   = flag.String("tables", "filter,nat,mangle,raw", "comma-separated tables to collect")
+		families = flag.String("families", "ipv4,ipv6", "comma-separated protocol families to collect")
+		interval = flag.Duration("interval", 15*time.Second, "time between two collections")
+	)
+	flag.Parse()
+
+	if *interval <= 0 {
+		fmt.Fprintf(os.Stderr, "invalid interval %v\n", *interval)
+		os.Exit(2)
+	}
+
+	c := &collector{tables: strings.Split(*tables, ",")}
+	for _, name := range strings.Split(*families, ",") {
+		var proto iptables.Protocol
+		switch name {
+		case "ipv4":
+			proto = iptables.ProtocolIPv4
+		case "ipv6":
+			proto = iptables.ProtocolIPv6
+		default:
+			fmt.Fprintf(os.Stderr, "unknown family %q\n", name)
+			os.Exit(2)
+		}
+		ipt, err := iptables.New(iptables.IPFamily(proto))
+		if err != nil {
+			log.Fatalf("setting up %s: %v", name, err)
+		}
+		c.families = append(c.families, family{name: name, ipt: ipt})
+	}
+
+	c.collect()
+	go c.run(*interval)
+
+	http.Handle(*path, c)
+	log.Printf("serving metrics on http://%s%s", *listen, *path)
+	log.Fatal(http.ListenAndServe(*listen, nil))
+}
@@ -0,0 +1,132 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/coreos/go-iptables/iptables"
+)
+
+// tableSample is the result of collecting the statistics of one table of one
+// family.
+type tableSample struct {
+	Family   string
+	Table    string
+	Chains   map[string]*iptables.ChainStats
+	Err      error
+	Duration time.Duration
+}
+
+// metric is a single metric family of the Prometheus text format.
+type metric struct {
+	name, help, kind string
+	lines            []string
+}
+
+func (m *metric) add(labels []string, value string) {
+	m.lines = append(m.lines, m.name+formatLabels(labels)+" "+value)
+}
+
+// writeMetrics renders samples in the Prometheus text exposition format.
+// Samples are expected in a stable order; chains and rules are sorted by
+// name and position.
+func writeMetrics(w io.Writer, samples []tableSample) error {
+	var (
+		rulePackets   = &metric{name: "iptables_rule_packets_total", help: "Packets matched by the rule.", kind: "counter"}
+		ruleBytes     = &metric{name: "iptables_rule_bytes_total", help: "Bytes matched by the rule.", kind: "counter"}
+		policyPackets = &metric{name: "iptables_chain_policy_packets_total", help: "Packets handled by the policy of the built-in chain.", kind: "counter"}
+		policyBytes   = &metric{name: "iptables_chain_policy_bytes_total", help: "Bytes handled by the policy of the built-in chain.", kind: "counter"}
+		policyInfo    = &metric{name: "iptables_chain_policy_info", help: "Policy of the built-in chain, in the policy label.", kind: "gauge"}
+		scrapeSuccess = &metric{name: "iptables_scrape_success", help: "Whether the last collection of the table succeeded.", kind: "gauge"}
+		scrapeSeconds = &metric{name: "iptables_scrape_duration_seconds", help: "Time taken by the last collection of the table.", kind: "gauge"}
+	)
+
+	for _, s := range samples {
+		tableLabels := []string{"family", s.Family, "table", s.Table}
+		success := "1"
+		if s.Err != nil {
+			success = "0"
+		}
+		scrapeSuccess.add(tableLabels, success)
+		scrapeSeconds.add(tableLabels, strconv.FormatFloat(s.Duration.Seconds(), 'f', -1, 64))
+
+		chains := make([]string, 0, len(s.Chains))
+		for chain := range s.Chains {
+			chains = append(chains, chain)
+		}
+		sort.Strings(chains)
+
+		for _, chain := range chains {
+			stats := s.Chains[chain]
+			chainLabels := withLabels(tableLabels, "chain", chain)
+			if stats.Policy != "" {
+				// the policy is kept out of the counters' labels, so that
+				// changing it doesn't start new series
+				policyPackets.add(chainLabels, strconv.FormatUint(stats.PolicyPackets, 10))
+				policyBytes.add(chainLabels, strconv.FormatUint(stats.PolicyBytes, 10))
+				policyInfo.add(withLabels(chainLabels, "policy", stats.Policy), "1")
+			}
+			for i, rule := range stats.Rules {
+				labels := withLabels(chainLabels,
+					"rule", strconv.Itoa(i+1),
+					"target", rule.Target,
+					"comment", rule.ParsedOptions().Comment,
+				)
+				rulePackets.add(labels, strconv.FormatUint(rule.Packets, 10))
+				ruleBytes.add(labels, strconv.FormatUint(rule.Bytes, 10))
+			}
+		}
+	}
+
+	for _, m := range []*metric{rulePackets, ruleBytes, policyPackets, policyBytes, policyInfo, scrapeSuccess, scrapeSeconds} {
+		if _, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", m.name, m.help, m.name, m.kind); err != nil {
+			return err
+		}
+		for _, line := range m.lines {
+			if _, err := io.WriteString(w, line+"\n"); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// withLabels returns a copy of labels with more appended.
+func withLabels(labels []string, more ...string) []string {
+	return append(append([]string{}, labels...), more...)
+}
+
+// labelEscaper escapes label values as required by the text format.
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// formatLabels renders alternating label names and values as {a="1",b="2"}.
+func formatLabels(labels []string) string {
+	var b strings.Builder
+	b.WriteByte('{')
+	for i := 0; i+1 < len(labels); i += 2 {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(labels[i] + `="` + labelEscaper.Replace(labels[i+1]) + `"`)
+	}
+	b.WriteByte('}')
+	return b.String()
+}
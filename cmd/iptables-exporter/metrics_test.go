@@ -0,0 +1,83 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/coreos/go-iptables/iptables"
+)
+
+func TestWriteMetrics(t *testing.T) {
+	samples := []tableSample{
+		{
+			Family: "ipv4",
+			Table:  "filter",
+			Chains: map[string]*iptables.ChainStats{
+				"INPUT": {
+					Chain:         "INPUT",
+					Policy:        "DROP",
+					PolicyPackets: 3,
+					PolicyBytes:   180,
+					Rules: []iptables.Stat{
+						{Packets: 10, Bytes: 600, Target: "ACCEPT", Options: `tcp dpt:22 /* "ssh" access */`},
+						{Packets: 1, Bytes: 40, Target: "MYAPP"},
+					},
+				},
+				"MYAPP": {Chain: "MYAPP", References: 1, Rules: []iptables.Stat{}},
+			},
+			Duration: 1500 * time.Millisecond,
+		},
+		{Family: "ipv6", Table: "filter", Err: errors.New("ip6tables failed")},
+	}
+
+	var b bytes.Buffer
+	if err := writeMetrics(&b, samples); err != nil {
+		t.Fatalf("writeMetrics failed: %v", err)
+	}
+
+	expected := `# HELP iptables_rule_packets_total Packets matched by the rule.
+# TYPE iptables_rule_packets_total counter
+iptables_rule_packets_total{family="ipv4",table="filter",chain="INPUT",rule="1",target="ACCEPT",comment="\"ssh\" access"} 10
+iptables_rule_packets_total{family="ipv4",table="filter",chain="INPUT",rule="2",target="MYAPP",comment=""} 1
+# HELP iptables_rule_bytes_total Bytes matched by the rule.
+# TYPE iptables_rule_bytes_total counter
+iptables_rule_bytes_total{family="ipv4",table="filter",chain="INPUT",rule="1",target="ACCEPT",comment="\"ssh\" access"} 600
+iptables_rule_bytes_total{family="ipv4",table="filter",chain="INPUT",rule="2",target="MYAPP",comment=""} 40
+# HELP iptables_chain_policy_packets_total Packets handled by the policy of the built-in chain.
+# TYPE iptables_chain_policy_packets_total counter
+iptables_chain_policy_packets_total{family="ipv4",table="filter",chain="INPUT"} 3
+# HELP iptables_chain_policy_bytes_total Bytes handled by the policy of the built-in chain.
+# TYPE iptables_chain_policy_bytes_total counter
+iptables_chain_policy_bytes_total{family="ipv4",table="filter",chain="INPUT"} 180
+# HELP iptables_chain_policy_info Policy of the built-in chain, in the policy label.
+# TYPE iptables_chain_policy_info gauge
+iptables_chain_policy_info{family="ipv4",table="filter",chain="INPUT",policy="DROP"} 1
+# HELP iptables_scrape_success Whether the last collection of the table succeeded.
+# TYPE iptables_scrape_success gauge
+iptables_scrape_success{family="ipv4",table="filter"} 1
+iptables_scrape_success{family="ipv6",table="filter"} 0
+# HELP iptables_scrape_duration_seconds Time taken by the last collection of the table.
+# TYPE iptables_scrape_duration_seconds gauge
+iptables_scrape_duration_seconds{family="ipv4",table="filter"} 1.5
+iptables_scrape_duration_seconds{family="ipv6",table="filter"} 0
+`
+	if b.String() != expected {
+		t.Fatalf("writeMetrics mismatch: \ngot  %s \nneed %s", b.String(), expected)
+	}
+}
@@ -0,0 +1,227 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strings"
+)
+
+// Blocklist is a list of networks, deduplicated and aggregated per family:
+// networks contained in others are dropped and adjacent networks are merged
+// into the smallest set of prefixes covering the same addresses.
+type Blocklist struct {
+	// ReadIPv4 and ReadIPv6 count the networks read, before deduplication
+	// and aggregation.
+	ReadIPv4 int
+	ReadIPv6 int
+	// IPv4 and IPv6 are the aggregated networks, sorted by address.
+	IPv4 []*net.IPNet
+	IPv6 []*net.IPNet
+}
+
+// ReadBlocklist reads networks from r, one per line, e.g. "10.0.0.0/8" or
+// "2001:db8::1". Blank lines are skipped, as is everything after a "#" or
+// ";" and after the first field, so that lists such as
+// "192.0.2.0/24 ; SBL123" are accepted. Host bits of networks are cleared.
+func ReadBlocklist(r io.Reader) (*Blocklist, error) {
+	var ipv4, ipv6 []*net.IPNet
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		line := scanner.Text()
+		if i := strings.IndexAny(line, "#;"); i >= 0 {
+			line = line[:i]
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		_, ipnet, err := net.ParseCIDR(appendSubnet(fields[0]))
+		if err != nil {
+			return nil, fmt.Errorf("line %d: invalid network %q", n, fields[0])
+		}
+		if len(ipnet.IP) == net.IPv4len {
+			ipv4 = append(ipv4, ipnet)
+		} else {
+			ipv6 = append(ipv6, ipnet)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return &Blocklist{
+		ReadIPv4: len(ipv4),
+		ReadIPv6: len(ipv6),
+		IPv4:     aggregateNetworks(ipv4),
+		IPv6:     aggregateNetworks(ipv6),
+	}, nil
+}
+
+// Networks returns the aggregated networks of the given family.
+func (b *Blocklist) Networks(proto Protocol) []*net.IPNet {
+	if proto == ProtocolIPv6 {
+		return b.IPv6
+	}
+	return b.IPv4
+}
+
+// String reports the counts of networks before and after aggregation.
+func (b *Blocklist) String() string {
+	return fmt.Sprintf("ipv4: %d read, %d aggregated; ipv6: %d read, %d aggregated",
+		b.ReadIPv4, len(b.IPv4), b.ReadIPv6, len(b.IPv6))
+}
+
+// aggregateNetworks returns the smallest sorted list of networks covering
+// the same addresses as nets, which must be of the same family.
+func aggregateNetworks(nets []*net.IPNet) []*net.IPNet {
+	sort.Slice(nets, func(i, j int) bool {
+		if c := bytes.Compare(nets[i].IP, nets[j].IP); c != 0 {
+			return c < 0
+		}
+		return prefixLen(nets[i]) < prefixLen(nets[j])
+	})
+
+	// networks either contain each other or don't overlap, so once sorted
+	// a network is covered by another one only if it is covered by the
+	// last one kept, and merged siblings are always at the top of the stack
+	var stack []*net.IPNet
+	for _, n := range nets {
+		if len(stack) > 0 && stack[len(stack)-1].Contains(n.IP) {
+			continue
+		}
+		stack = append(stack, n)
+		for len(stack) >= 2 {
+			parent := siblingsParent(stack[len(stack)-2], stack[len(stack)-1])
+			if parent == nil {
+				break
+			}
+			stack = append(stack[:len(stack)-2], parent)
+		}
+	}
+	return stack
+}
+
+func prefixLen(n *net.IPNet) int {
+	ones, _ := n.Mask.Size()
+	return ones
+}
+
+// siblingsParent returns the network made of the two halves a and b, in that
+// order, or nil if they aren't the two halves of a network.
+func siblingsParent(a, b *net.IPNet) *net.IPNet {
+	ones, bits := a.Mask.Size()
+	if ones == 0 || prefixLen(b) != ones || len(a.IP) != len(b.IP) {
+		return nil
+	}
+	// b must be a with the last bit of the prefix set
+	byteIndex, bit := (ones-1)/8, byte(0x80>>uint((ones-1)%8))
+	if a.IP[byteIndex]&bit != 0 {
+		return nil
+	}
+	sibling := append(net.IP{}, a.IP...)
+	sibling[byteIndex] |= bit
+	if !sibling.Equal(b.IP) {
+		return nil
+	}
+	return &net.IPNet{IP: a.IP, Mask: net.CIDRMask(ones-1, bits)}
+}
+
+// LoadIPSet replaces the entries of the hash:net set name with the networks
+// of the family of s, creating the set with opts if it doesn't exist. The
+// new entries are loaded into a temporary set that is then swapped with the
+// set, in a single ipset restore, so rules matching the set never see a
+// partial list. MaxElem is raised to the number of networks if needed.
+func (b *Blocklist) LoadIPSet(s *IPSet, name string, opts SetOptions) error {
+	sets, err := s.ListSets()
+	if err != nil {
+		return err
+	}
+	script, err := b.ipsetScript(s, name, opts, sets)
+	if err != nil {
+		return err
+	}
+	return s.Restore(strings.NewReader(script))
+}
+
+// blocklistTmpSet returns the name of the temporary set used to load name.
+func blocklistTmpSet(name string) string {
+	return "tmp-" + chainHash(name, 16)
+}
+
+// ipsetScript returns the ipset restore script loading the blocklist into
+// the set name, given the existing sets.
+func (b *Blocklist) ipsetScript(s *IPSet, name string, opts SetOptions, existing []string) (string, error) {
+	if err := checkSetName(name); err != nil {
+		return "", err
+	}
+	nets := b.Networks(s.proto)
+	maxElem := opts.MaxElem
+	if maxElem == 0 {
+		maxElem = 65536
+	}
+	if len(nets) > maxElem {
+		opts.MaxElem = len(nets)
+	}
+	tmp := blocklistTmpSet(name)
+
+	var script strings.Builder
+	if !contains(existing, name) {
+		args, err := s.createArgs(name, SetHashNet, opts)
+		if err != nil {
+			return "", err
+		}
+		fmt.Fprintln(&script, strings.Join(args, " "))
+	}
+	if contains(existing, tmp) {
+		// left over by a failed load
+		fmt.Fprintf(&script, "destroy %s\n", tmp)
+	}
+	args, err := s.createArgs(tmp, SetHashNet, opts)
+	if err != nil {
+		return "", err
+	}
+	fmt.Fprintln(&script, strings.Join(args, " "))
+	for _, n := range nets {
+		fmt.Fprintf(&script, "add %s %s\n", tmp, n)
+	}
+	fmt.Fprintf(&script, "swap %s %s\ndestroy %s\n", tmp, name, tmp)
+	return script.String(), nil
+}
+
+// LoadChain replaces the rules of table/chain, creating it if needed, with
+// one rule per network of the family of ipt, sending the matching packets
+// to target, e.g. "DROP". The chain is rewritten in a single restore, and
+// rules for networks that were already in the chain keep their counters.
+func (b *Blocklist) LoadChain(ipt *IPTables, table, chain, target string) error {
+	if target == "" {
+		return fmt.Errorf("empty blocklist target")
+	}
+	nets := b.Networks(ipt.proto)
+	rules := make([][]string, len(nets))
+	for i, n := range nets {
+		rules[i] = []string{"-s", n.String(), "-j", target}
+	}
+	ops, err := ipt.rewriteChainOps(table, chain, rules)
+	if err != nil {
+		return err
+	}
+	return ipt.restore(restoreScript(ops), false)
+}
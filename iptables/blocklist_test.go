@@ -0,0 +1,230 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables
+
+import (
+	"fmt"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func networkStrings(nets []*net.IPNet) []string {
+	out := make([]string, len(nets))
+	for i, n := range nets {
+		out[i] = n.String()
+	}
+	return out
+}
+
+func TestReadBlocklist(t *testing.T) {
+	list := `# threat intel
+192.0.2.0/25
+192.0.2.128/25 ; SBL1
+192.0.2.7
+10.0.0.0/8
+10.1.2.3/16   extra fields
+10.0.0.0/8
+198.51.100.0/24
+198.51.101.0/24
+198.51.102.0/23
+203.0.113.1
+203.0.113.2
+
+2001:db8::/33
+2001:db8:8000::/33
+2001:db8::1
+fd00::1/128
+`
+	b, err := ReadBlocklist(strings.NewReader(list))
+	if err != nil {
+		t.Fatalf("ReadBlocklist failed: %v", err)
+	}
+
+	ipv4 := []string{"10.0.0.0/8", "192.0.2.0/24", "198.51.100.0/22", "203.0.113.1/32", "203.0.113.2/32"}
+	if got := networkStrings(b.Networks(ProtocolIPv4)); !reflect.DeepEqual(got, ipv4) {
+		t.Fatalf("IPv4 mismatch: \ngot  %q \nneed %q", got, ipv4)
+	}
+	ipv6 := []string{"2001:db8::/32", "fd00::1/128"}
+	if got := networkStrings(b.Networks(ProtocolIPv6)); !reflect.DeepEqual(got, ipv6) {
+		t.Fatalf("IPv6 mismatch: \ngot  %q \nneed %q", got, ipv6)
+	}
+	summary := "ipv4: 11 read, 5 aggregated; ipv6: 4 read, 2 aggregated"
+	if b.String() != summary {
+		t.Fatalf("String mismatch: \ngot  %s \nneed %s", b.String(), summary)
+	}
+
+	if _, err := ReadBlocklist(strings.NewReader("10.0.0.0/8\n10.0.0/8\n")); err == nil || !strings.Contains(err.Error(), "line 2") {
+		t.Fatalf("expected err on line 2, got %v", err)
+	}
+}
+
+func TestAggregateNetworks(t *testing.T) {
+	testCases := []struct {
+		in, out []string
+	}{
+		// siblings merge up the whole tree
+		{
+			in:  []string{"10.0.0.3/32", "10.0.0.0/32", "10.0.0.2/32", "10.0.0.1/32"},
+			out: []string{"10.0.0.0/30"},
+		},
+		// halves of different networks don't merge
+		{
+			in:  []string{"10.0.1.0/24", "10.0.2.0/24"},
+			out: []string{"10.0.1.0/24", "10.0.2.0/24"},
+		},
+		// a merge can cover a later network
+		{
+			in:  []string{"10.0.0.0/25", "10.0.0.128/25", "10.0.0.200/32", "10.0.1.0/24"},
+			out: []string{"10.0.0.0/23"},
+		},
+		{
+			in:  []string{"0.0.0.0/1", "128.0.0.0/1", "1.2.3.4/32"},
+			out: []string{"0.0.0.0/0"},
+		},
+		{in: nil, out: []string{}},
+	}
+
+	for i, tt := range testCases {
+		t.Run(fmt.Sprint(i), func(t *testing.T) {
+			var nets []*net.IPNet
+			for _, s := range tt.in {
+				_, n, err := net.ParseCIDR(s)
+				if err != nil {
+					t.Fatalf("ParseCIDR failed: %v", err)
+				}
+				nets = append(nets, n)
+			}
+			if got := networkStrings(aggregateNetworks(nets)); !reflect.DeepEqual(got, tt.out) {
+				t.Fatalf("aggregateNetworks mismatch: \ngot  %q \nneed %q", got, tt.out)
+			}
+		})
+	}
+}
+
+func TestBlocklistIPSetScript(t *testing.T) {
+	b, err := ReadBlocklist(strings.NewReader("10.0.0.0/8\n192.0.2.0/24\n2001:db8::/32\n"))
+	if err != nil {
+		t.Fatalf("ReadBlocklist failed: %v", err)
+	}
+	tmp := blocklistTmpSet("deny")
+
+	script, err := b.ipsetScript(&IPSet{proto: ProtocolIPv4}, "deny", SetOptions{}, nil)
+	if err != nil {
+		t.Fatalf("ipsetScript failed: %v", err)
+	}
+	expected := "create deny hash:net family inet\n" +
+		"create " + tmp + " hash:net family inet\n" +
+		"add " + tmp + " 10.0.0.0/8\n" +
+		"add " + tmp + " 192.0.2.0/24\n" +
+		"swap " + tmp + " deny\n" +
+		"destroy " + tmp + "\n"
+	if script != expected {
+		t.Fatalf("ipsetScript mismatch: \ngot  %s \nneed %s", script, expected)
+	}
+
+	// existing sets are reused or replaced, and maxelem raised
+	script, err = b.ipsetScript(&IPSet{proto: ProtocolIPv6}, "deny", SetOptions{MaxElem: 0, Comment: true}, []string{"deny", tmp})
+	if err != nil {
+		t.Fatalf("ipsetScript failed: %v", err)
+	}
+	expected = "destroy " + tmp + "\n" +
+		"create " + tmp + " hash:net family inet6 comment\n" +
+		"add " + tmp + " 2001:db8::/32\n" +
+		"swap " + tmp + " deny\n" +
+		"destroy " + tmp + "\n"
+	if script != expected {
+		t.Fatalf("ipsetScript mismatch: \ngot  %s \nneed %s", script, expected)
+	}
+
+	big := &Blocklist{IPv4: make([]*net.IPNet, 3)}
+	for i := range big.IPv4 {
+		big.IPv4[i] = &net.IPNet{IP: net.IPv4(10, 0, 0, byte(i)).To4(), Mask: net.CIDRMask(32, 32)}
+	}
+	if script, err = big.ipsetScript(&IPSet{proto: ProtocolIPv4}, "deny", SetOptions{MaxElem: 2}, []string{"deny"}); err != nil {
+		t.Fatalf("ipsetScript failed: %v", err)
+	}
+	if !strings.Contains(script, "create "+tmp+" hash:net family inet maxelem 3\n") {
+		t.Fatalf("maxelem not raised: %s", script)
+	}
+}
+
+func TestBlocklist(t *testing.T) {
+	for i, ipt := range mustTestableIptables() {
+		t.Run(fmt.Sprint(i), func(t *testing.T) {
+			runBlocklistTests(t, ipt)
+		})
+	}
+}
+
+func runBlocklistTests(t *testing.T, ipt *IPTables) {
+	chain := randChain(t)
+	b, err := ReadBlocklist(strings.NewReader("192.0.2.0/25\n192.0.2.128/25\n198.51.100.1\n2001:db8::/32\n"))
+	if err != nil {
+		t.Fatalf("ReadBlocklist failed: %v", err)
+	}
+	if err := b.LoadChain(ipt, "filter", chain, "DROP"); err != nil {
+		t.Fatalf("LoadChain failed: %v", err)
+	}
+	defer func() {
+		if err := ipt.ClearAndDeleteChain("filter", chain); err != nil {
+			t.Fatalf("ClearAndDeleteChain failed: %v", err)
+		}
+	}()
+
+	state, err := ipt.chainState("filter", chain)
+	if err != nil {
+		t.Fatalf("chainState failed: %v", err)
+	}
+	var need [][]string
+	for _, n := range networkStrings(b.Networks(ipt.Proto())) {
+		need = append(need, []string{"-s", n, "-j", "DROP"})
+	}
+	if !reflect.DeepEqual(state.rules, need) {
+		t.Fatalf("rules mismatch: \ngot  %q \nneed %q", state.rules, need)
+	}
+
+	s, err := NewIPSet(IPFamily(ipt.Proto()))
+	if err != nil {
+		t.Fatalf("NewIPSet failed: %v", err)
+	}
+	// loading twice goes through the swap of an existing set
+	for i := 0; i < 2; i++ {
+		if err := b.LoadIPSet(s, chain, SetOptions{}); err != nil {
+			t.Fatalf("LoadIPSet failed: %v", err)
+		}
+	}
+	defer func() {
+		if err := s.Destroy(chain); err != nil {
+			t.Fatalf("Destroy failed: %v", err)
+		}
+	}()
+	info, err := s.List(chain)
+	if err != nil {
+		t.Fatalf("List failed: %v", err)
+	}
+	var entries []string
+	for _, e := range info.Entries {
+		_, n, err := net.ParseCIDR(appendSubnet(e.Value))
+		if err != nil {
+			t.Fatalf("invalid entry %q", e.Value)
+		}
+		entries = append(entries, n.String())
+	}
+	if want := networkStrings(b.Networks(ipt.Proto())); len(entries) != len(want) {
+		t.Fatalf("entries mismatch: \ngot  %q \nneed %q", entries, want)
+	}
+}
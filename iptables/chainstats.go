@@ -0,0 +1,191 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// ChainStats holds the statistics of a chain: the policy and its counters
+// for built-in chains, the reference count for user-defined chains, and the
+// statistics of every rule.
+type ChainStats struct {
+	Chain         string `json:"chain"`
+	Policy        string `json:"policy,omitempty"`
+	PolicyPackets uint64 `json:"policy_pkts"`
+	PolicyBytes   uint64 `json:"policy_bytes"`
+	References    int    `json:"references"`
+	Rules         []Stat `json:"rules"`
+}
+
+// chainHeaderRegex matches the first line of a chain in "iptables -L -v -x"
+// output, e.g.
+//
+//	Chain INPUT (policy ACCEPT 123 packets, 4567 bytes)
+//	Chain KUBE-SERVICES (2 references)
+var chainHeaderRegex = regexp.MustCompile(`^Chain (\S+) \((?:policy (\S+) ([0-9]+) packets, ([0-9]+) bytes|([0-9]+) references?)\)`)
+
+// ChainStats returns the statistics of the given chain, including the
+// header information that Stats skips.
+func (ipt *IPTables) ChainStats(table, chain string) (*ChainStats, error) {
+	args := []string{"-t", table, "-L", chain, "-n", "-v", "-x"}
+	lines, err := ipt.executeList(args)
+	if err != nil {
+		return nil, err
+	}
+
+	chains, err := ipt.parseStatsListing(lines)
+	if err != nil {
+		return nil, err
+	}
+	if len(chains) != 1 {
+		return nil, fmt.Errorf("unexpected output listing chain %s: %q", chain, lines)
+	}
+	return chains[0], nil
+}
+
+// TableStats returns the statistics of every chain of table, keyed by chain
+// name. All chains are listed by a single iptables invocation.
+func (ipt *IPTables) TableStats(table string) (map[string]*ChainStats, error) {
+	args := []string{"-t", table, "-L", "-n", "-v", "-x"}
+	lines, err := ipt.executeList(args)
+	if err != nil {
+		return nil, err
+	}
+
+	chains, err := ipt.parseStatsListing(lines)
+	if err != nil {
+		return nil, err
+	}
+	stats := make(map[string]*ChainStats, len(chains))
+	for _, c := range chains {
+		stats[c.Chain] = c
+	}
+	return stats, nil
+}
+
+// StatsAndZero returns the statistics of the given chain like ChainStats
+// and zeroes its counters in the same invocation, so that no packet is
+// counted twice or lost between reading and resetting the counters.
+func (ipt *IPTables) StatsAndZero(table, chain string) (*ChainStats, error) {
+	args := []string{"-t", table, "-L", chain, "-Z", "-n", "-v", "-x"}
+	lines, err := ipt.executeList(args)
+	if err != nil {
+		return nil, err
+	}
+
+	chains, err := ipt.parseStatsListing(lines)
+	if err != nil {
+		return nil, err
+	}
+	if len(chains) != 1 {
+		return nil, fmt.Errorf("unexpected output listing chain %s: %q", chain, lines)
+	}
+	return chains[0], nil
+}
+
+// ZeroCounters zeroes the packet and byte counters of all rules of the
+// given chain, or of all chains of table if chain is empty.
+func (ipt *IPTables) ZeroCounters(table, chain string) error {
+	args := []string{"-t", table, "-Z"}
+	if chain != "" {
+		args = append(args, chain)
+	}
+	return ipt.run(args...)
+}
+
+// ZeroRuleCounters zeroes the packet and byte counters of the rule at the
+// given position (1-based) of table/chain.
+func (ipt *IPTables) ZeroRuleCounters(table, chain string, pos int) error {
+	return ipt.run("-t", table, "-Z", chain, strconv.Itoa(pos))
+}
+
+// parseStatsListing parses "iptables -L -n -v -x" output covering one or
+// more chains. Each chain starts with its header, followed by the column
+// header and the rules; chains are separated by empty lines.
+func (ipt *IPTables) parseStatsListing(lines []string) ([]*ChainStats, error) {
+	var (
+		chains []*ChainStats
+		rules  [][]string
+	)
+	for _, line := range lines {
+		fields := strings.Fields(line)
+		switch {
+		case len(fields) == 0 || strings.HasPrefix(line, "#"):
+			// empty line or warning
+		case fields[0] == "Chain":
+			stats, err := parseChainHeader(line)
+			if err != nil {
+				return nil, err
+			}
+			chains = append(chains, stats)
+			rules = append(rules, nil)
+		case fields[0] == "pkts":
+			// column header
+		case len(chains) == 0:
+			return nil, fmt.Errorf("rule listed before any chain: %q", line)
+		default:
+			rules[len(rules)-1] = append(rules[len(rules)-1], line)
+		}
+	}
+
+	for i, stats := range chains {
+		rows, err := statsRows(rules[i])
+		if err != nil {
+			return nil, err
+		}
+		stats.Rules = []Stat{}
+		for _, row := range rows {
+			stat, err := ipt.ParseStat(row)
+			if err != nil {
+				return nil, err
+			}
+			stats.Rules = append(stats.Rules, stat)
+		}
+	}
+	return chains, nil
+}
+
+// parseChainHeader parses the "Chain ..." line preceding the rules of a
+// chain.
+func parseChainHeader(line string) (*ChainStats, error) {
+	groups := chainHeaderRegex.FindStringSubmatch(line)
+	if groups == nil {
+		return nil, fmt.Errorf("could not parse chain header %q", line)
+	}
+
+	stats := &ChainStats{Chain: groups[1]}
+	if groups[2] != "" {
+		var err error
+		stats.Policy = groups[2]
+		if stats.PolicyPackets, err = strconv.ParseUint(groups[3], 10, 64); err != nil {
+			return nil, fmt.Errorf("could not parse policy packets: %v", err)
+		}
+		if stats.PolicyBytes, err = strconv.ParseUint(groups[4], 10, 64); err != nil {
+			return nil, fmt.Errorf("could not parse policy bytes: %v", err)
+		}
+		return stats, nil
+	}
+
+	refs, err := strconv.Atoi(groups[5])
+	if err != nil {
+		return nil, fmt.Errorf("could not parse references: %v", err)
+	}
+	stats.References = refs
+	return stats, nil
+}
@@ -0,0 +1,186 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+func TestParseChainHeader(t *testing.T) {
+	testCases := []struct {
+		in  string
+		out *ChainStats
+		err bool
+	}{
+		{
+			"Chain INPUT (policy ACCEPT 123 packets, 4567 bytes)",
+			&ChainStats{Chain: "INPUT", Policy: "ACCEPT", PolicyPackets: 123, PolicyBytes: 4567},
+			false,
+		},
+		{
+			"Chain FORWARD (policy DROP 18446744073709551615 packets, 0 bytes)",
+			&ChainStats{Chain: "FORWARD", Policy: "DROP", PolicyPackets: 18446744073709551615},
+			false,
+		},
+		{
+			"Chain KUBE-SERVICES (2 references)",
+			&ChainStats{Chain: "KUBE-SERVICES", References: 2},
+			false,
+		},
+		{
+			"Chain TEST-1 (0 references)",
+			&ChainStats{Chain: "TEST-1"},
+			false,
+		},
+		{
+			"    pkts      bytes target     prot opt in     out     source               destination",
+			nil,
+			true,
+		},
+	}
+
+	for _, tt := range testCases {
+		t.Run(tt.in, func(t *testing.T) {
+			stats, err := parseChainHeader(tt.in)
+			if err == nil && tt.err {
+				t.Fatal("expected err, got none")
+			} else if err != nil && !tt.err {
+				t.Fatalf("unexpected err %s", err)
+			}
+			if !reflect.DeepEqual(stats, tt.out) {
+				t.Fatalf("parseChainHeader mismatch: \ngot  %#v \nneed %#v", stats, tt.out)
+			}
+		})
+	}
+}
+
+func TestParseStatsListing(t *testing.T) {
+	lines := []string{
+		"Chain INPUT (policy DROP 12 packets, 720 bytes)",
+		"    pkts      bytes target     prot opt in     out     source               destination         ",
+		"     100     6000 ACCEPT     6    --  *      *       0.0.0.0/0            0.0.0.0/0            tcp dpt:22",
+		"       3      180 APP        0    --  eth0   *       10.0.0.0/8           0.0.0.0/0           ",
+		"",
+		"Chain FORWARD (policy ACCEPT 0 packets, 0 bytes)",
+		"    pkts      bytes target     prot opt in     out     source               destination         ",
+		"",
+		"Chain APP (1 references)",
+		"    pkts      bytes target     prot opt in     out     source               destination         ",
+		"       3      180 RETURN     0    --  *      *       0.0.0.0/0            0.0.0.0/0           ",
+	}
+
+	ipt := &IPTables{proto: ProtocolIPv4}
+	chains, err := ipt.parseStatsListing(lines)
+	if err != nil {
+		t.Fatalf("parseStatsListing failed: %v", err)
+	}
+
+	any, _ := ParseInvertibleNet("0.0.0.0/0")
+	private, _ := ParseInvertibleNet("10.0.0.0/8")
+	expected := []*ChainStats{
+		{
+			Chain: "INPUT", Policy: "DROP", PolicyPackets: 12, PolicyBytes: 720,
+			Rules: []Stat{
+				{100, 6000, "ACCEPT", "6", "--", "*", "*", any, any, "tcp dpt:22"},
+				{3, 180, "APP", "0", "--", "eth0", "*", private, any, ""},
+			},
+		},
+		{Chain: "FORWARD", Policy: "ACCEPT", Rules: []Stat{}},
+		{
+			Chain: "APP", References: 1,
+			Rules: []Stat{
+				{3, 180, "RETURN", "0", "--", "*", "*", any, any, ""},
+			},
+		},
+	}
+	if !reflect.DeepEqual(chains, expected) {
+		t.Fatalf("parseStatsListing mismatch: \ngot  %#v \nneed %#v", chains, expected)
+	}
+
+	if _, err := ipt.parseStatsListing([]string{"       3      180 RETURN     0    --  *      *       0.0.0.0/0            0.0.0.0/0"}); err == nil {
+		t.Fatal("expected error for rule without chain header")
+	}
+}
+
+func TestZeroCounters(t *testing.T) {
+	for i, ipt := range mustTestableIptables() {
+		t.Run(fmt.Sprint(i), func(t *testing.T) {
+			runZeroCountersTests(t, ipt)
+		})
+	}
+}
+
+func runZeroCountersTests(t *testing.T, ipt *IPTables) {
+	chain := randChain(t)
+	if err := ipt.NewChain("filter", chain); err != nil {
+		t.Fatalf("NewChain failed: %v", err)
+	}
+	defer func() {
+		if err := ipt.ClearAndDeleteChain("filter", chain); err != nil {
+			t.Fatalf("ClearAndDeleteChain failed: %v", err)
+		}
+	}()
+
+	counts := func() []uint64 {
+		stats, err := ipt.ChainStats("filter", chain)
+		if err != nil {
+			t.Fatalf("ChainStats failed: %v", err)
+		}
+		var counts []uint64
+		for _, s := range stats.Rules {
+			counts = append(counts, s.Packets, s.Bytes)
+		}
+		return counts
+	}
+	setCounters := func() {
+		if err := ipt.ClearChain("filter", chain); err != nil {
+			t.Fatalf("ClearChain failed: %v", err)
+		}
+		for _, target := range []string{"ACCEPT", "DROP"} {
+			if err := ipt.Append("filter", chain, "-c", "5", "100", "-j", target); err != nil {
+				t.Fatalf("Append failed: %v", err)
+			}
+		}
+	}
+
+	setCounters()
+	stats, err := ipt.StatsAndZero("filter", chain)
+	if err != nil {
+		t.Fatalf("StatsAndZero failed: %v", err)
+	}
+	if len(stats.Rules) != 2 || stats.Rules[0].Packets != 5 || stats.Rules[0].Bytes != 100 {
+		t.Fatalf("StatsAndZero returned wrong counters: %#v", stats.Rules)
+	}
+	if c := counts(); !reflect.DeepEqual(c, []uint64{0, 0, 0, 0}) {
+		t.Fatalf("StatsAndZero didn't zero the counters: %v", c)
+	}
+
+	setCounters()
+	if err := ipt.ZeroRuleCounters("filter", chain, 2); err != nil {
+		t.Fatalf("ZeroRuleCounters failed: %v", err)
+	}
+	if c := counts(); !reflect.DeepEqual(c, []uint64{5, 100, 0, 0}) {
+		t.Fatalf("ZeroRuleCounters zeroed the wrong counters: %v", c)
+	}
+
+	if err := ipt.ZeroCounters("filter", chain); err != nil {
+		t.Fatalf("ZeroCounters failed: %v", err)
+	}
+	if c := counts(); !reflect.DeepEqual(c, []uint64{0, 0, 0, 0}) {
+		t.Fatalf("ZeroCounters didn't zero the counters: %v", c)
+	}
+}
@@ -0,0 +1,343 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// conntrackStates are the states of the conntrack match, in the order
+// iptables lists them.
+var conntrackStates = []string{"INVALID", "NEW", "RELATED", "ESTABLISHED", "UNTRACKED", "SNAT", "DNAT"}
+
+// conntrackStatuses are the statuses of the conntrack match, in the order
+// iptables lists them. NONE is only listed on its own.
+var conntrackStatuses = []string{"EXPECTED", "SEEN_REPLY", "ASSURED", "CONFIRMED"}
+
+// Conntrack is the conntrack match, matching the connection tracking entry
+// of packets.
+type Conntrack struct {
+	// States are the connection states, e.g. "NEW" or "ESTABLISHED".
+	States       []string
+	InvertStates bool
+	// Status are the connection statuses: "NONE", "EXPECTED", "SEEN_REPLY",
+	// "ASSURED" or "CONFIRMED".
+	Status       []string
+	InvertStatus bool
+	// OrigSrc and OrigDst match the addresses of the original direction of
+	// the connection, before NAT, e.g. "10.0.0.0/8".
+	OrigSrc       string
+	InvertOrigSrc bool
+	OrigDst       string
+	InvertOrigDst bool
+	// Direction is "ORIGINAL" or "REPLY", the direction of the packet in
+	// the connection.
+	Direction string
+}
+
+// args returns the arguments of the match, without "-m conntrack", in the
+// order iptables lists them.
+func (c Conntrack) args() ([]string, error) {
+	var args []string
+	flag := func(invert bool, name, value string) {
+		if invert {
+			args = append(args, "!")
+		}
+		args = append(args, name, value)
+	}
+
+	if len(c.States) > 0 {
+		states, err := sortFlags("conntrack state", c.States, conntrackStates)
+		if err != nil {
+			return nil, err
+		}
+		flag(c.InvertStates, "--ctstate", strings.Join(states, ","))
+	} else if c.InvertStates {
+		return nil, fmt.Errorf("no conntrack state to invert")
+	}
+
+	for _, addr := range []struct {
+		name   string
+		value  string
+		invert bool
+	}{{"--ctorigsrc", c.OrigSrc, c.InvertOrigSrc}, {"--ctorigdst", c.OrigDst, c.InvertOrigDst}} {
+		if addr.value == "" {
+			if addr.invert {
+				return nil, fmt.Errorf("no %s to invert", addr.name)
+			}
+			continue
+		}
+		value, err := conntrackAddress(addr.value)
+		if err != nil {
+			return nil, err
+		}
+		flag(addr.invert, addr.name, value)
+	}
+
+	if len(c.Status) > 0 {
+		var status []string
+		var none bool
+		for _, s := range c.Status {
+			if strings.ToUpper(s) == "NONE" {
+				none = true
+			} else {
+				status = append(status, s)
+			}
+		}
+		status, err := sortFlags("conntrack status", status, conntrackStatuses)
+		if err != nil {
+			return nil, err
+		}
+		// NONE is no status bit, so it only shows on its own
+		if len(status) == 0 && none {
+			status = []string{"NONE"}
+		}
+		flag(c.InvertStatus, "--ctstatus", strings.Join(status, ","))
+	} else if c.InvertStatus {
+		return nil, fmt.Errorf("no conntrack status to invert")
+	}
+
+	switch strings.ToUpper(c.Direction) {
+	case "":
+	case "ORIGINAL":
+		args = append(args, "--ctdir", "ORIGINAL")
+	case "REPLY":
+		args = append(args, "--ctdir", "REPLY")
+	default:
+		return nil, fmt.Errorf("invalid conntrack direction %q", c.Direction)
+	}
+
+	if len(args) == 0 {
+		return nil, fmt.Errorf("empty conntrack match")
+	}
+	return args, nil
+}
+
+// sortFlags upper-cases flags and sorts them in the given order, dropping
+// duplicates.
+func sortFlags(what string, flags, order []string) ([]string, error) {
+	want := map[string]bool{}
+	for _, f := range flags {
+		want[strings.ToUpper(f)] = true
+	}
+	var sorted []string
+	for _, f := range order {
+		if want[f] {
+			sorted = append(sorted, f)
+			delete(want, f)
+		}
+	}
+	for _, f := range flags {
+		if want[strings.ToUpper(f)] {
+			return nil, fmt.Errorf("unknown %s %q", what, f)
+		}
+	}
+	return sorted, nil
+}
+
+// conntrackAddress normalizes an address of the conntrack match the way
+// iptables lists it: the prefix length is left out for a single address.
+func conntrackAddress(cidr string) (string, error) {
+	ip, ipnet, err := net.ParseCIDR(appendSubnet(cidr))
+	if err != nil {
+		return "", fmt.Errorf("invalid conntrack address %q", cidr)
+	}
+	if ones, bits := ipnet.Mask.Size(); ones == bits {
+		return ip.String(), nil
+	}
+	return ipnet.String(), nil
+}
+
+// Conntrack adds a conntrack match to the rule.
+func (r *Rule) Conntrack(c Conntrack) *Rule {
+	r.noNot("conntrack match")
+	args, err := c.args()
+	if err != nil {
+		r.errs = append(r.errs, err)
+		return r
+	}
+	return r.addMatch("conntrack", args...)
+}
+
+// comparableRule returns rulespec as a single line in which the state match
+// is replaced by the equivalent conntrack match and conntrack states are
+// sorted, so that "-m state --state ESTABLISHED,RELATED" and
+// "-m conntrack --ctstate RELATED,ESTABLISHED" compare equal.
+func comparableRule(rulespec []string) string {
+	var out []string
+	module := ""
+	for i := 0; i < len(rulespec); i++ {
+		arg := rulespec[i]
+		switch {
+		case arg == "-m" && i+1 < len(rulespec):
+			module = rulespec[i+1]
+			if module == "state" {
+				out = append(out, "-m", "conntrack")
+				i++
+				continue
+			}
+		case (module == "state" && arg == "--state" || module == "conntrack" && arg == "--ctstate") && i+1 < len(rulespec):
+			value := rulespec[i+1]
+			if states, err := sortFlags("conntrack state", strings.Split(value, ","), conntrackStates); err == nil {
+				value = strings.Join(states, ",")
+			}
+			out = append(out, "--ctstate", value)
+			i++
+			continue
+		}
+		out = append(out, arg)
+	}
+	return joinRulespec(out)
+}
+
+// hasStateMatch returns true if rulespec uses the state or conntrack match.
+func hasStateMatch(rulespec []string) bool {
+	for i := 0; i+1 < len(rulespec); i++ {
+		if rulespec[i] == "-m" && (rulespec[i+1] == "state" || rulespec[i+1] == "conntrack") {
+			return true
+		}
+	}
+	return false
+}
+
+// ExistsEquivalent acts like Exists, except that a rule using the state
+// match is also found by the equivalent conntrack match, and the other way
+// around. Equivalence only works for rulespecs in the canonical form listed
+// by "iptables -S", e.g. "-p tcp -m tcp --dport 22" rather than
+// "-p tcp --dport 22". When a state or conntrack rule isn't found as is, the
+// chain is listed to look for the equivalent rule, which costs an extra
+// "iptables -v -S" invocation. AppendUnique, InsertUnique and DeleteIfExists
+// keep matching exactly, while EnsureStatefulPrelude applies the same
+// equivalence.
+func (ipt *IPTables) ExistsEquivalent(table, chain string, rulespec ...string) (bool, error) {
+	exists, err := ipt.Exists(table, chain, rulespec...)
+	if err != nil || exists || !hasStateMatch(rulespec) {
+		return exists, err
+	}
+	// the state match and the conntrack match are different matches to
+	// iptables, look for a listed rule using the other one
+	return ipt.existsEquivalent(table, chain, rulespec)
+}
+
+// existsEquivalent checks for a listed rule of table/chain that is equal to
+// rulespec, once state matches are normalized.
+func (ipt *IPTables) existsEquivalent(table, chain string, rulespec []string) (bool, error) {
+	state, err := ipt.chainState(table, chain)
+	if err != nil {
+		return false, err
+	}
+	want := comparableRule(rulespec)
+	for _, rule := range state.rules {
+		if comparableRule(rule) == want {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// statefulPrelude are the rules starting a stateful chain: packets of known
+// connections are accepted, and invalid ones dropped.
+var statefulPrelude = [][]string{
+	{"-m", "conntrack", "--ctstate", "RELATED,ESTABLISHED", "-j", "ACCEPT"},
+	{"-m", "conntrack", "--ctstate", "INVALID", "-j", "DROP"},
+}
+
+// EnsureStatefulPrelude makes sure table/chain starts with the rules
+// accepting the packets of established and related connections, then
+// dropping invalid packets. Equivalent rules using the state match are
+// accepted as is. Copies of these rules elsewhere in the chain are removed,
+// and moved rules keep their counters.
+func (ipt *IPTables) EnsureStatefulPrelude(table, chain string) error {
+	state, err := ipt.chainState(table, chain)
+	if err != nil {
+		return err
+	}
+	if !state.exists {
+		return fmt.Errorf("chain %s does not exist in table %s", chain, table)
+	}
+	ops := planPrelude(table, chain, statefulPrelude, state)
+	if len(ops) == 0 {
+		return nil
+	}
+	return ipt.restore(restoreScript(ops), false)
+}
+
+// planPrelude returns the operations that leave exactly one copy of each
+// prelude rule, at the start of the chain and in order.
+func planPrelude(table, chain string, prelude [][]string, state *chainState) []Operation {
+	return planRuleBlock(table, chain, prelude, 1, state)
+}
+
+// planRuleBlock returns the operations leaving exactly one copy of each of
+// rules in the chain, next to each other and in order. Rules are compared
+// once state matches are normalized. The block starts at position anchor of
+// the resulting chain, or if anchor is 0, where its first rule was, and is
+// appended if none of its rules exist. Rules that are moved keep their
+// counters.
+func planRuleBlock(table, chain string, rules [][]string, anchor int, state *chainState) []Operation {
+	wanted := map[string]int{}
+	for i, rule := range rules {
+		wanted[comparableRule(rule)] = i
+	}
+
+	// found lists the positions of the copies of each rule
+	found := make([][]int, len(rules))
+	first := 0
+	for i, rule := range state.rules {
+		j, ok := wanted[comparableRule(rule)]
+		if !ok {
+			continue
+		}
+		found[j] = append(found[j], i+1)
+		if first == 0 {
+			first = i + 1
+		}
+	}
+	if anchor == 0 {
+		// no rule before first is deleted, so the block starts at first
+		anchor = first
+	}
+	inPlace := anchor != 0
+	for j := range rules {
+		if len(found[j]) != 1 || found[j][0] != anchor+j {
+			inPlace = false
+		}
+	}
+	if inPlace {
+		return nil
+	}
+
+	var ops []Operation
+	for i := len(state.rules) - 1; i >= 0; i-- {
+		if _, ok := wanted[comparableRule(state.rules[i])]; ok {
+			ops = append(ops, Operation{Kind: OpDeleteRule, Table: table, Chain: chain, Position: i + 1, Rulespec: state.rules[i]})
+		}
+	}
+	for j, rule := range rules {
+		op := Operation{Kind: OpAppendRule, Table: table, Chain: chain, Rulespec: rule}
+		if anchor != 0 {
+			op.Kind, op.Position = OpInsertRule, anchor+j
+		}
+		if len(found[j]) > 0 && found[j][0] <= len(state.counters) {
+			if counters := state.counters[found[j][0]-1]; counters != (Counters{}) {
+				op.Counters = &counters
+			}
+		}
+		ops = append(ops, op)
+	}
+	return ops
+}
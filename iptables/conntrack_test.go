@@ -0,0 +1,322 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+func TestConntrackArgs(t *testing.T) {
+	testCases := []struct {
+		name    string
+		match   Conntrack
+		args    string
+		wantErr bool
+	}{
+		{
+			name:  "states",
+			match: Conntrack{States: []string{"established", "RELATED", "established"}},
+			args:  "-m conntrack --ctstate RELATED,ESTABLISHED",
+		},
+		{
+			name: "everything",
+			match: Conntrack{
+				States:        []string{"DNAT"},
+				Status:        []string{"CONFIRMED", "assured"},
+				InvertStatus:  true,
+				OrigSrc:       "10.1.2.3/8",
+				OrigDst:       "192.168.0.1",
+				InvertOrigDst: true,
+				Direction:     "reply",
+			},
+			args: "-m conntrack --ctstate DNAT --ctorigsrc 10.0.0.0/8 ! --ctorigdst 192.168.0.1 ! --ctstatus ASSURED,CONFIRMED --ctdir REPLY",
+		},
+		{
+			name:  "ipv6 origin",
+			match: Conntrack{OrigSrc: "2001:db8::1/128", Direction: "ORIGINAL"},
+			args:  "-m conntrack --ctorigsrc 2001:db8::1 --ctdir ORIGINAL",
+		},
+		{
+			name:  "status none",
+			match: Conntrack{Status: []string{"NONE"}},
+			args:  "-m conntrack --ctstatus NONE",
+		},
+		{name: "empty", match: Conntrack{}, wantErr: true},
+		{name: "unknown state", match: Conntrack{States: []string{"NEW", "BOGUS"}}, wantErr: true},
+		{name: "unknown status", match: Conntrack{Status: []string{"BOGUS"}}, wantErr: true},
+		{name: "invalid address", match: Conntrack{OrigSrc: "10.0.0"}, wantErr: true},
+		{name: "invalid direction", match: Conntrack{Direction: "BOTH"}, wantErr: true},
+		{name: "invert nothing", match: Conntrack{InvertStates: true, Direction: "REPLY"}, wantErr: true},
+	}
+
+	for _, tt := range testCases {
+		t.Run(tt.name, func(t *testing.T) {
+			args, err := NewRule().Conntrack(tt.match).Args()
+			if err == nil && tt.wantErr {
+				t.Fatalf("expected err, got %q", args)
+			} else if err != nil && !tt.wantErr {
+				t.Fatalf("unexpected err %s", err)
+			}
+			if tt.wantErr {
+				return
+			}
+			if got := joinRulespec(args); got != tt.args {
+				t.Fatalf("args mismatch: \ngot  %s \nneed %s", got, tt.args)
+			}
+		})
+	}
+}
+
+func TestComparableRule(t *testing.T) {
+	conntrack := "-p tcp -m conntrack --ctstate RELATED,ESTABLISHED -j ACCEPT"
+	for _, rule := range []string{
+		conntrack,
+		"-p tcp -m state --state RELATED,ESTABLISHED -j ACCEPT",
+		"-p tcp -m state --state ESTABLISHED,RELATED -j ACCEPT",
+		"-p tcp -m conntrack --ctstate ESTABLISHED,RELATED -j ACCEPT",
+	} {
+		args, err := splitRulespec(rule)
+		if err != nil {
+			t.Fatalf("splitRulespec failed: %v", err)
+		}
+		if got := comparableRule(args); got != conntrack {
+			t.Fatalf("comparableRule mismatch: \ngot  %s \nneed %s", got, conntrack)
+		}
+	}
+
+	for _, rule := range []string{
+		"-p tcp -m state ! --state RELATED,ESTABLISHED -j ACCEPT",
+		"-p tcp -m conntrack --ctstate ESTABLISHED -j ACCEPT",
+		"-p tcp -m comment --comment --state -j ACCEPT",
+	} {
+		args, err := splitRulespec(rule)
+		if err != nil {
+			t.Fatalf("splitRulespec failed: %v", err)
+		}
+		if got := comparableRule(args); got == conntrack {
+			t.Fatalf("comparableRule of %q unexpectedly equal to %q", rule, conntrack)
+		}
+	}
+}
+
+func TestPlanPrelude(t *testing.T) {
+	established := []string{"-m", "state", "--state", "RELATED,ESTABLISHED", "-j", "ACCEPT"}
+	invalid := []string{"-m", "conntrack", "--ctstate", "INVALID", "-j", "DROP"}
+	other := []string{"-p", "tcp", "-j", "ACCEPT"}
+
+	testCases := []struct {
+		name     string
+		rules    [][]string
+		counters []Counters
+		ops      []string
+	}{
+		{
+			name:  "in place with state match",
+			rules: [][]string{established, invalid, other},
+		},
+		{
+			name:  "empty chain",
+			rules: nil,
+			ops: []string{
+				"-t filter -I INPUT 1 -m conntrack --ctstate RELATED,ESTABLISHED -j ACCEPT",
+				"-t filter -I INPUT 2 -m conntrack --ctstate INVALID -j DROP",
+			},
+		},
+		{
+			name:     "misplaced",
+			rules:    [][]string{other, established, invalid, established},
+			counters: []Counters{{}, {Packets: 5, Bytes: 600}, {}, {}},
+			ops: []string{
+				"-t filter -D INPUT 4",
+				"-t filter -D INPUT 3",
+				"-t filter -D INPUT 2",
+				"-t filter -I INPUT 1 -c 5 600 -m conntrack --ctstate RELATED,ESTABLISHED -j ACCEPT",
+				"-t filter -I INPUT 2 -m conntrack --ctstate INVALID -j DROP",
+			},
+		},
+	}
+
+	for _, tt := range testCases {
+		t.Run(tt.name, func(t *testing.T) {
+			ops := planPrelude("filter", "INPUT", statefulPrelude, &chainState{exists: true, rules: tt.rules, counters: tt.counters})
+			var got []string
+			for _, op := range ops {
+				got = append(got, op.String())
+			}
+			if !reflect.DeepEqual(got, tt.ops) {
+				t.Fatalf("planPrelude mismatch: \ngot  %#v \nneed %#v", got, tt.ops)
+			}
+		})
+	}
+}
+
+func TestPlanRuleBlock(t *testing.T) {
+	a := []string{"-p", "tcp", "-j", "A"}
+	b := []string{"-j", "B"}
+	other := []string{"-j", "ACCEPT"}
+
+	testCases := []struct {
+		name     string
+		anchor   int
+		rules    [][]string
+		counters []Counters
+		ops      []string
+	}{
+		{
+			name:  "in place",
+			rules: [][]string{other, a, b, other},
+		},
+		{
+			name:  "missing",
+			rules: [][]string{other},
+			ops: []string{
+				"-t mangle -A PREROUTING -p tcp -j A",
+				"-t mangle -A PREROUTING -j B",
+			},
+		},
+		{
+			// the first rule must not be appended after the second
+			name:     "first missing",
+			rules:    [][]string{other, b, other},
+			counters: []Counters{{}, {Packets: 5, Bytes: 300}, {}},
+			ops: []string{
+				"-t mangle -D PREROUTING 2",
+				"-t mangle -I PREROUTING 2 -p tcp -j A",
+				"-t mangle -I PREROUTING 3 -c 5 300 -j B",
+			},
+		},
+		{
+			name:  "out of order",
+			rules: [][]string{b, other, a},
+			ops: []string{
+				"-t mangle -D PREROUTING 3",
+				"-t mangle -D PREROUTING 1",
+				"-t mangle -I PREROUTING 1 -p tcp -j A",
+				"-t mangle -I PREROUTING 2 -j B",
+			},
+		},
+		{
+			name:   "anchored",
+			anchor: 2,
+			rules:  [][]string{other, b, a},
+			ops: []string{
+				"-t mangle -D PREROUTING 3",
+				"-t mangle -D PREROUTING 2",
+				"-t mangle -I PREROUTING 2 -p tcp -j A",
+				"-t mangle -I PREROUTING 3 -j B",
+			},
+		},
+		{
+			name:  "duplicates",
+			rules: [][]string{a, b, other, b, a},
+			ops: []string{
+				"-t mangle -D PREROUTING 5",
+				"-t mangle -D PREROUTING 4",
+				"-t mangle -D PREROUTING 2",
+				"-t mangle -D PREROUTING 1",
+				"-t mangle -I PREROUTING 1 -p tcp -j A",
+				"-t mangle -I PREROUTING 2 -j B",
+			},
+		},
+	}
+
+	for _, tt := range testCases {
+		t.Run(tt.name, func(t *testing.T) {
+			ops := planRuleBlock("mangle", "PREROUTING", [][]string{a, b}, tt.anchor, &chainState{exists: true, rules: tt.rules, counters: tt.counters})
+			var got []string
+			for _, op := range ops {
+				got = append(got, op.String())
+			}
+			if !reflect.DeepEqual(got, tt.ops) {
+				t.Fatalf("planRuleBlock mismatch: \ngot  %#v \nneed %#v", got, tt.ops)
+			}
+		})
+	}
+}
+
+func TestStatefulPrelude(t *testing.T) {
+	for i, ipt := range mustTestableIptables() {
+		t.Run(fmt.Sprint(i), func(t *testing.T) {
+			runStatefulPreludeTests(t, ipt)
+		})
+	}
+}
+
+func runStatefulPreludeTests(t *testing.T, ipt *IPTables) {
+	chain := randChain(t)
+	if err := ipt.NewChain("filter", chain); err != nil {
+		t.Fatalf("NewChain failed: %v", err)
+	}
+	defer func() {
+		if err := ipt.ClearAndDeleteChain("filter", chain); err != nil {
+			t.Fatalf("ClearAndDeleteChain failed: %v", err)
+		}
+	}()
+
+	// a rule written with the state match is found by the conntrack form
+	if err := ipt.Append("filter", chain, "-m", "state", "--state", "ESTABLISHED,RELATED", "-j", "ACCEPT"); err != nil {
+		t.Fatalf("Append failed: %v", err)
+	}
+	exists, err := ipt.ExistsEquivalent("filter", chain, statefulPrelude[0]...)
+	if err != nil {
+		t.Fatalf("ExistsEquivalent failed: %v", err)
+	}
+	if !exists {
+		t.Fatalf("ExistsEquivalent didn't find the state rule by its conntrack form")
+	}
+	// Exists stays exact, so that DeleteIfExists leaves the state rule alone
+	exists, err = ipt.Exists("filter", chain, statefulPrelude[0]...)
+	if err != nil {
+		t.Fatalf("Exists failed: %v", err)
+	}
+	if exists {
+		t.Fatalf("Exists found the state rule by its conntrack form")
+	}
+	if err := ipt.DeleteIfExists("filter", chain, statefulPrelude[0]...); err != nil {
+		t.Fatalf("DeleteIfExists failed: %v", err)
+	}
+
+	if err := ipt.Append("filter", chain, "-p", "tcp", "-j", "ACCEPT"); err != nil {
+		t.Fatalf("Append failed: %v", err)
+	}
+	for i := 0; i < 2; i++ {
+		if err := ipt.EnsureStatefulPrelude("filter", chain); err != nil {
+			t.Fatalf("EnsureStatefulPrelude failed: %v", err)
+		}
+	}
+
+	state, err := ipt.chainState("filter", chain)
+	if err != nil {
+		t.Fatalf("chainState failed: %v", err)
+	}
+	var got []string
+	for _, rule := range state.rules {
+		got = append(got, comparableRule(rule))
+	}
+	need := []string{
+		comparableRule(statefulPrelude[0]),
+		comparableRule(statefulPrelude[1]),
+		"-p tcp -j ACCEPT",
+	}
+	if !reflect.DeepEqual(got, need) {
+		t.Fatalf("rules mismatch: \ngot  %q \nneed %q", got, need)
+	}
+
+	if err := ipt.EnsureStatefulPrelude("filter", "NO-SUCH-"+chain); err == nil {
+		t.Fatalf("expected err for a missing chain, got none")
+	}
+}
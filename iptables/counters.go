@@ -0,0 +1,77 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables
+
+import (
+	"fmt"
+	"strconv"
+)
+
+// Counters are the packet and byte counters of a rule.
+type Counters struct {
+	Packets uint64 `json:"pkts"`
+	Bytes   uint64 `json:"bytes"`
+}
+
+// args returns the counters as "-c packets bytes" arguments.
+func (c Counters) args() []string {
+	return []string{"-c", strconv.FormatUint(c.Packets, 10), strconv.FormatUint(c.Bytes, 10)}
+}
+
+// AppendWithCounters acts like Append, with the counters of the new rule
+// set to counters instead of zero.
+func (ipt *IPTables) AppendWithCounters(table, chain string, counters Counters, rulespec ...string) error {
+	cmd := append([]string{"-t", table, "-A", chain}, counters.args()...)
+	return ipt.run(append(cmd, rulespec...)...)
+}
+
+// InsertWithCounters acts like Insert, with the counters of the new rule
+// set to counters instead of zero.
+func (ipt *IPTables) InsertWithCounters(table, chain string, pos int, counters Counters, rulespec ...string) error {
+	cmd := append([]string{"-t", table, "-I", chain, strconv.Itoa(pos)}, counters.args()...)
+	return ipt.run(append(cmd, rulespec...)...)
+}
+
+// ReplaceWithCounters acts like Replace, with the counters of the new rule
+// set to counters. Replace alone resets them to zero.
+func (ipt *IPTables) ReplaceWithCounters(table, chain string, pos int, counters Counters, rulespec ...string) error {
+	cmd := append([]string{"-t", table, "-R", chain, strconv.Itoa(pos)}, counters.args()...)
+	return ipt.run(append(cmd, rulespec...)...)
+}
+
+// splitCounters removes the "-c packets bytes" arguments listed by
+// "iptables -v -S" from a rule, wherever they appear, and returns them
+// separately.
+func splitCounters(args []string) ([]string, Counters, error) {
+	var counters Counters
+	for i, arg := range args {
+		if arg != "-c" && arg != "--set-counters" {
+			continue
+		}
+		if i+2 >= len(args) {
+			return nil, counters, fmt.Errorf("missing counters in rule %q", args)
+		}
+		var err error
+		if counters.Packets, err = strconv.ParseUint(args[i+1], 10, 64); err != nil {
+			return nil, counters, fmt.Errorf("could not parse packets: %v", err)
+		}
+		if counters.Bytes, err = strconv.ParseUint(args[i+2], 10, 64); err != nil {
+			return nil, counters, fmt.Errorf("could not parse bytes: %v", err)
+		}
+		rest := append([]string{}, args[:i]...)
+		return append(rest, args[i+3:]...), counters, nil
+	}
+	return args, counters, nil
+}
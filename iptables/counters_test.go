@@ -0,0 +1,123 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestSplitCounters(t *testing.T) {
+	testCases := []struct {
+		args     string
+		rest     string
+		counters Counters
+		wantErr  bool
+	}{
+		{"-A X -s 10.0.0.1/32 -c 1 2 -j ACCEPT", "-A X -s 10.0.0.1/32 -j ACCEPT", Counters{1, 2}, false},
+		{"-A X -j ACCEPT -c 10 2000", "-A X -j ACCEPT", Counters{10, 2000}, false},
+		{"-P INPUT ACCEPT -c 0 0", "-P INPUT ACCEPT", Counters{}, false},
+		{"-A X -j ACCEPT", "-A X -j ACCEPT", Counters{}, false},
+		{"-A X -j ACCEPT -c 1", "", Counters{}, true},
+		{"-A X -c a b -j ACCEPT", "", Counters{}, true},
+	}
+
+	for i, tt := range testCases {
+		t.Run(fmt.Sprint(i), func(t *testing.T) {
+			rest, counters, err := splitCounters(strings.Fields(tt.args))
+			if err == nil && tt.wantErr {
+				t.Fatal("expected err, got none")
+			} else if err != nil && !tt.wantErr {
+				t.Fatalf("unexpected err %s", err)
+			}
+			if tt.wantErr {
+				return
+			}
+			if strings.Join(rest, " ") != tt.rest || counters != tt.counters {
+				t.Fatalf("splitCounters mismatch: \ngot  %q %#v \nneed %q %#v", rest, counters, tt.rest, tt.counters)
+			}
+		})
+	}
+}
+
+func TestRulesWithCounters(t *testing.T) {
+	for i, ipt := range mustTestableIptables() {
+		t.Run(fmt.Sprint(i), func(t *testing.T) {
+			runRulesWithCountersTests(t, ipt)
+		})
+	}
+}
+
+func runRulesWithCountersTests(t *testing.T, ipt *IPTables) {
+	chain := randChain(t)
+	if err := ipt.NewChain("filter", chain); err != nil {
+		t.Fatalf("NewChain failed: %v", err)
+	}
+	defer func() {
+		if err := ipt.ClearAndDeleteChain("filter", chain); err != nil {
+			t.Fatalf("ClearAndDeleteChain failed: %v", err)
+		}
+	}()
+
+	counters := func() []Counters {
+		state, err := ipt.chainState("filter", chain)
+		if err != nil {
+			t.Fatalf("chainState failed: %v", err)
+		}
+		return state.counters
+	}
+
+	if err := ipt.AppendWithCounters("filter", chain, Counters{1, 100}, "-j", "ACCEPT"); err != nil {
+		t.Fatalf("AppendWithCounters failed: %v", err)
+	}
+	if err := ipt.InsertWithCounters("filter", chain, 1, Counters{2, 200}, "-j", "DROP"); err != nil {
+		t.Fatalf("InsertWithCounters failed: %v", err)
+	}
+	if err := ipt.ReplaceWithCounters("filter", chain, 2, Counters{3, 300}, "-j", "RETURN"); err != nil {
+		t.Fatalf("ReplaceWithCounters failed: %v", err)
+	}
+	expected := []Counters{{2, 200}, {3, 300}}
+	if got := counters(); !reflect.DeepEqual(got, expected) {
+		t.Fatalf("counters mismatch: \ngot  %#v \nneed %#v", got, expected)
+	}
+
+	// swapping the rules keeps the counters with them
+	plan, err := ipt.Plan(Ruleset{{Table: "filter", Chain: chain, Rules: [][]string{
+		{"-j", "RETURN"},
+		{"-j", "DROP"},
+	}}})
+	if err != nil {
+		t.Fatalf("Plan failed: %v", err)
+	}
+	if err := ipt.Apply(plan); err != nil {
+		t.Fatalf("Apply failed: %v", err)
+	}
+	expected = []Counters{{3, 300}, {2, 200}}
+	if got := counters(); !reflect.DeepEqual(got, expected) {
+		t.Fatalf("counters after Apply mismatch: \ngot  %#v \nneed %#v", got, expected)
+	}
+
+	// so does rewriting the chain
+	m := ipt.NewManagedChain("filter", chain)
+	if err := m.Sync([][]string{{"-j", "DROP"}, {"-j", "ACCEPT"}}); err != nil {
+		t.Fatalf("Sync failed: %v", err)
+	}
+	expected = []Counters{{2, 200}, {0, 0}}
+	if got := counters(); !reflect.DeepEqual(got, expected) {
+		t.Fatalf("counters after Sync mismatch: \ngot  %#v \nneed %#v", got, expected)
+	}
+}
@@ -0,0 +1,231 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// cgroupRoot is where the cgroup v2 hierarchy is mounted.
+var cgroupRoot = "/sys/fs/cgroup"
+
+// SocketOwner is the owner match, matching locally generated packets by the
+// owner of their socket.
+type SocketOwner struct {
+	// UID and GID are a user or group id, e.g. "1000", or an inclusive
+	// range, e.g. "1000-1999". Names aren't accepted, since iptables lists
+	// them as ids.
+	UID       string
+	InvertUID bool
+	GID       string
+	InvertGID bool
+	// SupplementaryGroups also matches GID against the supplementary
+	// groups of the socket's owner.
+	SupplementaryGroups bool
+	// SocketExists matches packets that have a socket.
+	SocketExists       bool
+	InvertSocketExists bool
+}
+
+// args returns the match arguments, in the order listed by "iptables -S".
+func (o SocketOwner) args() ([]string, error) {
+	var args []string
+	if o.SocketExists {
+		if o.InvertSocketExists {
+			args = append(args, "!")
+		}
+		args = append(args, "--socket-exists")
+	} else if o.InvertSocketExists {
+		return nil, fmt.Errorf("no --socket-exists to invert")
+	}
+
+	for _, id := range []struct {
+		name   string
+		value  string
+		invert bool
+	}{{"--uid-owner", o.UID, o.InvertUID}, {"--gid-owner", o.GID, o.InvertGID}} {
+		if id.value == "" {
+			if id.invert {
+				return nil, fmt.Errorf("no %s to invert", id.name)
+			}
+			continue
+		}
+		value, err := ownerIDRange(id.value)
+		if err != nil {
+			return nil, err
+		}
+		if id.invert {
+			args = append(args, "!")
+		}
+		args = append(args, id.name, value)
+	}
+
+	if o.SupplementaryGroups {
+		if o.GID == "" {
+			return nil, fmt.Errorf("--suppl-groups requires a GID")
+		}
+		args = append(args, "--suppl-groups")
+	}
+	if len(args) == 0 {
+		return nil, fmt.Errorf("empty owner match")
+	}
+	return args, nil
+}
+
+// ownerIDRange validates an id or id range and returns it the way iptables
+// lists it.
+func ownerIDRange(s string) (string, error) {
+	parts := strings.SplitN(s, "-", 2)
+	ids := make([]uint64, len(parts))
+	for i, part := range parts {
+		id, err := strconv.ParseUint(part, 10, 32)
+		if err != nil {
+			return "", fmt.Errorf("invalid owner id %q", s)
+		}
+		ids[i] = id
+	}
+	if len(ids) == 1 || ids[0] == ids[1] {
+		return strconv.FormatUint(ids[0], 10), nil
+	}
+	if ids[0] > ids[1] {
+		return "", fmt.Errorf("invalid owner id range %q", s)
+	}
+	return fmt.Sprintf("%d-%d", ids[0], ids[1]), nil
+}
+
+// SocketOwner adds an owner match to the rule. It is only valid in OUTPUT
+// and POSTROUTING, see CheckChain.
+func (r *Rule) SocketOwner(o SocketOwner) *Rule {
+	r.noNot("owner match")
+	args, err := o.args()
+	if err != nil {
+		r.errs = append(r.errs, err)
+		return r
+	}
+	return r.addMatch("owner", args...)
+}
+
+// Cgroup matches the packets of sockets created by the processes of the
+// cgroup v2 path, relative to the root of the hierarchy, e.g.
+// "system.slice/nginx.service". Descendants of the cgroup are matched too.
+// The path isn't required to exist, see CheckCgroupPath.
+func (r *Rule) Cgroup(path string) *Rule {
+	invert := r.takeNot()
+	if err := checkCgroupPathSyntax(path); err != nil {
+		r.errs = append(r.errs, err)
+		return r
+	}
+	var args []string
+	if invert {
+		args = append(args, "!")
+	}
+	return r.addMatch("cgroup", append(args, "--path", path)...)
+}
+
+func checkCgroupPathSyntax(path string) error {
+	if path == "" {
+		return fmt.Errorf("empty cgroup path")
+	}
+	for _, elem := range strings.Split(path, "/") {
+		if elem == ".." {
+			return fmt.Errorf("invalid cgroup path %q", path)
+		}
+	}
+	return nil
+}
+
+// CheckCgroupPath returns an error if path isn't a cgroup of the cgroup v2
+// hierarchy mounted at /sys/fs/cgroup. iptables rejects a cgroup match
+// whose cgroup doesn't exist.
+func CheckCgroupPath(path string) error {
+	return checkCgroupPath(cgroupRoot, path)
+}
+
+func checkCgroupPath(root, path string) error {
+	if err := checkCgroupPathSyntax(path); err != nil {
+		return err
+	}
+	// only the root of a cgroup v2 hierarchy has cgroup.controllers
+	if _, err := os.Stat(filepath.Join(root, "cgroup.controllers")); err != nil {
+		return fmt.Errorf("no cgroup v2 hierarchy at %s", root)
+	}
+	info, err := os.Stat(filepath.Join(root, path))
+	if err != nil || !info.IsDir() {
+		return fmt.Errorf("cgroup %s doesn't exist", path)
+	}
+	return nil
+}
+
+// EgressAllowlist restricts the packets sent by the processes of the cgroup
+// v2 path in the filter table. OUTPUT jumps into a chain accepting replies
+// of established connections and the packets matched by one of allow,
+// e.g. NewRule().Protocol("tcp").Destination("10.0.0.0/8").DPort(443);
+// other packets are sent to action, e.g. "REJECT". Rules of allow must not
+// be nil. Calling it again atomically replaces the allowlist.
+func (ipt *IPTables) EgressAllowlist(path string, allow []*Rule, action string) (*ManagedChain, error) {
+	if action == "" {
+		return nil, fmt.Errorf("empty egress action")
+	}
+	if err := CheckCgroupPath(path); err != nil {
+		return nil, err
+	}
+	rules, err := ipt.egressRules(allow, action)
+	if err != nil {
+		return nil, err
+	}
+	jump, err := NewRule().Cgroup(path).Args()
+	if err != nil {
+		return nil, err
+	}
+
+	name := "EGR-" + chainHash(path, 16)
+	m := ipt.NewManagedChain("filter", name, JumpRule{Chain: "OUTPUT", Match: jump})
+	return m, m.Sync(rules)
+}
+
+// egressRules returns the rules of an egress allowlist chain.
+func (ipt *IPTables) egressRules(allow []*Rule, action string) ([][]string, error) {
+	established, err := NewRule().State("RELATED", "ESTABLISHED").Jump("ACCEPT").Args()
+	if err != nil {
+		return nil, err
+	}
+	rules := [][]string{established}
+	for i, r := range allow {
+		// a nil rule would accept all the packets of the cgroup, which is
+		// more likely a mistake than an allowlist
+		if r == nil {
+			return nil, fmt.Errorf("egress allow rule %d is nil", i)
+		}
+		if r.target != nil {
+			return nil, fmt.Errorf("egress allow rule %s already has a target", r)
+		}
+		if err := r.CheckChain("OUTPUT"); err != nil {
+			return nil, err
+		}
+		if err := ipt.checkRuleFamily(r); err != nil {
+			return nil, err
+		}
+		args, err := r.Args()
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, append(args, "-j", "ACCEPT"))
+	}
+	return append(rules, []string{"-j", action}), nil
+}
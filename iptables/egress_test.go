@@ -0,0 +1,190 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestEgressMatches(t *testing.T) {
+	testCases := []struct {
+		name    string
+		rule    *Rule
+		args    string
+		wantErr bool
+	}{
+		{
+			name: "uid",
+			rule: NewRule().SocketOwner(SocketOwner{UID: "1000"}).Jump("ACCEPT"),
+			args: "-m owner --uid-owner 1000 -j ACCEPT",
+		},
+		{
+			name: "all owner flags",
+			rule: NewRule().SocketOwner(SocketOwner{UID: "1000-1999", InvertUID: true, GID: "100-100", SupplementaryGroups: true, SocketExists: true}),
+			args: "-m owner --socket-exists ! --uid-owner 1000-1999 --gid-owner 100 --suppl-groups",
+		},
+		{
+			name: "cgroup",
+			rule: NewRule().Protocol("tcp").Not().Cgroup("system.slice/nginx.service").Jump("DROP"),
+			args: "-p tcp -m cgroup ! --path system.slice/nginx.service -j DROP",
+		},
+		{name: "empty owner", rule: NewRule().SocketOwner(SocketOwner{}), wantErr: true},
+		{name: "uid name", rule: NewRule().SocketOwner(SocketOwner{UID: "root"}), wantErr: true},
+		{name: "reversed range", rule: NewRule().SocketOwner(SocketOwner{UID: "2-1"}), wantErr: true},
+		{name: "suppl groups without gid", rule: NewRule().SocketOwner(SocketOwner{UID: "1", SupplementaryGroups: true}), wantErr: true},
+		{name: "invert without gid", rule: NewRule().SocketOwner(SocketOwner{UID: "1", InvertGID: true}), wantErr: true},
+		{name: "empty cgroup", rule: NewRule().Cgroup(""), wantErr: true},
+		{name: "cgroup outside hierarchy", rule: NewRule().Cgroup("a/../../b"), wantErr: true},
+	}
+
+	for _, tt := range testCases {
+		t.Run(tt.name, func(t *testing.T) {
+			args, err := tt.rule.Args()
+			if err == nil && tt.wantErr {
+				t.Fatalf("expected err, got %q", args)
+			} else if err != nil && !tt.wantErr {
+				t.Fatalf("unexpected err %s", err)
+			}
+			if tt.wantErr {
+				return
+			}
+			if got := joinRulespec(args); got != tt.args {
+				t.Fatalf("args mismatch: \ngot  %s \nneed %s", got, tt.args)
+			}
+		})
+	}
+}
+
+func TestCheckCgroupPath(t *testing.T) {
+	root, err := ioutil.TempDir("", "cgroup")
+	if err != nil {
+		t.Fatalf("TempDir failed: %v", err)
+	}
+	defer os.RemoveAll(root)
+
+	if err := os.MkdirAll(filepath.Join(root, "system.slice", "nginx.service"), 0755); err != nil {
+		t.Fatalf("MkdirAll failed: %v", err)
+	}
+	if err := checkCgroupPath(root, "system.slice"); err == nil || !strings.Contains(err.Error(), "cgroup v2") {
+		t.Fatalf("expected a cgroup v2 err, got %v", err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(root, "cgroup.controllers"), nil, 0644); err != nil {
+		t.Fatalf("WriteFile failed: %v", err)
+	}
+
+	for path, valid := range map[string]bool{
+		"system.slice/nginx.service":  true,
+		"/system.slice/nginx.service": true,
+		"system.slice/sshd.service":   false,
+		"cgroup.controllers":          false,
+		"system.slice/..":             false,
+	} {
+		if err := checkCgroupPath(root, path); (err == nil) != valid {
+			t.Fatalf("checkCgroupPath(%q): got %v, need valid %v", path, err, valid)
+		}
+	}
+}
+
+func TestEgressRules(t *testing.T) {
+	ipt := &IPTables{proto: ProtocolIPv4}
+	allow := []*Rule{
+		NewRule().Protocol("udp").Destination("10.0.0.53").DPort(53),
+		NewRule().Protocol("tcp").Destination("192.0.2.0/24").DPorts(80, 443),
+	}
+	rules, err := ipt.egressRules(allow, "REJECT")
+	if err != nil {
+		t.Fatalf("egressRules failed: %v", err)
+	}
+	expected := [][]string{
+		{"-m", "conntrack", "--ctstate", "RELATED,ESTABLISHED", "-j", "ACCEPT"},
+		{"-d", "10.0.0.53/32", "-p", "udp", "-m", "udp", "--dport", "53", "-j", "ACCEPT"},
+		{"-d", "192.0.2.0/24", "-p", "tcp", "-m", "multiport", "--dports", "80,443", "-j", "ACCEPT"},
+		{"-j", "REJECT"},
+	}
+	if !reflect.DeepEqual(rules, expected) {
+		t.Fatalf("egressRules mismatch: \ngot  %q \nneed %q", rules, expected)
+	}
+
+	for name, bad := range map[string]*Rule{
+		"target":       NewRule().Jump("ACCEPT"),
+		"family":       NewRule().Destination("2001:db8::/32"),
+		"invalid rule": NewRule().Protocol(""),
+		"nil rule":     nil,
+	} {
+		if _, err := ipt.egressRules([]*Rule{bad}, "REJECT"); err == nil {
+			t.Fatalf("expected err for %s, got none", name)
+		}
+	}
+}
+
+func TestEgressAllowlist(t *testing.T) {
+	for i, ipt := range mustTestableIptables() {
+		t.Run(fmt.Sprint(i), func(t *testing.T) {
+			runEgressAllowlistTests(t, ipt)
+		})
+	}
+}
+
+func runEgressAllowlistTests(t *testing.T, ipt *IPTables) {
+	// the cgroup of the test itself, e.g. "0::/user.slice/session-1.scope"
+	data, err := ioutil.ReadFile("/proc/self/cgroup")
+	if err != nil {
+		t.Fatalf("ReadFile failed: %v", err)
+	}
+	path := strings.TrimPrefix(strings.TrimSpace(string(data)), "0::")
+	if err := CheckCgroupPath(path); err != nil {
+		t.Skipf("no cgroup v2 hierarchy: %v", err)
+	}
+
+	// allow everything, so that the test doesn't block its own traffic
+	m, err := ipt.EgressAllowlist(path, []*Rule{NewRule()}, "REJECT")
+	if err != nil {
+		t.Fatalf("EgressAllowlist failed: %v", err)
+	}
+	defer func() {
+		if err := m.Teardown(); err != nil {
+			t.Fatalf("Teardown failed: %v", err)
+		}
+	}()
+
+	allow := []*Rule{NewRule().SocketOwner(SocketOwner{UID: "0-65535"})}
+	if m, err = ipt.EgressAllowlist(path, allow, "REJECT"); err != nil {
+		t.Fatalf("EgressAllowlist failed: %v", err)
+	}
+	rules, err := ipt.egressRules(allow, "REJECT")
+	if err != nil {
+		t.Fatalf("egressRules failed: %v", err)
+	}
+	state, err := ipt.chainState("filter", m.Name)
+	if err != nil {
+		t.Fatalf("chainState failed: %v", err)
+	}
+	if !reflect.DeepEqual(state.rules, rules) {
+		t.Fatalf("rules mismatch: \ngot  %q \nneed %q", state.rules, rules)
+	}
+	exists, err := ipt.Exists("filter", "OUTPUT", m.Jumps[0].rulespec(m.Name)...)
+	if err != nil {
+		t.Fatalf("Exists failed: %v", err)
+	}
+	if !exists {
+		t.Fatalf("jump into %s not found", m.Name)
+	}
+}
@@ -0,0 +1,274 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables
+
+import (
+	"fmt"
+)
+
+// ChainRef is a rule jumping (-j) or going (-g) from a parent chain into a
+// user-defined child chain.
+type ChainRef struct {
+	Parent string
+	Child  string
+	// Position is the 1-based position of the rule in Parent.
+	Position int
+	Goto     bool
+	Rulespec []string
+}
+
+// ChainGraph is the graph of references between the chains of a table.
+type ChainGraph struct {
+	Table string
+	// Chains lists all chains of the table, built-in chains first.
+	Chains []string
+	// Refs lists all references, in listing order.
+	Refs []ChainRef
+
+	builtin map[string]bool
+}
+
+// ChainGraph builds the reference graph of table from a single listing.
+func (ipt *IPTables) ChainGraph(table string) (*ChainGraph, error) {
+	lines, err := ipt.executeList([]string{"-t", table, "-S"})
+	if err != nil {
+		return nil, err
+	}
+	return parseChainGraph(table, lines)
+}
+
+// parseChainGraph builds a ChainGraph from "iptables -S" output.
+func parseChainGraph(table string, lines []string) (*ChainGraph, error) {
+	g := &ChainGraph{Table: table, builtin: map[string]bool{}}
+	known := map[string]bool{}
+	positions := map[string]int{}
+
+	var rules [][]string
+	for _, line := range lines {
+		args, err := splitRulespec(line)
+		if err != nil {
+			return nil, err
+		}
+		if len(args) < 2 {
+			continue
+		}
+		switch args[0] {
+		case "-P":
+			g.builtin[args[1]] = true
+			fallthrough
+		case "-N":
+			g.Chains = append(g.Chains, args[1])
+			known[args[1]] = true
+		case "-A":
+			rules = append(rules, args)
+		}
+	}
+
+	// targets are only known to be chains once all chains are listed
+	for _, args := range rules {
+		parent := args[1]
+		positions[parent]++
+		target, isGoto := ruleTarget(args[2:])
+		if !known[target] {
+			continue
+		}
+		g.Refs = append(g.Refs, ChainRef{
+			Parent:   parent,
+			Child:    target,
+			Position: positions[parent],
+			Goto:     isGoto,
+			Rulespec: args[2:],
+		})
+	}
+	return g, nil
+}
+
+// IsBuiltin returns true if chain is a built-in chain of the table.
+func (g *ChainGraph) IsBuiltin(chain string) bool {
+	return g.builtin[chain]
+}
+
+// Has returns true if chain exists in the table.
+func (g *ChainGraph) Has(chain string) bool {
+	for _, c := range g.Chains {
+		if c == chain {
+			return true
+		}
+	}
+	return false
+}
+
+// Parents returns the references into chain.
+func (g *ChainGraph) Parents(chain string) []ChainRef {
+	var refs []ChainRef
+	for _, ref := range g.Refs {
+		if ref.Child == chain {
+			refs = append(refs, ref)
+		}
+	}
+	return refs
+}
+
+// Children returns the references from chain into other chains.
+func (g *ChainGraph) Children(chain string) []ChainRef {
+	var refs []ChainRef
+	for _, ref := range g.Refs {
+		if ref.Parent == chain {
+			refs = append(refs, ref)
+		}
+	}
+	return refs
+}
+
+// RefCount returns the number of rules referencing chain, as reported in
+// the "(N references)" header of "iptables -L".
+func (g *ChainGraph) RefCount(chain string) int {
+	return len(g.Parents(chain))
+}
+
+// Cycles returns the groups of chains that reference each other in a loop.
+// The kernel refuses loops, so this is normally empty.
+func (g *ChainGraph) Cycles() [][]string {
+	// Tarjan's strongly connected components
+	var (
+		index   = map[string]int{}
+		lowlink = map[string]int{}
+		onStack = map[string]bool{}
+		stack   []string
+		cycles  [][]string
+		next    int
+	)
+
+	var visit func(chain string)
+	visit = func(chain string) {
+		index[chain] = next
+		lowlink[chain] = next
+		next++
+		stack = append(stack, chain)
+		onStack[chain] = true
+
+		selfLoop := false
+		for _, ref := range g.Children(chain) {
+			if ref.Child == chain {
+				selfLoop = true
+			}
+			if _, seen := index[ref.Child]; !seen {
+				visit(ref.Child)
+				if lowlink[ref.Child] < lowlink[chain] {
+					lowlink[chain] = lowlink[ref.Child]
+				}
+			} else if onStack[ref.Child] && index[ref.Child] < lowlink[chain] {
+				lowlink[chain] = index[ref.Child]
+			}
+		}
+
+		if lowlink[chain] != index[chain] {
+			return
+		}
+		var component []string
+		for {
+			top := stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+			onStack[top] = false
+			component = append([]string{top}, component...)
+			if top == chain {
+				break
+			}
+		}
+		if len(component) > 1 || selfLoop {
+			cycles = append(cycles, component)
+		}
+	}
+
+	for _, chain := range g.Chains {
+		if _, seen := index[chain]; !seen {
+			visit(chain)
+		}
+	}
+	return cycles
+}
+
+// orphans returns chain together with the user-defined chains that would be
+// left unreferenced once chain and its rules are removed, recursively.
+func (g *ChainGraph) orphans(chain string) []string {
+	doomed := map[string]bool{chain: true}
+	order := []string{chain}
+	for changed := true; changed; {
+		changed = false
+		for _, c := range g.Chains {
+			if doomed[c] || g.builtin[c] {
+				continue
+			}
+			parents := g.Parents(c)
+			if len(parents) == 0 {
+				continue
+			}
+			owned := true
+			for _, ref := range parents {
+				if !doomed[ref.Parent] {
+					owned = false
+					break
+				}
+			}
+			if owned {
+				doomed[c] = true
+				order = append(order, c)
+				changed = true
+			}
+		}
+	}
+	return order
+}
+
+// DeleteChainRecursive deletes chain after removing all rules referencing
+// it. User-defined chains that were only referenced from chain (directly or
+// through other chains being deleted) are deleted as well. Everything is
+// done in a single iptables-restore transaction. It is not an error if the
+// chain doesn't exist.
+func (ipt *IPTables) DeleteChainRecursive(table, chain string) error {
+	g, err := ipt.ChainGraph(table)
+	if err != nil {
+		return err
+	}
+	if g.IsBuiltin(chain) {
+		return fmt.Errorf("cannot delete built-in chain %s", chain)
+	}
+	if !g.Has(chain) {
+		return nil
+	}
+
+	doomed := g.orphans(chain)
+	isDoomed := map[string]bool{}
+	for _, c := range doomed {
+		isDoomed[c] = true
+	}
+
+	var ops []Operation
+	for _, c := range doomed {
+		ops = append(ops, Operation{Kind: opFlushChain, Table: table, Chain: c})
+	}
+	// delete references from the surviving chains, last first so that
+	// positions stay valid
+	for i := len(g.Refs) - 1; i >= 0; i-- {
+		ref := g.Refs[i]
+		if isDoomed[ref.Child] && !isDoomed[ref.Parent] {
+			ops = append(ops, Operation{Kind: OpDeleteRule, Table: table, Chain: ref.Parent, Position: ref.Position, Rulespec: ref.Rulespec})
+		}
+	}
+	for _, c := range doomed {
+		ops = append(ops, Operation{Kind: opDeleteChain, Table: table, Chain: c})
+	}
+	return ipt.restore(restoreScript(ops), false)
+}
@@ -0,0 +1,133 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+var graphListing = []string{
+	"-P INPUT ACCEPT",
+	"-P FORWARD DROP",
+	"-P OUTPUT ACCEPT",
+	"-N APP",
+	"-N APP-TCP",
+	"-N APP-UDP",
+	"-N SHARED",
+	"-N LOOP-A",
+	"-N LOOP-B",
+	"-A INPUT -i lo -j ACCEPT",
+	"-A INPUT -j APP",
+	"-A FORWARD -j SHARED",
+	"-A APP -p tcp -j APP-TCP",
+	"-A APP -p udp -g APP-UDP",
+	"-A APP -j SHARED",
+	"-A APP-TCP -j ACCEPT",
+	"-A LOOP-A -j LOOP-B",
+	"-A LOOP-B -j LOOP-A",
+}
+
+func TestChainGraph(t *testing.T) {
+	g, err := parseChainGraph("filter", graphListing)
+	if err != nil {
+		t.Fatalf("parseChainGraph failed: %v", err)
+	}
+
+	if !g.IsBuiltin("INPUT") || g.IsBuiltin("APP") {
+		t.Fatal("IsBuiltin returned wrong results")
+	}
+
+	expectedChildren := []ChainRef{
+		{Parent: "APP", Child: "APP-TCP", Position: 1, Rulespec: []string{"-p", "tcp", "-j", "APP-TCP"}},
+		{Parent: "APP", Child: "APP-UDP", Position: 2, Goto: true, Rulespec: []string{"-p", "udp", "-g", "APP-UDP"}},
+		{Parent: "APP", Child: "SHARED", Position: 3, Rulespec: []string{"-j", "SHARED"}},
+	}
+	if children := g.Children("APP"); !reflect.DeepEqual(children, expectedChildren) {
+		t.Fatalf("Children mismatch: \ngot  %#v \nneed %#v", children, expectedChildren)
+	}
+
+	for chain, count := range map[string]int{"APP": 1, "SHARED": 2, "INPUT": 0, "APP-TCP": 1} {
+		if refs := g.RefCount(chain); refs != count {
+			t.Fatalf("expected %d references to %s, got %d", count, chain, refs)
+		}
+	}
+
+	expectedCycles := [][]string{{"LOOP-A", "LOOP-B"}}
+	if cycles := g.Cycles(); !reflect.DeepEqual(cycles, expectedCycles) {
+		t.Fatalf("Cycles mismatch: \ngot  %#v \nneed %#v", cycles, expectedCycles)
+	}
+
+	// SHARED is still referenced from FORWARD
+	expectedOrphans := []string{"APP", "APP-TCP", "APP-UDP"}
+	if orphans := g.orphans("APP"); !reflect.DeepEqual(orphans, expectedOrphans) {
+		t.Fatalf("orphans mismatch: \ngot  %#v \nneed %#v", orphans, expectedOrphans)
+	}
+}
+
+func TestDeleteChainRecursive(t *testing.T) {
+	for i, ipt := range mustTestableIptables() {
+		t.Run(fmt.Sprint(i), func(t *testing.T) {
+			runDeleteChainRecursiveTests(t, ipt)
+		})
+	}
+}
+
+func runDeleteChainRecursiveTests(t *testing.T, ipt *IPTables) {
+	parent, chain, child := randChain(t), randChain(t), randChain(t)
+	for _, c := range []string{parent, chain, child} {
+		if err := ipt.NewChain("filter", c); err != nil {
+			t.Fatalf("NewChain failed: %v", err)
+		}
+	}
+	defer func() {
+		if err := ipt.ClearAndDeleteChain("filter", parent); err != nil {
+			t.Fatalf("ClearAndDeleteChain failed: %v", err)
+		}
+	}()
+
+	if err := ipt.Append("filter", parent, "-j", chain); err != nil {
+		t.Fatalf("Append failed: %v", err)
+	}
+	if err := ipt.Append("filter", chain, "-p", "tcp", "-j", child); err != nil {
+		t.Fatalf("Append failed: %v", err)
+	}
+
+	if err := ipt.DeleteChainRecursive("filter", chain); err != nil {
+		t.Fatalf("DeleteChainRecursive failed: %v", err)
+	}
+
+	for _, c := range []string{chain, child} {
+		exists, err := ipt.ChainExists("filter", c)
+		if err != nil {
+			t.Fatalf("ChainExists failed: %v", err)
+		}
+		if exists {
+			t.Fatalf("DeleteChainRecursive didn't delete %s", c)
+		}
+	}
+	rules, err := ipt.List("filter", parent)
+	if err != nil {
+		t.Fatalf("List failed: %v", err)
+	}
+	if len(rules) != 1 {
+		t.Fatalf("DeleteChainRecursive didn't remove the reference: %#v", rules)
+	}
+
+	if err := ipt.DeleteChainRecursive("filter", chain); err != nil {
+		t.Fatalf("DeleteChainRecursive failed for non-existing chain: %v", err)
+	}
+}
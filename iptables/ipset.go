@@ -0,0 +1,476 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// maxSetNameLen is the maximum length of a set name, see IPSET_MAXNAMELEN in
+// the kernel (32 including the terminating NUL)
+const maxSetNameLen = 31
+
+// SetType is the type of an ipset, which defines what its entries are.
+type SetType string
+
+const (
+	// SetHashIP stores addresses, e.g. "10.0.0.1".
+	SetHashIP SetType = "hash:ip"
+	// SetHashNet stores networks, e.g. "10.0.0.0/8".
+	SetHashNet SetType = "hash:net"
+	// SetHashIPPort stores address and port pairs, e.g. "10.0.0.1,tcp:80".
+	SetHashIPPort SetType = "hash:ip,port"
+	// SetBitmapIP stores IPv4 addresses of a range given at creation.
+	SetBitmapIP SetType = "bitmap:ip"
+	// SetBitmapIPMac stores IPv4 and MAC address pairs of a range given at
+	// creation.
+	SetBitmapIPMac SetType = "bitmap:ip,mac"
+	// SetBitmapPort stores ports of a range given at creation.
+	SetBitmapPort SetType = "bitmap:port"
+)
+
+// SetOptions are the creation options of a set. Zero values leave the
+// ipset defaults.
+type SetOptions struct {
+	// HashSize and MaxElem size the hash types.
+	HashSize int
+	MaxElem  int
+	// Range is the range of the bitmap types, e.g. "192.168.0.0/16" or
+	// "1024-65535".
+	Range string
+	// Timeout is the default timeout of the entries. Entries never expire
+	// if 0.
+	Timeout time.Duration
+	// Counters keeps packet and byte counters per entry.
+	Counters bool
+	// Comment allows a comment per entry.
+	Comment bool
+}
+
+// SetEntry is an entry of a set.
+type SetEntry struct {
+	// Value is the entry in the format of the set type, e.g. "10.0.0.1",
+	// "10.0.0.0/8" or "10.0.0.1,tcp:80".
+	Value string
+	// Timeout overrides the default timeout of the set if not 0.
+	Timeout time.Duration
+	// Comment requires a set created with comments.
+	Comment string
+	// Packets and Bytes are the counters listed for sets created with
+	// counters.
+	Packets uint64
+	Bytes   uint64
+}
+
+// SetInfo describes a set and its entries, as listed by IPSet.List.
+type SetInfo struct {
+	Name    string
+	Type    SetType
+	Family  Protocol
+	Options SetOptions
+	Entries []SetEntry
+}
+
+// IPSet runs the ipset command for a Protocol, which is the family of the
+// sets it creates.
+type IPSet struct {
+	path  string
+	proto Protocol
+	v1    int
+	v2    int
+}
+
+// NewIPSet returns an IPSet configured with the options of New, IPFamily
+// and Path. Timeout has no effect, ipset has no lock to wait for.
+//
+//	set6, err := NewIPSet(IPFamily(ProtocolIPv6))
+func NewIPSet(opts ...option) (*IPSet, error) {
+	cfg := &IPTables{proto: ProtocolIPv4}
+	for _, opt := range opts {
+		opt(cfg)
+	}
+
+	cmd := cfg.path
+	if cmd == "" {
+		cmd = "ipset"
+	}
+	path, err := exec.LookPath(cmd)
+	if err != nil {
+		return nil, err
+	}
+
+	var out bytes.Buffer
+	if err := runCommand(path, []string{path, "--version"}, nil, &out); err != nil {
+		return nil, fmt.Errorf("could not get ipset version: %v", err)
+	}
+	v1, v2, err := extractIPSetVersion(out.String())
+	if err != nil {
+		return nil, err
+	}
+	return &IPSet{path: path, proto: cfg.proto, v1: v1, v2: v2}, nil
+}
+
+var ipsetVersionRegex = regexp.MustCompile(`v([0-9]+)\.([0-9]+)`)
+
+// extractIPSetVersion returns the major and minor version of ipset, e.g.
+// "ipset v7.15, protocol version: 7" would return (7, 15, nil).
+func extractIPSetVersion(str string) (int, int, error) {
+	result := ipsetVersionRegex.FindStringSubmatch(str)
+	if result == nil {
+		return 0, 0, fmt.Errorf("no ipset version found in string: %s", str)
+	}
+	v1, err := strconv.Atoi(result[1])
+	if err != nil {
+		return 0, 0, err
+	}
+	v2, err := strconv.Atoi(result[2])
+	if err != nil {
+		return 0, 0, err
+	}
+	return v1, v2, nil
+}
+
+// Proto returns the family of the sets created by this IPSet.
+func (s *IPSet) Proto() Protocol {
+	return s.proto
+}
+
+// GetIPSetVersion returns the major and minor version of ipset.
+func (s *IPSet) GetIPSetVersion() (int, int) {
+	return s.v1, s.v2
+}
+
+func (s *IPSet) run(args ...string) error {
+	return s.runWithOutput(args, nil, nil)
+}
+
+func (s *IPSet) runWithOutput(args []string, stdin io.Reader, stdout io.Writer) error {
+	return runCommand(s.path, append([]string{s.path}, args...), stdin, stdout)
+}
+
+// createArgs returns the arguments of "ipset create".
+func (s *IPSet) createArgs(name string, typ SetType, opts SetOptions) ([]string, error) {
+	if err := checkSetName(name); err != nil {
+		return nil, err
+	}
+	args := []string{"create", name, string(typ)}
+	switch typ {
+	case SetHashIP, SetHashNet, SetHashIPPort:
+		if opts.Range != "" {
+			return nil, fmt.Errorf("range is only supported by bitmap sets")
+		}
+		family := "inet"
+		if s.proto == ProtocolIPv6 {
+			family = "inet6"
+		}
+		args = append(args, "family", family)
+		if opts.HashSize > 0 {
+			args = append(args, "hashsize", strconv.Itoa(opts.HashSize))
+		}
+		if opts.MaxElem > 0 {
+			args = append(args, "maxelem", strconv.Itoa(opts.MaxElem))
+		}
+	case SetBitmapIP, SetBitmapIPMac, SetBitmapPort:
+		if s.proto == ProtocolIPv6 && typ != SetBitmapPort {
+			return nil, fmt.Errorf("set type %s only supports IPv4", typ)
+		}
+		if opts.Range == "" {
+			return nil, fmt.Errorf("set type %s requires a range", typ)
+		}
+		if opts.HashSize > 0 || opts.MaxElem > 0 {
+			return nil, fmt.Errorf("hashsize and maxelem are only supported by hash sets")
+		}
+		args = append(args, "range", opts.Range)
+	default:
+		return nil, fmt.Errorf("unsupported set type %q", typ)
+	}
+	if opts.Timeout > 0 {
+		args = append(args, "timeout", strconv.Itoa(int(opts.Timeout/time.Second)))
+	}
+	if opts.Counters {
+		args = append(args, "counters")
+	}
+	if opts.Comment {
+		args = append(args, "comment")
+	}
+	return args, nil
+}
+
+func checkSetName(name string) error {
+	if name == "" || len(name) > maxSetNameLen {
+		return fmt.Errorf("set name must be 1 to %d characters long", maxSetNameLen)
+	}
+	return nil
+}
+
+// Create creates the set name of the given type. It is an error if a set of
+// that name already exists.
+func (s *IPSet) Create(name string, typ SetType, opts SetOptions) error {
+	args, err := s.createArgs(name, typ, opts)
+	if err != nil {
+		return err
+	}
+	return s.run(args...)
+}
+
+// Destroy deletes the set name, which must not be referenced by a rule.
+func (s *IPSet) Destroy(name string) error {
+	if err := checkSetName(name); err != nil {
+		return err
+	}
+	return s.run("destroy", name)
+}
+
+// args returns the entry with its options, as given to "ipset add".
+func (e SetEntry) args() []string {
+	args := []string{e.Value}
+	if e.Timeout > 0 {
+		args = append(args, "timeout", strconv.Itoa(int(e.Timeout/time.Second)))
+	}
+	if e.Comment != "" {
+		args = append(args, "comment", e.Comment)
+	}
+	return args
+}
+
+// Add adds entry to the set name. Adding an existing entry updates its
+// timeout and comment instead of failing.
+func (s *IPSet) Add(name string, entry SetEntry) error {
+	return s.run(append([]string{"add", "-exist", name}, entry.args()...)...)
+}
+
+// Del deletes the entry value from the set name. It is an error, for which
+// IsNotExist returns true, if the entry doesn't exist.
+func (s *IPSet) Del(name, value string) error {
+	return s.run("del", name, value)
+}
+
+// Test checks if the entry value is in the set name.
+func (s *IPSet) Test(name, value string) (bool, error) {
+	err := s.run("test", name, value)
+	eerr, eok := err.(*Error)
+	switch {
+	case err == nil:
+		return true, nil
+	case eok && eerr.ExitStatus() == 1 && strings.Contains(eerr.msg, "is NOT in set"):
+		return false, nil
+	default:
+		return false, err
+	}
+}
+
+// ListSets returns the names of all sets.
+func (s *IPSet) ListSets() ([]string, error) {
+	var stdout bytes.Buffer
+	if err := s.runWithOutput([]string{"list", "-name"}, nil, &stdout); err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, name := range strings.Split(stdout.String(), "\n") {
+		if name != "" {
+			names = append(names, name)
+		}
+	}
+	return names, nil
+}
+
+// List returns the set name with its entries.
+func (s *IPSet) List(name string) (*SetInfo, error) {
+	if err := checkSetName(name); err != nil {
+		return nil, err
+	}
+	var stdout bytes.Buffer
+	if err := s.Save(&stdout, name); err != nil {
+		return nil, err
+	}
+	sets, err := ParseSetSave(&stdout)
+	if err != nil {
+		return nil, err
+	}
+	if len(sets) != 1 {
+		return nil, fmt.Errorf("expected set %s in ipset save output, got %d sets", name, len(sets))
+	}
+	return sets[0], nil
+}
+
+// Flush deletes all entries of the set name, or of all sets if name is
+// empty.
+func (s *IPSet) Flush(name string) error {
+	if name == "" {
+		return s.run("flush")
+	}
+	return s.run("flush", name)
+}
+
+// Swap exchanges the contents of the sets from and to, which must be of the
+// same type and family. Rules referencing either set see the swap
+// atomically.
+func (s *IPSet) Swap(from, to string) error {
+	return s.run("swap", from, to)
+}
+
+// Save writes the set name, or all sets if name is empty, to w in the
+// format read by Restore.
+func (s *IPSet) Save(w io.Writer, name string) error {
+	args := []string{"save"}
+	if name != "" {
+		args = append(args, name)
+	}
+	return s.runWithOutput(args, nil, w)
+}
+
+// Restore runs the ipset commands read from r, in the format written by
+// Save, e.g. "create" and "add" lines.
+func (s *IPSet) Restore(r io.Reader) error {
+	return s.runWithOutput([]string{"restore"}, r, nil)
+}
+
+// ParseSetSave parses the output of "ipset save" into sets.
+func ParseSetSave(r io.Reader) ([]*SetInfo, error) {
+	var sets []*SetInfo
+	byName := map[string]*SetInfo{}
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		args, err := splitRulespec(line)
+		if err != nil {
+			return nil, err
+		}
+		if len(args) < 3 {
+			return nil, fmt.Errorf("invalid ipset save line: %s", line)
+		}
+
+		switch args[0] {
+		case "create":
+			set := &SetInfo{Name: args[1], Type: SetType(args[2])}
+			if err := parseSetOptions(set, args[3:]); err != nil {
+				return nil, fmt.Errorf("invalid ipset save line: %s: %v", line, err)
+			}
+			sets = append(sets, set)
+			byName[set.Name] = set
+		case "add":
+			set, ok := byName[args[1]]
+			if !ok {
+				return nil, fmt.Errorf("entry of unknown set: %s", line)
+			}
+			entry, err := parseSetEntry(args[2:])
+			if err != nil {
+				return nil, fmt.Errorf("invalid ipset save line: %s: %v", line, err)
+			}
+			set.Entries = append(set.Entries, entry)
+		default:
+			return nil, fmt.Errorf("unknown ipset save command: %s", line)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return sets, nil
+}
+
+// parseSetOptions parses the options of a create line. Options that have no
+// SetOptions field are ignored.
+func parseSetOptions(set *SetInfo, args []string) error {
+	for i := 0; i < len(args); i++ {
+		var value string
+		switch args[i] {
+		case "counters":
+			set.Options.Counters = true
+			continue
+		case "comment":
+			set.Options.Comment = true
+			continue
+		case "family", "hashsize", "maxelem", "range", "timeout":
+			if i+1 >= len(args) {
+				return fmt.Errorf("missing value of %s", args[i])
+			}
+			value = args[i+1]
+		default:
+			continue
+		}
+
+		var err error
+		switch args[i] {
+		case "family":
+			set.Family = ProtocolIPv4
+			if value == "inet6" {
+				set.Family = ProtocolIPv6
+			}
+		case "hashsize":
+			set.Options.HashSize, err = strconv.Atoi(value)
+		case "maxelem":
+			set.Options.MaxElem, err = strconv.Atoi(value)
+		case "range":
+			set.Options.Range = value
+		case "timeout":
+			set.Options.Timeout, err = parseSeconds(value)
+		}
+		if err != nil {
+			return err
+		}
+		i++
+	}
+	return nil
+}
+
+// parseSetEntry parses the entry of an add line with its options.
+func parseSetEntry(args []string) (SetEntry, error) {
+	entry := SetEntry{Value: args[0]}
+	for i := 1; i < len(args); i++ {
+		// nomatch is the only flag without a value
+		if args[i] == "nomatch" {
+			continue
+		}
+		if i+1 >= len(args) {
+			return entry, fmt.Errorf("missing value of %s", args[i])
+		}
+		var err error
+		switch value := args[i+1]; args[i] {
+		case "timeout":
+			entry.Timeout, err = parseSeconds(value)
+		case "comment":
+			entry.Comment = value
+		case "packets":
+			entry.Packets, err = strconv.ParseUint(value, 10, 64)
+		case "bytes":
+			entry.Bytes, err = strconv.ParseUint(value, 10, 64)
+		}
+		if err != nil {
+			return entry, err
+		}
+		i++
+	}
+	return entry, nil
+}
+
+func parseSeconds(s string) (time.Duration, error) {
+	seconds, err := strconv.Atoi(s)
+	if err != nil {
+		return 0, err
+	}
+	return time.Duration(seconds) * time.Second, nil
+}
@@ -0,0 +1,264 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables
+
+import (
+	"bytes"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestExtractIPSetVersion(t *testing.T) {
+	testCases := []struct {
+		in     string
+		v1, v2 int
+		err    bool
+	}{
+		{"ipset v7.15, protocol version: 7", 7, 15, false},
+		{"ipset v6.38, protocol version: 6\n", 6, 38, false},
+		{"ipset", 0, 0, true},
+	}
+
+	for i, tt := range testCases {
+		t.Run(fmt.Sprint(i), func(t *testing.T) {
+			v1, v2, err := extractIPSetVersion(tt.in)
+			if err == nil && tt.err {
+				t.Fatal("expected err, got none")
+			} else if err != nil && !tt.err {
+				t.Fatalf("unexpected err %s", err)
+			}
+			if v1 != tt.v1 || v2 != tt.v2 {
+				t.Fatalf("expected %d %d, got %d %d", tt.v1, tt.v2, v1, v2)
+			}
+		})
+	}
+}
+
+func TestIPSetCreateArgs(t *testing.T) {
+	ipv4 := &IPSet{proto: ProtocolIPv4}
+	ipv6 := &IPSet{proto: ProtocolIPv6}
+
+	testCases := []struct {
+		name    string
+		ipset   *IPSet
+		typ     SetType
+		opts    SetOptions
+		args    string
+		wantErr bool
+	}{
+		{
+			name:  "hash:ip",
+			ipset: ipv4,
+			typ:   SetHashIP,
+			opts:  SetOptions{HashSize: 1024, MaxElem: 65536, Timeout: 5 * time.Minute, Counters: true, Comment: true},
+			args:  "create test hash:ip family inet hashsize 1024 maxelem 65536 timeout 300 counters comment",
+		},
+		{
+			name:  "hash:net ipv6",
+			ipset: ipv6,
+			typ:   SetHashNet,
+			args:  "create test hash:net family inet6",
+		},
+		{
+			name:  "bitmap:ip",
+			ipset: ipv4,
+			typ:   SetBitmapIP,
+			opts:  SetOptions{Range: "192.168.0.0/16"},
+			args:  "create test bitmap:ip range 192.168.0.0/16",
+		},
+		{
+			name:  "bitmap:port ipv6",
+			ipset: ipv6,
+			typ:   SetBitmapPort,
+			opts:  SetOptions{Range: "1024-65535"},
+			args:  "create test bitmap:port range 1024-65535",
+		},
+		{name: "bitmap:ip ipv6", ipset: ipv6, typ: SetBitmapIP, opts: SetOptions{Range: "::/64"}, wantErr: true},
+		{name: "bitmap without range", ipset: ipv4, typ: SetBitmapPort, wantErr: true},
+		{name: "bitmap with hashsize", ipset: ipv4, typ: SetBitmapPort, opts: SetOptions{Range: "1-2", HashSize: 64}, wantErr: true},
+		{name: "hash with range", ipset: ipv4, typ: SetHashIP, opts: SetOptions{Range: "1-2"}, wantErr: true},
+		{name: "unsupported type", ipset: ipv4, typ: "list:set", wantErr: true},
+	}
+
+	for _, tt := range testCases {
+		t.Run(tt.name, func(t *testing.T) {
+			args, err := tt.ipset.createArgs("test", tt.typ, tt.opts)
+			if err == nil && tt.wantErr {
+				t.Fatalf("expected err, got %q", args)
+			} else if err != nil && !tt.wantErr {
+				t.Fatalf("unexpected err %s", err)
+			}
+			if tt.wantErr {
+				return
+			}
+			if got := strings.Join(args, " "); got != tt.args {
+				t.Fatalf("createArgs mismatch: \ngot  %s \nneed %s", got, tt.args)
+			}
+		})
+	}
+
+	if _, err := ipv4.createArgs(strings.Repeat("x", maxSetNameLen+1), SetHashIP, SetOptions{}); err == nil {
+		t.Fatalf("expected err for a long name, got none")
+	}
+}
+
+func TestParseSetSave(t *testing.T) {
+	save := `create allow hash:net family inet6 hashsize 1024 maxelem 65536 timeout 300 counters comment bucketsize 12 initval 0x5f6b7e4e
+add allow 2001:db8::/32 timeout 120 packets 3 bytes 180 comment "office network"
+add allow 2001:db8:1::/48 nomatch timeout 0 packets 0 bytes 0 comment "excluded"
+create ports bitmap:port range 1-1024
+add ports 22
+`
+	sets, err := ParseSetSave(strings.NewReader(save))
+	if err != nil {
+		t.Fatalf("ParseSetSave failed: %v", err)
+	}
+	expected := []*SetInfo{
+		{
+			Name:    "allow",
+			Type:    SetHashNet,
+			Family:  ProtocolIPv6,
+			Options: SetOptions{HashSize: 1024, MaxElem: 65536, Timeout: 5 * time.Minute, Counters: true, Comment: true},
+			Entries: []SetEntry{
+				{Value: "2001:db8::/32", Timeout: 2 * time.Minute, Comment: "office network", Packets: 3, Bytes: 180},
+				{Value: "2001:db8:1::/48", Comment: "excluded"},
+			},
+		},
+		{
+			Name:    "ports",
+			Type:    SetBitmapPort,
+			Options: SetOptions{Range: "1-1024"},
+			Entries: []SetEntry{{Value: "22"}},
+		},
+	}
+	if !reflect.DeepEqual(sets, expected) {
+		t.Fatalf("ParseSetSave mismatch: \ngot  %#v \nneed %#v", sets, expected)
+	}
+
+	for _, bad := range []string{
+		"add missing 10.0.0.1\n",
+		"create x hash:ip hashsize\n",
+		"create x hash:ip\nadd x 10.0.0.1 packets many\n",
+		"destroy x hash:ip\n",
+		"create x\n",
+	} {
+		if _, err := ParseSetSave(strings.NewReader(bad)); err == nil {
+			t.Fatalf("expected err for %q, got none", bad)
+		}
+	}
+}
+
+func TestIPSet(t *testing.T) {
+	for _, proto := range []Protocol{ProtocolIPv4, ProtocolIPv6} {
+		t.Run(fmt.Sprint(proto), func(t *testing.T) {
+			s, err := NewIPSet(IPFamily(proto))
+			if err != nil {
+				t.Fatalf("NewIPSet failed: %v", err)
+			}
+			runIPSetTests(t, s)
+		})
+	}
+}
+
+func runIPSetTests(t *testing.T, s *IPSet) {
+	name, tmp := randChain(t), randChain(t)
+	if err := s.Create(name, SetHashNet, SetOptions{Comment: true}); err != nil {
+		t.Fatalf("Create failed: %v", err)
+	}
+	defer func() {
+		if err := s.Destroy(name); err != nil {
+			t.Fatalf("Destroy failed: %v", err)
+		}
+	}()
+	if err := s.Create(name, SetHashNet, SetOptions{}); err == nil {
+		t.Fatalf("expected err creating an existing set, got none")
+	}
+
+	network, other := "10.0.0.0/8", "192.168.0.0/16"
+	if s.Proto() == ProtocolIPv6 {
+		network, other = "2001:db8::/32", "fd00::/8"
+	}
+	// adding twice updates the entry
+	for _, comment := range []string{"first", "second"} {
+		if err := s.Add(name, SetEntry{Value: network, Comment: comment}); err != nil {
+			t.Fatalf("Add failed: %v", err)
+		}
+	}
+	found, err := s.Test(name, network)
+	if err != nil {
+		t.Fatalf("Test failed: %v", err)
+	}
+	if !found {
+		t.Fatalf("Test didn't find %s", network)
+	}
+	if found, err = s.Test(name, other); err != nil || found {
+		t.Fatalf("Test of %s: got %v, %v, need false, nil", other, found, err)
+	}
+
+	info, err := s.List(name)
+	if err != nil {
+		t.Fatalf("List failed: %v", err)
+	}
+	if info.Family != s.Proto() || !reflect.DeepEqual(info.Entries, []SetEntry{{Value: network, Comment: "second"}}) {
+		t.Fatalf("List mismatch: %#v", info)
+	}
+	names, err := s.ListSets()
+	if err != nil {
+		t.Fatalf("ListSets failed: %v", err)
+	}
+	if !contains(names, name) {
+		t.Fatalf("ListSets didn't list %s: %q", name, names)
+	}
+
+	// fill a new set through restore and swap it in
+	var script bytes.Buffer
+	family := "inet"
+	if s.Proto() == ProtocolIPv6 {
+		family = "inet6"
+	}
+	fmt.Fprintf(&script, "create %s hash:net family %s comment\nadd %s %s\n", tmp, family, tmp, other)
+	if err := s.Restore(&script); err != nil {
+		t.Fatalf("Restore failed: %v", err)
+	}
+	if err := s.Swap(tmp, name); err != nil {
+		t.Fatalf("Swap failed: %v", err)
+	}
+	if err := s.Destroy(tmp); err != nil {
+		t.Fatalf("Destroy failed: %v", err)
+	}
+	if found, err = s.Test(name, other); err != nil || !found {
+		t.Fatalf("Test of %s after swap: got %v, %v, need true, nil", other, found, err)
+	}
+
+	err = s.Del(name, network)
+	if eerr, ok := err.(*Error); !ok || !eerr.IsNotExist() {
+		t.Fatalf("expected a not exist error deleting a missing entry, got %v", err)
+	}
+	if err := s.Del(name, other); err != nil {
+		t.Fatalf("Del failed: %v", err)
+	}
+	if err := s.Add(name, SetEntry{Value: network}); err != nil {
+		t.Fatalf("Add failed: %v", err)
+	}
+	if err := s.Flush(name); err != nil {
+		t.Fatalf("Flush failed: %v", err)
+	}
+	if info, err = s.List(name); err != nil || len(info.Entries) != 0 {
+		t.Fatalf("List after Flush: got %#v, %v", info, err)
+	}
+}
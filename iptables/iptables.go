@@ -52,6 +52,7 @@ var (
 		"No chain/target/match by that name.\n",
 		"No such file or directory",
 		"does not exist",
+		"it's not added",
 	}
 
 	ErrNotFound = errors.New("rule not found")
@@ -82,6 +83,7 @@ type IPTables struct {
 	hasWait           bool
 	waitSupportSecond bool
 	hasRandomFully    bool
+	hasRestoreWait    bool
 	v1                int
 	v2                int
 	v3                int
@@ -89,12 +91,45 @@ type IPTables struct {
 	timeout           int    // time to wait for the iptables lock, default waits forever
 }
 
-// InvertibleIPNet - is net.IPNet with inverse(!) match symbol
+// InvertibleIPNet - is net.IPNet with inverse(!) match symbol.
+// It is marshaled as a CIDR string, e.g. "!10.0.0.0/8".
 type InvertibleIPNet struct {
 	*net.IPNet `json:"net"`
 	Invert     bool `json:"invert"`
 }
 
+// String returns the network in CIDR notation, preceded by "!" if inverted.
+func (n InvertibleIPNet) String() string {
+	if n.IPNet == nil {
+		return ""
+	}
+	if n.Invert {
+		return "!" + n.IPNet.String()
+	}
+	return n.IPNet.String()
+}
+
+// MarshalText implements encoding.TextMarshaler, and thereby JSON
+// marshaling, using String.
+func (n InvertibleIPNet) MarshalText() ([]byte, error) {
+	return []byte(n.String()), nil
+}
+
+// UnmarshalText implements encoding.TextUnmarshaler, accepting the format of
+// ParseInvertibleNet. An empty text sets the zero value.
+func (n *InvertibleIPNet) UnmarshalText(text []byte) error {
+	if len(text) == 0 {
+		*n = InvertibleIPNet{}
+		return nil
+	}
+	parsed, err := ParseInvertibleNet(string(text))
+	if err != nil {
+		return err
+	}
+	*n = *parsed
+	return nil
+}
+
 // Stat represents a structured statistic entry.
 type Stat struct {
 	Packets     uint64           `json:"pkts"`
@@ -184,6 +219,7 @@ func New(opts ...option) (*IPTables, error) {
 	ipt.hasWait = waitPresent
 	ipt.waitSupportSecond = waitSupportSecond
 	ipt.hasRandomFully = randomFullyPresent
+	ipt.hasRestoreWait = iptablesRestoreHasWait(v1, v2, v3)
 
 	return ipt, nil
 }
@@ -359,64 +395,132 @@ func (ipt *IPTables) Stats(table, chain string) ([][]string, error) {
 		return nil, err
 	}
 
-	appendSubnet := func(addr string) string {
-		if strings.IndexByte(addr, byte('/')) < 0 {
-			if strings.IndexByte(addr, '.') < 0 {
-				return addr + "/128"
-			}
-			return addr + "/32"
-		}
-		return addr
-	}
-
-	ipv6 := ipt.proto == ProtocolIPv6
-
 	// Skip the warning if exist
-	if strings.HasPrefix(lines[0], "#") {
+	if len(lines) > 0 && strings.HasPrefix(lines[0], "#") {
 		lines = lines[1:]
 	}
 
+	// Skip over chain name and field header
+	if len(lines) < 2 {
+		return [][]string{}, nil
+	}
+	return statsRows(lines[2:])
+}
+
+// statsRows splits the rule lines of "iptables -L -n -v -x" output into
+// fields, as returned by Stats.
+func statsRows(lines []string) ([][]string, error) {
 	rows := [][]string{}
-	for i, line := range lines {
-		// Skip over chain name and field header
-		if i < 2 {
+	for _, line := range lines {
+		if strings.TrimSpace(line) == "" {
 			continue
 		}
+		fields, err := parseStatLine(line)
+		if err != nil {
+			return nil, err
+		}
+		rows = append(rows, fields)
+	}
+	return rows, nil
+}
+
+// parseStatLine splits a single rule line of "iptables -L -n -v -x" output.
+//
+// The columns are printed with fixed widths but values may overflow them, so
+// they are located relative to each other rather than to the column header:
+// the packet and byte counters are right-aligned and followed by a single
+// space, immediately followed by the target column, which is blank for rules
+// without a target. The "opt" column is blank in ip6tables before 1.8.9, in
+// which case it is reported as two spaces.
+func parseStatLine(line string) ([]string, error) {
+	pkts, rest := cutStatField(strings.TrimLeft(line, " "))
+	bytes, rest := cutStatField(strings.TrimLeft(rest, " "))
+	if !isDigits(pkts) || !isDigits(bytes) || len(rest) == 0 {
+		return nil, fmt.Errorf("could not parse counters of stat line %q", line)
+	}
+
+	// drop the separator following the byte counter
+	rest = rest[1:]
+	target := ""
+	if len(rest) > 0 && rest[0] != ' ' {
+		target, rest = cutStatField(rest)
+	}
+
+	// Fields:
+	// prot [opt] in out source destination options...
+	fields := strings.Fields(rest)
+	if len(fields) < 5 {
+		return nil, fmt.Errorf("stat line contained fewer fields than expected: %q", line)
+	}
+	prot := fields[0]
+	fields = fields[1:]
+	opt := "  "
+	switch fields[0] {
+	case "--", "-f", "!f":
+		opt = fields[0]
+		fields = fields[1:]
+	}
+	if len(fields) < 4 {
+		return nil, fmt.Errorf("stat line contained fewer fields than expected: %q", line)
+	}
+
+	// Adjust "source" and "destination" to include netmask, to match regular
+	// List output
+	return []string{
+		pkts,
+		bytes,
+		target,
+		prot,
+		opt,
+		fields[0],
+		fields[1],
+		appendSubnet(fields[2]),
+		appendSubnet(fields[3]),
+		// Combine "options" fields into a single space-delimited field.
+		strings.Join(fields[4:], " "),
+	}, nil
+}
+
+// cutStatField returns the leading non-space characters of s and the rest
+// of s.
+func cutStatField(s string) (string, string) {
+	if i := strings.IndexByte(s, ' '); i >= 0 {
+		return s[:i], s[i:]
+	}
+	return s, ""
+}
 
-		// Fields:
-		// 0=pkts 1=bytes 2=target 3=prot 4=opt 5=in 6=out 7=source 8=destination 9=options
-		line = strings.TrimSpace(line)
-		fields := strings.Fields(line)
-
-		// The ip6tables verbose output cannot be naively split due to the default "opt"
-		// field containing 2 single spaces.
-		if ipv6 {
-			// Check if field 6 is "opt" or "source" address
-			dest := appendSubnet(fields[6])
-			ipnet, _ := ParseInvertibleNet(dest)
-
-			// If we detected a CIDR or IP, the "opt" field is empty.. insert it.
-			if ipnet != nil {
-				f := []string{}
-				f = append(f, fields[:4]...)
-				f = append(f, "  ") // Empty "opt" field for ip6tables
-				f = append(f, fields[4:]...)
-				fields = f
-			}
+func isDigits(s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, c := range s {
+		if c < '0' || c > '9' {
+			return false
 		}
+	}
+	return true
+}
 
-		// Adjust "source" and "destination" to include netmask, to match regular
-		// List output
-		fields[7] = appendSubnet(fields[7])
-		fields[8] = appendSubnet(fields[8])
+// appendSubnet adds the host netmask to a bare address.
+func appendSubnet(addr string) string {
+	if strings.IndexByte(addr, '/') >= 0 {
+		return addr
+	}
+	if strings.IndexByte(addr, ':') >= 0 {
+		return addr + "/128"
+	}
+	return addr + "/32"
+}
 
-		// Combine "options" fields 9... into a single space-delimited field.
-		options := fields[9:]
-		fields = fields[:9]
-		fields = append(fields, strings.Join(options, " "))
-		rows = append(rows, fields)
+// contains returns true if list contains value.
+func contains(list []string, value string) bool {
+	for _, val := range list {
+		if val == value {
+			return true
+		}
 	}
-	return rows, nil
+	return false
 }
 
 // ParseStat parses a single statistic row into a Stat struct. The input should
@@ -430,19 +534,19 @@ func (ipt *IPTables) ParseStat(stat []string) (parsed Stat, err error) {
 	// Convert the fields that are not plain strings
 	parsed.Packets, err = strconv.ParseUint(stat[0], 0, 64)
 	if err != nil {
-		return parsed, fmt.Errorf(err.Error(), "could not parse packets")
+		return parsed, fmt.Errorf("could not parse packets: %v", err)
 	}
 	parsed.Bytes, err = strconv.ParseUint(stat[1], 0, 64)
 	if err != nil {
-		return parsed, fmt.Errorf(err.Error(), "could not parse bytes")
+		return parsed, fmt.Errorf("could not parse bytes: %v", err)
 	}
 	parsed.Source, err = ParseInvertibleNet(stat[7])
 	if err != nil {
-		return parsed, fmt.Errorf(err.Error(), "could not parse source")
+		return parsed, fmt.Errorf("could not parse source: %v", err)
 	}
 	parsed.Destination, err = ParseInvertibleNet(stat[8])
 	if err != nil {
-		return parsed, fmt.Errorf(err.Error(), "could not parse destination")
+		return parsed, fmt.Errorf("could not parse destination: %v", err)
 	}
 
 	// Put the fields that are strings
@@ -576,8 +680,15 @@ func (ipt *IPTables) run(args ...string) error {
 // runWithOutput runs an iptables command with the given arguments,
 // writing any stdout output to the given writer
 func (ipt *IPTables) runWithOutput(args []string, stdout io.Writer) error {
-	args = append([]string{ipt.path}, args...)
-	if ipt.hasWait {
+	return ipt.runTool(ipt.path, args, nil, stdout, ipt.hasWait)
+}
+
+// runTool runs the binary at path (iptables or one of its companion tools)
+// with the given arguments. If wait is set, the tool is asked to wait for the
+// xtables lock itself, otherwise the lock is taken on its behalf.
+func (ipt *IPTables) runTool(path string, args []string, stdin io.Reader, stdout io.Writer, wait bool) error {
+	args = append([]string{path}, args...)
+	if wait {
 		args = append(args, "--wait")
 		if ipt.timeout != 0 && ipt.waitSupportSecond {
 			args = append(args, strconv.Itoa(ipt.timeout))
@@ -597,10 +708,18 @@ func (ipt *IPTables) runWithOutput(args []string, stdout io.Writer) error {
 		}()
 	}
 
+	return runCommand(path, args, stdin, stdout)
+}
+
+// runCommand runs the command line args, whose first element is the name of
+// the binary at path, wrapping exit errors in *Error with the output of
+// stderr.
+func runCommand(path string, args []string, stdin io.Reader, stdout io.Writer) error {
 	var stderr bytes.Buffer
 	cmd := exec.Cmd{
-		Path:   ipt.path,
+		Path:   path,
 		Args:   args,
+		Stdin:  stdin,
 		Stdout: stdout,
 		Stderr: &stderr,
 	}
@@ -728,6 +847,20 @@ func iptablesHasRandomFully(v1 int, v2 int, v3 int) bool {
 	return false
 }
 
+// Checks if an iptables version is after 1.6.2, when iptables-restore gained --wait
+func iptablesRestoreHasWait(v1 int, v2 int, v3 int) bool {
+	if v1 > 1 {
+		return true
+	}
+	if v1 == 1 && v2 > 6 {
+		return true
+	}
+	if v1 == 1 && v2 == 6 && v3 >= 2 {
+		return true
+	}
+	return false
+}
+
 // Checks if a rule specification exists for a table
 func (ipt *IPTables) existsForOldIptables(table, chain string, rulespec []string) (bool, error) {
 	rs := strings.Join(append([]string{"-A", chain}, rulespec...), " ")
@@ -763,6 +896,8 @@ func filterRuleOutput(rule string) string {
 	return out
 }
 
+// ParseInvertibleNet parses a network in CIDR notation, optionally preceded
+// by "!" to invert the match.
 func ParseInvertibleNet(s string) (*InvertibleIPNet, error) {
 	if len(s) == 0 {
 		return nil, errors.New("empty ipnet")
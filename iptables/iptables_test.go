@@ -16,6 +16,7 @@ package iptables
 
 import (
 	"crypto/rand"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"math/big"
@@ -127,15 +128,6 @@ func randChain(t *testing.T) string {
 	return "TEST-" + n.String()
 }
 
-func contains(list []string, value string) bool {
-	for _, val := range list {
-		if val == value {
-			return true
-		}
-	}
-	return false
-}
-
 // mustTestableIptables returns a list of ip(6)tables handles with various
 // features enabled & disabled, to test compatibility.
 // We used to test noWait as well, but that was removed as of iptables v1.6.0
@@ -547,6 +539,16 @@ func runRulesTests(t *testing.T, ipt *IPTables) {
 			structStats, expectedStructStats)
 	}
 
+	chainStats, err := ipt.ChainStats("filter", chain)
+	if err != nil {
+		t.Fatalf("ChainStats failed: %v", err)
+	}
+	expectedChainStats := &ChainStats{Chain: chain, Rules: expectedStructStats}
+	if !reflect.DeepEqual(chainStats, expectedChainStats) {
+		t.Fatalf("ChainStats mismatch: \ngot  %#v \nneed %#v",
+			chainStats, expectedChainStats)
+	}
+
 	for i, stat := range expectedStats {
 		stat, err := ipt.ParseStat(stat)
 		if err != nil {
@@ -909,3 +911,55 @@ func TestListById(t *testing.T) {
 		})
 	}
 }
+
+func TestInvertibleIPNetMarshaling(t *testing.T) {
+	for _, in := range []string{"10.0.0.0/8", "!10.0.0.0/8", "2001:db8::/32", "!::1/128"} {
+		n, err := ParseInvertibleNet(in)
+		if err != nil {
+			t.Fatalf("ParseInvertibleNet(%q) failed: %v", in, err)
+		}
+		if n.String() != in {
+			t.Fatalf("String mismatch: \ngot  %q \nneed %q", n.String(), in)
+		}
+		text, err := n.MarshalText()
+		if err != nil || string(text) != in {
+			t.Fatalf("MarshalText returned %q, %v", text, err)
+		}
+		var out InvertibleIPNet
+		if err := out.UnmarshalText(text); err != nil {
+			t.Fatalf("UnmarshalText(%q) failed: %v", text, err)
+		}
+		if !reflect.DeepEqual(&out, n) {
+			t.Fatalf("UnmarshalText mismatch: \ngot  %#v \nneed %#v", out, n)
+		}
+	}
+
+	var n InvertibleIPNet
+	if err := n.UnmarshalText([]byte("10.0.0.0")); err == nil {
+		t.Fatal("expected err unmarshaling an address without prefix length, got none")
+	}
+
+	source, _ := ParseInvertibleNet("!10.0.0.0/8")
+	destination, _ := ParseInvertibleNet("::/0")
+	stat := Stat{
+		Packets: 1, Bytes: 2, Target: "ACCEPT", Protocol: "tcp", Opt: "--", Input: "*", Output: "*",
+		Source: source, Destination: destination, Options: "tcp dpt:22",
+	}
+	data, err := json.Marshal(stat)
+	if err != nil {
+		t.Fatalf("json.Marshal failed: %v", err)
+	}
+	expected := `{"pkts":1,"bytes":2,"target":"ACCEPT","prot":"tcp","opt":"--","in":"*","out":"*",` +
+		`"source":"!10.0.0.0/8","destination":"::/0","options":"tcp dpt:22"}`
+	if string(data) != expected {
+		t.Fatalf("json.Marshal mismatch: \ngot  %s \nneed %s", data, expected)
+	}
+
+	var decoded Stat
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		t.Fatalf("json.Unmarshal failed: %v", err)
+	}
+	if !reflect.DeepEqual(decoded, stat) {
+		t.Fatalf("json round-trip mismatch: \ngot  %#v \nneed %#v", decoded, stat)
+	}
+}
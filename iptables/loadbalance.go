@@ -0,0 +1,307 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables
+
+import (
+	"crypto/sha256"
+	"encoding/base32"
+	"fmt"
+	"math"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// BalanceMode is the way a LoadBalancer picks a backend.
+type BalanceMode string
+
+const (
+	// BalanceRandom picks a backend at random, in proportion to its weight.
+	BalanceRandom BalanceMode = "random"
+	// BalanceNth picks the backends in turn. Weights are not supported.
+	BalanceNth BalanceMode = "nth"
+)
+
+const (
+	lbServicePrefix  = "LB-SVC-"
+	lbEndpointPrefix = "LB-SEP-"
+)
+
+// Backend is a destination of a LoadBalancer.
+type Backend struct {
+	Address string
+	// Port is the destination port. If 0, the port is left unchanged.
+	Port int
+	// Weight is the relative share of connections sent to the backend. It
+	// defaults to 1.
+	Weight int
+}
+
+// LoadBalancer spreads the connections to a virtual IP and port over a set
+// of backends by DNAT, in the nat table. Connections enter a service chain
+// from the parent chains, which picks an endpoint chain, one per backend,
+// using the statistic match. Endpoint chains do the DNAT.
+type LoadBalancer struct {
+	ipt      *IPTables
+	Name     string
+	Protocol string
+	VIP      string
+	Port     int
+	Mode     BalanceMode
+	// Affinity, if set, sends the connections from a client to the same
+	// backend as long as the client was seen within that time, using the
+	// recent match.
+	Affinity time.Duration
+	// Parents are the chains of the nat table jumping into the service
+	// chain. They default to PREROUTING and OUTPUT.
+	Parents []string
+}
+
+// NewLoadBalancer returns a LoadBalancer for the service name, listening on
+// vip and port for the given protocol, e.g. "tcp". The name identifies the
+// chains of the service and must be unique. Nothing is changed until Sync
+// is called.
+func (ipt *IPTables) NewLoadBalancer(name, protocol, vip string, port int) *LoadBalancer {
+	return &LoadBalancer{
+		ipt:      ipt,
+		Name:     name,
+		Protocol: protocol,
+		VIP:      vip,
+		Port:     port,
+		Mode:     BalanceRandom,
+		Parents:  []string{"PREROUTING", "OUTPUT"},
+	}
+}
+
+// chainHash returns a hash of s usable in a chain name.
+func chainHash(s string, n int) string {
+	sum := sha256.Sum256([]byte(s))
+	return base32.StdEncoding.EncodeToString(sum[:])[:n]
+}
+
+// ServiceChain returns the name of the service chain.
+func (lb *LoadBalancer) ServiceChain() string {
+	return lbServicePrefix + chainHash(lb.Name, 16)
+}
+
+// endpointPrefix is the prefix of the endpoint chains of the service.
+func (lb *LoadBalancer) endpointPrefix() string {
+	return lbEndpointPrefix + chainHash(lb.Name, 8)
+}
+
+// EndpointChain returns the name of the endpoint chain of backend.
+func (lb *LoadBalancer) EndpointChain(backend Backend) string {
+	return lb.endpointPrefix() + chainHash(net.JoinHostPort(backend.Address, strconv.Itoa(backend.Port)), 8)
+}
+
+func (lb *LoadBalancer) managedChain() (*ManagedChain, error) {
+	match, err := NewRule().Destination(lb.VIP).Protocol(lb.Protocol).DPort(lb.Port).Args()
+	if err != nil {
+		return nil, err
+	}
+	if isIPv6(lb.VIP) != (lb.ipt.proto == ProtocolIPv6) {
+		return nil, fmt.Errorf("virtual IP %s doesn't match the family of %s", lb.VIP, getIptablesCommand(lb.ipt.proto))
+	}
+	m := lb.ipt.NewManagedChain("nat", lb.ServiceChain())
+	for _, parent := range lb.Parents {
+		m.Jumps = append(m.Jumps, JumpRule{Chain: parent, Match: match})
+	}
+	return m, nil
+}
+
+// lbChain is a chain of a LoadBalancer with its rules.
+type lbChain struct {
+	name  string
+	rules [][]string
+}
+
+// chains returns the service chain, followed by the endpoint chains, for
+// the given backends.
+func (lb *LoadBalancer) chains(backends []Backend) ([]lbChain, error) {
+	if lb.Mode != BalanceRandom && lb.Mode != BalanceNth {
+		return nil, fmt.Errorf("unknown balance mode %q", lb.Mode)
+	}
+	if lb.Affinity != 0 && lb.Affinity < time.Second {
+		return nil, fmt.Errorf("affinity must be at least a second, got %v", lb.Affinity)
+	}
+
+	mask := "255.255.255.255"
+	if lb.ipt.proto == ProtocolIPv6 {
+		mask = "ffff:ffff:ffff:ffff:ffff:ffff:ffff:ffff"
+	}
+
+	weights := make([]int, len(backends))
+	total := 0
+	seen := map[string]bool{}
+	for i, b := range backends {
+		endpoint := net.JoinHostPort(b.Address, strconv.Itoa(b.Port))
+		if seen[endpoint] {
+			return nil, fmt.Errorf("duplicate backend %s", endpoint)
+		}
+		seen[endpoint] = true
+		if b.Port < 0 || b.Port > 65535 {
+			return nil, fmt.Errorf("invalid port of backend %s", endpoint)
+		}
+		switch {
+		case b.Weight < 0:
+			return nil, fmt.Errorf("negative weight of backend %s", endpoint)
+		case b.Weight == 0:
+			weights[i] = 1
+		default:
+			weights[i] = b.Weight
+		}
+		if lb.Mode == BalanceNth && weights[i] != weights[0] {
+			return nil, fmt.Errorf("weights are not supported in nth mode")
+		}
+		total += weights[i]
+	}
+
+	// affinity rules come first, then the rules picking a backend
+	var affinity, balance [][]string
+	var endpoints []lbChain
+	for i, b := range backends {
+		sep := lb.EndpointChain(b)
+		match := NewRule().Protocol(lb.Protocol)
+		if lb.Affinity != 0 {
+			seconds := strconv.Itoa(int(lb.Affinity / time.Second))
+			rule, err := NewRule().Match("recent", "--rcheck", "--seconds", seconds, "--reap", "--name", sep, "--mask", mask, "--rsource").Jump(sep).Args()
+			if err != nil {
+				return nil, err
+			}
+			affinity = append(affinity, rule)
+			match.Match("recent", "--set", "--name", sep, "--mask", mask, "--rsource")
+		}
+
+		dnat := DNAT{Address: b.Address}
+		if b.Port != 0 {
+			dnat.Ports = PortRange{First: uint16(b.Port), Last: uint16(b.Port)}
+		}
+		rule, err := lb.ipt.NATRulespec(sep, match, dnat)
+		if err != nil {
+			return nil, err
+		}
+		endpoints = append(endpoints, lbChain{name: sep, rules: [][]string{rule}})
+
+		pick := NewRule()
+		if i < len(backends)-1 {
+			if lb.Mode == BalanceNth {
+				pick.Match("statistic", "--mode", "nth", "--every", strconv.Itoa(len(backends)-i), "--packet", "0")
+			} else {
+				pick.Match("statistic", "--mode", "random", "--probability", probability(weights[i], total))
+			}
+		}
+		total -= weights[i]
+		args, err := pick.Jump(sep).Args()
+		if err != nil {
+			return nil, err
+		}
+		balance = append(balance, args)
+	}
+
+	service := lbChain{name: lb.ServiceChain(), rules: append(affinity, balance...)}
+	return append([]lbChain{service}, endpoints...), nil
+}
+
+// probability returns weight/total as listed by the statistic match, which
+// stores it as a fraction of 2^31.
+func probability(weight, total int) string {
+	fraction := math.Round(float64(weight) / float64(total) * 0x80000000)
+	return strconv.FormatFloat(fraction/0x80000000, 'f', 11, 64)
+}
+
+// Sync replaces the backends of the service with backends and makes sure
+// the parent chains jump into the service chain. All chains are updated in
+// a single iptables-restore transaction, so connections are never balanced
+// over a partial set of backends. Endpoint chains of removed backends are
+// deleted. With no backends, connections to the service are left untouched.
+func (lb *LoadBalancer) Sync(backends []Backend) error {
+	m, err := lb.managedChain()
+	if err != nil {
+		return err
+	}
+	chains, err := lb.chains(backends)
+	if err != nil {
+		return err
+	}
+
+	var ops []Operation
+	keep := map[string]bool{}
+	for _, c := range chains {
+		keep[c.name] = true
+		chainOps, err := lb.ipt.rewriteChainOps("nat", c.name, c.rules)
+		if err != nil {
+			return err
+		}
+		ops = append(ops, chainOps...)
+	}
+
+	jumpOps, err := m.jumpOps()
+	if err != nil {
+		return err
+	}
+	ops = append(ops, jumpOps...)
+
+	staleOps, err := lb.endpointCleanupOps(keep)
+	if err != nil {
+		return err
+	}
+	ops = append(ops, staleOps...)
+
+	return lb.ipt.restore(restoreScript(ops), false)
+}
+
+// Teardown removes the jumps into the service chain and deletes the chains
+// of the service. It is not an error if they don't exist.
+func (lb *LoadBalancer) Teardown() error {
+	m, err := lb.managedChain()
+	if err != nil {
+		return err
+	}
+	ops, err := m.teardownOps()
+	if err != nil {
+		return err
+	}
+	staleOps, err := lb.endpointCleanupOps(nil)
+	if err != nil {
+		return err
+	}
+	ops = append(ops, staleOps...)
+
+	if len(ops) == 0 {
+		return nil
+	}
+	return lb.ipt.restore(restoreScript(ops), false)
+}
+
+// endpointCleanupOps returns the operations deleting the endpoint chains of
+// the service that are not in keep. They are only referenced by the service
+// chain, which must be flushed or rewritten by the same transaction.
+func (lb *LoadBalancer) endpointCleanupOps(keep map[string]bool) ([]Operation, error) {
+	existing, err := lb.ipt.ListChains("nat")
+	if err != nil {
+		return nil, err
+	}
+	var ops []Operation
+	for _, chain := range existing {
+		if strings.HasPrefix(chain, lb.endpointPrefix()) && !keep[chain] {
+			ops = append(ops,
+				Operation{Kind: opFlushChain, Table: "nat", Chain: chain},
+				Operation{Kind: opDeleteChain, Table: "nat", Chain: chain},
+			)
+		}
+	}
+	return ops, nil
+}
@@ -0,0 +1,206 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestProbability(t *testing.T) {
+	testCases := []struct {
+		weight, total int
+		out           string
+	}{
+		{1, 2, "0.50000000000"},
+		{1, 3, "0.33333333349"},
+		{2, 3, "0.66666666651"},
+		{1, 1, "1.00000000000"},
+	}
+	for _, tt := range testCases {
+		if got := probability(tt.weight, tt.total); got != tt.out {
+			t.Fatalf("probability(%d, %d) mismatch: \ngot  %s \nneed %s", tt.weight, tt.total, got, tt.out)
+		}
+	}
+}
+
+func TestLoadBalancerChains(t *testing.T) {
+	lb := (&IPTables{proto: ProtocolIPv4}).NewLoadBalancer("web", "tcp", "10.96.0.10", 80)
+	backends := []Backend{
+		{Address: "10.0.0.1", Port: 8080, Weight: 2},
+		{Address: "10.0.0.2", Port: 8080},
+		{Address: "10.0.0.3", Port: 8080},
+	}
+	sep := make([]string, len(backends))
+	for i, b := range backends {
+		sep[i] = lb.EndpointChain(b)
+		if !strings.HasPrefix(sep[i], lb.endpointPrefix()) || len(sep[i]) > 28 {
+			t.Fatalf("invalid endpoint chain name %q", sep[i])
+		}
+	}
+
+	render := func(chains []lbChain) map[string][]string {
+		rendered := map[string][]string{}
+		for _, c := range chains {
+			rendered[c.name] = []string{}
+			for _, rule := range c.rules {
+				rendered[c.name] = append(rendered[c.name], joinRulespec(rule))
+			}
+		}
+		return rendered
+	}
+
+	chains, err := lb.chains(backends)
+	if err != nil {
+		t.Fatalf("chains failed: %v", err)
+	}
+	expected := map[string][]string{
+		lb.ServiceChain(): {
+			"-m statistic --mode random --probability 0.50000000000 -j " + sep[0],
+			"-m statistic --mode random --probability 0.50000000000 -j " + sep[1],
+			"-j " + sep[2],
+		},
+		sep[0]: {"-p tcp -j DNAT --to-destination 10.0.0.1:8080"},
+		sep[1]: {"-p tcp -j DNAT --to-destination 10.0.0.2:8080"},
+		sep[2]: {"-p tcp -j DNAT --to-destination 10.0.0.3:8080"},
+	}
+	if got := render(chains); !reflect.DeepEqual(got, expected) {
+		t.Fatalf("chains mismatch: \ngot  %#v \nneed %#v", got, expected)
+	}
+
+	lb.Mode = BalanceNth
+	lb.Affinity = 3 * time.Hour
+	backends[0].Weight = 0
+	if chains, err = lb.chains(backends[:2]); err != nil {
+		t.Fatalf("chains failed: %v", err)
+	}
+	recent := func(i int) string {
+		return "-m recent --rcheck --seconds 10800 --reap --name " + sep[i] + " --mask 255.255.255.255 --rsource -j " + sep[i]
+	}
+	expected = map[string][]string{
+		lb.ServiceChain(): {
+			recent(0),
+			recent(1),
+			"-m statistic --mode nth --every 2 --packet 0 -j " + sep[0],
+			"-j " + sep[1],
+		},
+		sep[0]: {"-p tcp -m recent --set --name " + sep[0] + " --mask 255.255.255.255 --rsource -j DNAT --to-destination 10.0.0.1:8080"},
+		sep[1]: {"-p tcp -m recent --set --name " + sep[1] + " --mask 255.255.255.255 --rsource -j DNAT --to-destination 10.0.0.2:8080"},
+	}
+	if got := render(chains); !reflect.DeepEqual(got, expected) {
+		t.Fatalf("chains with affinity mismatch: \ngot  %#v \nneed %#v", got, expected)
+	}
+
+	for name, bad := range map[string][]Backend{
+		"nth with weights": {{Address: "10.0.0.1", Weight: 2}, {Address: "10.0.0.2"}},
+		"duplicate":        {{Address: "10.0.0.1"}, {Address: "10.0.0.1"}},
+		"wrong family":     {{Address: "::1"}},
+		"negative weight":  {{Address: "10.0.0.1", Weight: -1}},
+	} {
+		if _, err := lb.chains(bad); err == nil {
+			t.Fatalf("expected err for %s, got none", name)
+		}
+	}
+}
+
+func TestLoadBalancer(t *testing.T) {
+	for i, ipt := range mustTestableIptables() {
+		t.Run(fmt.Sprint(i), func(t *testing.T) {
+			runLoadBalancerTests(t, ipt)
+		})
+	}
+}
+
+func runLoadBalancerTests(t *testing.T, ipt *IPTables) {
+	parent := randChain(t)
+	if err := ipt.NewChain("nat", parent); err != nil {
+		t.Fatalf("NewChain failed: %v", err)
+	}
+	defer func() {
+		if err := ipt.ClearAndDeleteChain("nat", parent); err != nil {
+			t.Fatalf("ClearAndDeleteChain failed: %v", err)
+		}
+	}()
+
+	vip, backend := "10.96.0.10", func(i int) string { return fmt.Sprintf("10.0.0.%d", i) }
+	if ipt.Proto() == ProtocolIPv6 {
+		vip, backend = "fd00:96::10", func(i int) string { return fmt.Sprintf("fd00::%d", i) }
+	}
+	lb := ipt.NewLoadBalancer(parent, "tcp", vip, 80)
+	lb.Parents = []string{parent}
+	lb.Affinity = time.Minute
+
+	hasChains := func(want ...string) {
+		chains, err := ipt.ListChains("nat")
+		if err != nil {
+			t.Fatalf("ListChains failed: %v", err)
+		}
+		var got []string
+		for _, chain := range chains {
+			if chain == lb.ServiceChain() || strings.HasPrefix(chain, lb.endpointPrefix()) {
+				got = append(got, chain)
+			}
+		}
+		sort.Strings(got)
+		sort.Strings(want)
+		if strings.Join(got, " ") != strings.Join(want, " ") {
+			t.Fatalf("chains mismatch: \ngot  %q \nneed %q", got, want)
+		}
+	}
+
+	backends := []Backend{{Address: backend(1), Port: 8080}, {Address: backend(2), Port: 8080}}
+	if err := lb.Sync(backends); err != nil {
+		t.Fatalf("Sync failed: %v", err)
+	}
+	// syncing again doesn't change anything
+	if err := lb.Sync(backends); err != nil {
+		t.Fatalf("Sync failed: %v", err)
+	}
+	chains, err := lb.chains(backends)
+	if err != nil {
+		t.Fatalf("chains failed: %v", err)
+	}
+	for _, c := range chains {
+		state, err := ipt.chainState("nat", c.name)
+		if err != nil {
+			t.Fatalf("chainState failed: %v", err)
+		}
+		if !reflect.DeepEqual(state.rules, c.rules) {
+			t.Fatalf("rules of %s mismatch: \ngot  %q \nneed %q", c.name, state.rules, c.rules)
+		}
+	}
+	state, err := ipt.chainState("nat", parent)
+	if err != nil {
+		t.Fatalf("chainState failed: %v", err)
+	}
+	if len(state.rules) != 1 {
+		t.Fatalf("expected a single jump in %s, got %q", parent, state.rules)
+	}
+
+	// the endpoint chain of the removed backend is deleted
+	if err := lb.Sync(backends[1:]); err != nil {
+		t.Fatalf("Sync failed: %v", err)
+	}
+	hasChains(lb.ServiceChain(), lb.EndpointChain(backends[1]))
+
+	if err := lb.Teardown(); err != nil {
+		t.Fatalf("Teardown failed: %v", err)
+	}
+	hasChains()
+}
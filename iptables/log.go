@@ -0,0 +1,377 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+)
+
+const (
+	// maxLogPrefixLen is the maximum length of a LOG prefix, see the prefix
+	// of struct xt_log_info in the kernel (30 including the terminating NUL)
+	maxLogPrefixLen = 29
+	// maxNFLogPrefixLen is the maximum length of a NFLOG prefix, see the
+	// prefix of struct xt_nflog_info in the kernel (64 including the
+	// terminating NUL)
+	maxNFLogPrefixLen = 63
+	// defaultLogLevel is the level of LOG rules without --log-level, which
+	// iptables doesn't list.
+	defaultLogLevel = 4
+)
+
+// logLevels are the syslog levels accepted by --log-level, by value.
+var logLevels = []string{"emerg", "alert", "crit", "error", "warning", "notice", "info", "debug"}
+
+// Log is the LOG target, logging the headers of matching packets to the
+// kernel log. Unlike most targets, rule traversal continues after it.
+type Log struct {
+	// Prefix starts the log lines of the rule, at most 29 characters. It
+	// should be unique, so that ReadLogEvents maps lines back to the rule.
+	Prefix string
+	// Level is the syslog level, by name, e.g. "info", or by value, e.g.
+	// "6". It defaults to "warning".
+	Level string
+	// TCPSequence, TCPOptions and IPOptions log the TCP sequence numbers,
+	// the TCP options and the IP options.
+	TCPSequence bool
+	TCPOptions  bool
+	IPOptions   bool
+	// UID logs the user id of the socket sending the packet.
+	UID bool
+}
+
+// args returns the target arguments, as listed by "iptables -S".
+func (l Log) args() ([]string, error) {
+	if err := checkLogPrefix("LOG", l.Prefix, maxLogPrefixLen); err != nil {
+		return nil, err
+	}
+	level, err := parseLogLevel(l.Level)
+	if err != nil {
+		return nil, err
+	}
+
+	args := []string{"LOG"}
+	if l.Prefix != "" {
+		args = append(args, "--log-prefix", l.Prefix)
+	}
+	if level != defaultLogLevel {
+		args = append(args, "--log-level", strconv.Itoa(level))
+	}
+	args = appendFlag(args, l.TCPSequence, "--log-tcp-sequence")
+	args = appendFlag(args, l.TCPOptions, "--log-tcp-options")
+	args = appendFlag(args, l.IPOptions, "--log-ip-options")
+	args = appendFlag(args, l.UID, "--log-uid")
+	return args, nil
+}
+
+// parseLogLevel returns the value of a syslog level given by name or value.
+func parseLogLevel(level string) (int, error) {
+	if level == "" {
+		return defaultLogLevel, nil
+	}
+	for i, name := range logLevels {
+		if strings.EqualFold(level, name) {
+			return i, nil
+		}
+	}
+	// aliases accepted by iptables
+	switch strings.ToLower(level) {
+	case "panic":
+		return 0, nil
+	case "err":
+		return 3, nil
+	case "warn":
+		return 4, nil
+	}
+	n, err := strconv.Atoi(level)
+	if err != nil || n < 0 || n >= len(logLevels) {
+		return 0, fmt.Errorf("invalid log level %q", level)
+	}
+	return n, nil
+}
+
+// NFLog is the NFLOG target, sending matching packets to userspace through
+// a netlink group, e.g. to ulogd. Rule traversal continues after it.
+type NFLog struct {
+	// Group is the netlink group the packets are sent to.
+	Group uint16
+	// Prefix is passed along with the packets, at most 63 characters.
+	Prefix string
+	// Range is the number of bytes of the packets copied, 0 copying whole
+	// packets. It is ignored by kernels since 4.9, which use Size instead.
+	Range uint32
+	// Size is the number of bytes of the packets copied, if set.
+	Size uint32
+	// Threshold is the number of packets queued in the kernel before they
+	// are sent. It defaults to 1.
+	Threshold uint16
+}
+
+// args returns the target arguments, as listed by "iptables -S".
+func (n NFLog) args() ([]string, error) {
+	if err := checkLogPrefix("NFLOG", n.Prefix, maxNFLogPrefixLen); err != nil {
+		return nil, err
+	}
+	if n.Range != 0 && n.Size != 0 {
+		return nil, fmt.Errorf("NFLOG range and size are exclusive")
+	}
+
+	args := []string{"NFLOG"}
+	if n.Prefix != "" {
+		args = append(args, "--nflog-prefix", n.Prefix)
+	}
+	if n.Group != 0 {
+		args = append(args, "--nflog-group", strconv.Itoa(int(n.Group)))
+	}
+	if n.Size != 0 {
+		args = append(args, "--nflog-size", strconv.FormatUint(uint64(n.Size), 10))
+	} else if n.Range != 0 {
+		args = append(args, "--nflog-range", strconv.FormatUint(uint64(n.Range), 10))
+	}
+	if n.Threshold > 1 {
+		args = append(args, "--nflog-threshold", strconv.Itoa(int(n.Threshold)))
+	}
+	return args, nil
+}
+
+// checkLogPrefix checks a prefix of the target against its maximum length.
+func checkLogPrefix(target, prefix string, max int) error {
+	if len(prefix) > max {
+		return fmt.Errorf("%s prefix %q exceeds %d characters", target, prefix, max)
+	}
+	if strings.ContainsAny(prefix, "\n\r") {
+		return fmt.Errorf("%s prefix %q contains a newline", target, prefix)
+	}
+	return nil
+}
+
+// Log sets the LOG target of the rule.
+func (r *Rule) Log(l Log) *Rule {
+	r.noNot("target")
+	args, err := l.args()
+	if err != nil {
+		r.errs = append(r.errs, err)
+		return r
+	}
+	return r.setTarget(args[0], false, args[1:])
+}
+
+// NFLog sets the NFLOG target of the rule.
+func (r *Rule) NFLog(n NFLog) *Rule {
+	r.noNot("target")
+	args, err := n.args()
+	if err != nil {
+		r.errs = append(r.errs, err)
+		return r
+	}
+	return r.setTarget(args[0], false, args[1:])
+}
+
+// LogRule is a rule with the LOG target.
+type LogRule struct {
+	Table string
+	Chain string
+	// Position is the 1-based position of the rule in Chain.
+	Position int
+	Prefix   string
+	Rulespec []string
+}
+
+// LogRules returns the rules of table with the LOG target, from a single
+// listing.
+func (ipt *IPTables) LogRules(table string) ([]LogRule, error) {
+	lines, err := ipt.executeList([]string{"-t", table, "-S"})
+	if err != nil {
+		return nil, err
+	}
+	return parseLogRules(table, lines)
+}
+
+// parseLogRules returns the LOG rules of "iptables -S" output.
+func parseLogRules(table string, lines []string) ([]LogRule, error) {
+	var rules []LogRule
+	positions := map[string]int{}
+	for _, line := range lines {
+		args, err := splitRulespec(line)
+		if err != nil {
+			return nil, err
+		}
+		if len(args) < 2 || args[0] != "-A" {
+			continue
+		}
+		chain := args[1]
+		positions[chain]++
+		if target, _ := ruleTarget(args[2:]); target != "LOG" {
+			continue
+		}
+		rule := LogRule{Table: table, Chain: chain, Position: positions[chain], Rulespec: args[2:]}
+		for i := 2; i+1 < len(args); i++ {
+			if args[i] == "--log-prefix" {
+				rule.Prefix = args[i+1]
+			}
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+// LogEvent is a packet logged by a LOG rule.
+type LogEvent struct {
+	// Line is the number of the log line, starting at 1.
+	Line   int
+	Prefix string
+	// In and Out are the input and output interfaces, empty when unknown,
+	// e.g. Out in INPUT.
+	In  string
+	Out string
+	Src net.IP
+	Dst net.IP
+	// Proto is the protocol, e.g. "TCP", "UDP" or "ICMP".
+	Proto string
+	// SrcPort and DstPort are the ports of TCP, UDP and similar protocols,
+	// 0 otherwise.
+	SrcPort int
+	DstPort int
+	// Fields are all the KEY=value fields of the line, e.g. "TTL" or
+	// "MAC", and Flags the other words, e.g. "DF" or "SYN". Both only cover
+	// the logged packet, not the packet quoted by an ICMP error.
+	Fields map[string]string
+	Flags  []string
+	// Rule is the rule that logged the packet, if its prefix is the prefix
+	// of a single rule.
+	Rule *LogRule
+}
+
+// ReadLogEvents reads kernel log lines from r, such as the output of dmesg
+// or journalctl -k, and returns the packets logged by LOG rules. Other
+// lines, including malformed or truncated LOG lines, are skipped. Events
+// are mapped to the rule of rules with the same prefix, ignoring spaces
+// around prefixes; rules are typically those returned by LogRules.
+func ReadLogEvents(r io.Reader, rules []LogRule) ([]*LogEvent, error) {
+	byPrefix := map[string][]*LogRule{}
+	for i := range rules {
+		prefix := strings.TrimSpace(rules[i].Prefix)
+		byPrefix[prefix] = append(byPrefix[prefix], &rules[i])
+	}
+
+	var events []*LogEvent
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		event, err := parseLogLine(scanner.Text())
+		if err != nil || event == nil {
+			// kernel logs mix in truncated and unrelated lines, skip them
+			// rather than losing the rest of the log
+			continue
+		}
+		event.Line = n
+		if matches := byPrefix[strings.TrimSpace(event.Prefix)]; len(matches) == 1 {
+			event.Rule = matches[0]
+		}
+		events = append(events, event)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return events, nil
+}
+
+// parseLogLine parses a kernel log line written by the LOG target, e.g.
+//
+//	[ 1234.567890] DROP-IN: IN=eth0 OUT= MAC=... SRC=192.0.2.1 DST=192.0.2.2 ...
+//
+// It returns nil if the line wasn't written by LOG.
+func parseLogLine(line string) (*LogEvent, error) {
+	// the prefix is arbitrary, so the packet starts at the first "IN="
+	// followed by "OUT=", which LOG always writes
+	start := -1
+	for i := 0; ; {
+		j := strings.Index(line[i:], "IN=")
+		if j < 0 {
+			return nil, nil
+		}
+		i += j
+		if end := strings.IndexByte(line[i:], ' '); end >= 0 && strings.HasPrefix(line[i+end+1:], "OUT=") {
+			start = i
+			break
+		}
+		i += len("IN=")
+	}
+
+	event := &LogEvent{Prefix: logLinePrefix(line[:start]), Fields: map[string]string{}}
+	for _, word := range strings.Fields(line[start:]) {
+		if strings.HasPrefix(word, "[") {
+			// the packet quoted by an ICMP error
+			break
+		}
+		i := strings.IndexByte(word, '=')
+		if i < 0 {
+			event.Flags = append(event.Flags, word)
+			continue
+		}
+		key, value := word[:i], word[i+1:]
+		if _, ok := event.Fields[key]; !ok {
+			event.Fields[key] = value
+		}
+	}
+
+	event.In, event.Out, event.Proto = event.Fields["IN"], event.Fields["OUT"], event.Fields["PROTO"]
+	for _, f := range []struct {
+		key string
+		ip  *net.IP
+	}{{"SRC", &event.Src}, {"DST", &event.Dst}} {
+		value, ok := event.Fields[f.key]
+		if !ok {
+			continue
+		}
+		if *f.ip = net.ParseIP(value); *f.ip == nil {
+			return nil, fmt.Errorf("invalid %s address %q", f.key, value)
+		}
+	}
+	for _, f := range []struct {
+		key  string
+		port *int
+	}{{"SPT", &event.SrcPort}, {"DPT", &event.DstPort}} {
+		value, ok := event.Fields[f.key]
+		if !ok {
+			continue
+		}
+		port, err := strconv.ParseUint(value, 10, 16)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s port %q", f.key, value)
+		}
+		*f.port = int(port)
+	}
+	return event, nil
+}
+
+// logLinePrefix returns the LOG prefix from the part of a kernel log line
+// before the packet, skipping the syslog header of journalctl and syslog
+// files and the kernel timestamp of dmesg.
+func logLinePrefix(s string) string {
+	if i := strings.Index(s, "kernel: "); i >= 0 {
+		s = s[i+len("kernel: "):]
+	}
+	if strings.HasPrefix(s, "[") {
+		if i := strings.IndexByte(s, ']'); i >= 0 {
+			s = strings.TrimPrefix(s[i+1:], " ")
+		}
+	}
+	return s
+}
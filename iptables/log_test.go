@@ -0,0 +1,219 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables
+
+import (
+	"fmt"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestLogTargets(t *testing.T) {
+	testCases := []struct {
+		name    string
+		rule    *Rule
+		args    string
+		wantErr bool
+	}{
+		{
+			name: "log defaults",
+			rule: NewRule().Log(Log{}),
+			args: "-j LOG",
+		},
+		{
+			name: "log",
+			rule: NewRule().Protocol("tcp").Log(Log{Prefix: "DROP-IN: ", Level: "info", TCPOptions: true, UID: true}),
+			args: `-p tcp -j LOG --log-prefix "DROP-IN: " --log-level 6 --log-tcp-options --log-uid`,
+		},
+		{
+			name: "log level by value",
+			rule: NewRule().Log(Log{Level: "7", TCPSequence: true, IPOptions: true}),
+			args: "-j LOG --log-level 7 --log-tcp-sequence --log-ip-options",
+		},
+		{
+			name: "log default level",
+			rule: NewRule().Log(Log{Level: "warn"}),
+			args: "-j LOG",
+		},
+		{
+			name: "nflog",
+			rule: NewRule().NFLog(NFLog{Group: 5, Prefix: "audit", Size: 128, Threshold: 10}),
+			args: "-j NFLOG --nflog-prefix audit --nflog-group 5 --nflog-size 128 --nflog-threshold 10",
+		},
+		{
+			name: "nflog range",
+			rule: NewRule().NFLog(NFLog{Range: 64, Threshold: 1}),
+			args: "-j NFLOG --nflog-range 64",
+		},
+		{name: "long log prefix", rule: NewRule().Log(Log{Prefix: strings.Repeat("x", 30)}), wantErr: true},
+		{name: "newline in prefix", rule: NewRule().Log(Log{Prefix: "a\nb"}), wantErr: true},
+		{name: "invalid level", rule: NewRule().Log(Log{Level: "8"}), wantErr: true},
+		{name: "long nflog prefix", rule: NewRule().NFLog(NFLog{Prefix: strings.Repeat("x", 64)}), wantErr: true},
+		{name: "nflog range and size", rule: NewRule().NFLog(NFLog{Range: 1, Size: 1}), wantErr: true},
+		{name: "two targets", rule: NewRule().Log(Log{}).Jump("DROP"), wantErr: true},
+	}
+
+	for _, tt := range testCases {
+		t.Run(tt.name, func(t *testing.T) {
+			args, err := tt.rule.Args()
+			if err == nil && tt.wantErr {
+				t.Fatalf("expected err, got %q", args)
+			} else if err != nil && !tt.wantErr {
+				t.Fatalf("unexpected err %s", err)
+			}
+			if tt.wantErr {
+				return
+			}
+			if got := joinRulespec(args); got != tt.args {
+				t.Fatalf("args mismatch: \ngot  %s \nneed %s", got, tt.args)
+			}
+		})
+	}
+
+	if err := checkLogPrefix("LOG", strings.Repeat("x", maxLogPrefixLen), maxLogPrefixLen); err != nil {
+		t.Fatalf("unexpected err for a %d characters prefix: %v", maxLogPrefixLen, err)
+	}
+}
+
+func TestReadLogEvents(t *testing.T) {
+	listing := []string{
+		"-P INPUT ACCEPT",
+		"-N BLOCK",
+		`-A INPUT -s 10.0.0.0/8 -j LOG --log-prefix "DROP-IN: " --log-level 6`,
+		"-A INPUT -j BLOCK",
+		"-A BLOCK -p tcp -j ACCEPT",
+		`-A BLOCK -j LOG --log-prefix "SHARED "`,
+		`-A BLOCK -j LOG --log-prefix "SHARED "`,
+		"-A BLOCK -j LOG",
+	}
+	rules, err := parseLogRules("filter", listing)
+	if err != nil {
+		t.Fatalf("parseLogRules failed: %v", err)
+	}
+	expectedRules := []LogRule{
+		{Table: "filter", Chain: "INPUT", Position: 1, Prefix: "DROP-IN: ", Rulespec: []string{"-s", "10.0.0.0/8", "-j", "LOG", "--log-prefix", "DROP-IN: ", "--log-level", "6"}},
+		{Table: "filter", Chain: "BLOCK", Position: 2, Prefix: "SHARED ", Rulespec: []string{"-j", "LOG", "--log-prefix", "SHARED "}},
+		{Table: "filter", Chain: "BLOCK", Position: 3, Prefix: "SHARED ", Rulespec: []string{"-j", "LOG", "--log-prefix", "SHARED "}},
+		{Table: "filter", Chain: "BLOCK", Position: 4, Rulespec: []string{"-j", "LOG"}},
+	}
+	if !reflect.DeepEqual(rules, expectedRules) {
+		t.Fatalf("parseLogRules mismatch: \ngot  %#v \nneed %#v", rules, expectedRules)
+	}
+
+	log := `[ 1234.567890] DROP-IN: IN=eth0 OUT= MAC=52:54:00:12:34:56:52:54:00:65:43:21:08:00 SRC=10.1.2.3 DST=192.0.2.1 LEN=60 TOS=0x00 PREC=0x00 TTL=64 ID=4242 DF PROTO=TCP SPT=51234 DPT=22 WINDOW=64240 RES=0x00 SYN URGP=0
+[ 1234.600000] eth0: link becomes ready
+Oct 18 10:00:00 host kernel: SHARED IN=eth1 OUT= SRC=2001:db8::1 DST=2001:db8::2 LEN=104 TC=0 HOPLIMIT=64 FLOWLBL=1 PROTO=ICMPv6 TYPE=128 CODE=0 ID=7 SEQ=1
+[Sat Oct 18 10:00:01 2026] IN= OUT=eth0 SRC=192.0.2.1 DST=198.51.100.1 LEN=88 TOS=0x00 PREC=0xC0 TTL=64 ID=1 PROTO=ICMP TYPE=3 CODE=3 [SRC=198.51.100.1 DST=192.0.2.1 LEN=60 PROTO=UDP SPT=53 DPT=40000 LEN=40 ]
+[ 1240.000000] UNKNOWN:IN=lo OUT= SRC=127.0.0.1 DST=127.0.0.1 LEN=40 PROTO=UDP SPT=1 DPT=2 LEN=20
+`
+	events, err := ReadLogEvents(strings.NewReader(log), rules)
+	if err != nil {
+		t.Fatalf("ReadLogEvents failed: %v", err)
+	}
+	if len(events) != 4 {
+		t.Fatalf("expected 4 events, got %d", len(events))
+	}
+
+	e := events[0]
+	if e.Line != 1 || e.Prefix != "DROP-IN: " || e.In != "eth0" || e.Out != "" || !e.Src.Equal(net.ParseIP("10.1.2.3")) || !e.Dst.Equal(net.ParseIP("192.0.2.1")) ||
+		e.Proto != "TCP" || e.SrcPort != 51234 || e.DstPort != 22 || e.Fields["TTL"] != "64" || !reflect.DeepEqual(e.Flags, []string{"DF", "SYN"}) {
+		t.Fatalf("event mismatch: %#v", e)
+	}
+	if e.Rule != &rules[0] {
+		t.Fatalf("event mapped to %#v, need %#v", e.Rule, rules[0])
+	}
+
+	// a prefix shared by two rules maps to neither
+	if e := events[1]; e.Line != 3 || e.Prefix != "SHARED " || e.Proto != "ICMPv6" || !e.Src.Equal(net.ParseIP("2001:db8::1")) || e.Rule != nil {
+		t.Fatalf("event mismatch: %#v", e)
+	}
+
+	// the packet quoted by an ICMP error is ignored
+	if e := events[2]; e.Prefix != "" || e.Out != "eth0" || e.Fields["PROTO"] != "ICMP" || e.Fields["LEN"] != "88" || e.SrcPort != 0 || e.Rule != &rules[3] {
+		t.Fatalf("event mismatch: %#v", e)
+	}
+
+	if e := events[3]; e.Prefix != "UNKNOWN:" || e.Fields["LEN"] != "40" || e.Rule != nil {
+		t.Fatalf("event mismatch: %#v", e)
+	}
+
+	// a corrupt line between two valid ones is skipped
+	log = `[ 1.0] A: IN=eth0 OUT= SRC=10.0.0.1 DST=10.0.0.2 PROTO=TCP SPT=1 DPT=2
+[ 2.0] B: IN=eth0 OUT= SRC=10.0.0.1 DST=10.0.0.2 PROTO=TCP SPT=99999 DPT=1
+[ 3.0] C: IN=eth0 OUT= SRC=10.0.0.3 DST=10.0.0.4 PROTO=UDP SPT=3 DPT=4
+`
+	events, err = ReadLogEvents(strings.NewReader(log), nil)
+	if err != nil {
+		t.Fatalf("ReadLogEvents failed: %v", err)
+	}
+	if len(events) != 2 || events[0].Line != 1 || events[0].Prefix != "A: " || events[1].Line != 3 || events[1].Prefix != "C: " {
+		t.Fatalf("expected the events of lines 1 and 3, got %#v", events)
+	}
+}
+
+func TestLogRules(t *testing.T) {
+	for i, ipt := range mustTestableIptables() {
+		t.Run(fmt.Sprint(i), func(t *testing.T) {
+			runLogRulesTests(t, ipt)
+		})
+	}
+}
+
+func runLogRulesTests(t *testing.T, ipt *IPTables) {
+	chain := randChain(t)
+	if err := ipt.NewChain("filter", chain); err != nil {
+		t.Fatalf("NewChain failed: %v", err)
+	}
+	defer func() {
+		if err := ipt.ClearAndDeleteChain("filter", chain); err != nil {
+			t.Fatalf("ClearAndDeleteChain failed: %v", err)
+		}
+	}()
+
+	prefix := chain + " drop: "
+	logRule, err := NewRule().Protocol("tcp").Log(Log{Prefix: prefix, Level: "info", UID: true}).Args()
+	if err != nil {
+		t.Fatalf("Args failed: %v", err)
+	}
+	for _, rule := range [][]string{{"-p", "udp", "-j", "ACCEPT"}, logRule, {"-j", "DROP"}} {
+		if err := ipt.Append("filter", chain, rule...); err != nil {
+			t.Fatalf("Append failed: %v", err)
+		}
+	}
+	exists, err := ipt.Exists("filter", chain, logRule...)
+	if err != nil {
+		t.Fatalf("Exists failed: %v", err)
+	}
+	if !exists {
+		t.Fatalf("LOG rule %q not found", logRule)
+	}
+
+	rules, err := ipt.LogRules("filter")
+	if err != nil {
+		t.Fatalf("LogRules failed: %v", err)
+	}
+	var found []LogRule
+	for _, rule := range rules {
+		if rule.Chain == chain {
+			found = append(found, rule)
+		}
+	}
+	expected := []LogRule{{Table: "filter", Chain: chain, Position: 2, Prefix: prefix, Rulespec: logRule}}
+	if !reflect.DeepEqual(found, expected) {
+		t.Fatalf("LogRules mismatch: \ngot  %#v \nneed %#v", found, expected)
+	}
+}
@@ -0,0 +1,305 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables
+
+import "sort"
+
+// JumpRule describes the rule jumping into a managed chain from a parent
+// chain.
+type JumpRule struct {
+	// Chain is the parent chain, e.g. "INPUT".
+	Chain string
+	// Position is the 1-based position the jump rule is kept at. If 0, the
+	// jump rule may be anywhere in the parent chain.
+	Position int
+	// Match is an optional rulespec restricting the jump, e.g.
+	// []string{"-p", "tcp"}. It must be in the canonical form listed by
+	// "iptables -S".
+	Match []string
+}
+
+// rulespec returns the full rulespec of the jump into chain.
+func (j JumpRule) rulespec(chain string) []string {
+	spec := append([]string{}, j.Match...)
+	return append(spec, "-j", chain)
+}
+
+// ManagedChain is a user-defined chain whose jump rules in parent chains are
+// maintained alongside the chain itself.
+type ManagedChain struct {
+	ipt   *IPTables
+	Table string
+	Name  string
+	Jumps []JumpRule
+}
+
+// NewManagedChain returns a ManagedChain for the chain name in table, jumped
+// into from the given parent chains. Nothing is changed until Ensure or Sync
+// is called.
+func (ipt *IPTables) NewManagedChain(table, name string, jumps ...JumpRule) *ManagedChain {
+	return &ManagedChain{ipt: ipt, Table: table, Name: name, Jumps: jumps}
+}
+
+// Ensure creates the chain if it doesn't exist and makes sure every jump
+// rule exists exactly once, at its requested position. Jump rules that were
+// moved are deleted and re-inserted at their position.
+func (m *ManagedChain) Ensure() error {
+	ops := []Operation{{Kind: OpNewChain, Table: m.Table, Chain: m.Name}}
+	exists, err := m.ipt.ChainExists(m.Table, m.Name)
+	if err != nil {
+		return err
+	}
+	if exists {
+		ops = nil
+	}
+
+	jumpOps, err := m.jumpOps()
+	if err != nil {
+		return err
+	}
+	ops = append(ops, jumpOps...)
+
+	if len(ops) == 0 {
+		return nil
+	}
+	return m.ipt.restore(restoreScript(ops), false)
+}
+
+// Sync atomically replaces the rules of the chain with rules, creating the
+// chain if needed, and repairs the jump rules like Ensure. Rules that were
+// already in the chain keep their counters.
+func (m *ManagedChain) Sync(rules [][]string) error {
+	ops, err := m.ipt.rewriteChainOps(m.Table, m.Name, rules)
+	if err != nil {
+		return err
+	}
+
+	jumpOps, err := m.jumpOps()
+	if err != nil {
+		return err
+	}
+	ops = append(ops, jumpOps...)
+
+	return m.ipt.restore(restoreScript(ops), false)
+}
+
+// rewriteChainOps returns the operations replacing the rules of table/chain
+// with rules, creating the chain if needed. Rules that were already in the
+// chain keep their counters.
+func (ipt *IPTables) rewriteChainOps(table, chain string, rules [][]string) ([]Operation, error) {
+	state, err := ipt.chainState(table, chain)
+	if err != nil {
+		return nil, err
+	}
+	previous := counterPool{}
+	for i := len(state.rules) - 1; i >= 0; i-- {
+		previous.put(comparableRule(state.rules[i]), state.counters[i])
+	}
+
+	ops := []Operation{{Kind: opFlushChain, Table: table, Chain: chain}}
+	for _, rule := range rules {
+		ops = append(ops, Operation{
+			Kind:     OpAppendRule,
+			Table:    table,
+			Chain:    chain,
+			Rulespec: rule,
+			Counters: previous.take(comparableRule(rule)),
+		})
+	}
+	return ops, nil
+}
+
+// Teardown removes every rule jumping into the chain from the parent chains,
+// whatever its match, then flushes and deletes the chain. It is not an error
+// if the chain doesn't exist.
+func (m *ManagedChain) Teardown() error {
+	ops, err := m.teardownOps()
+	if err != nil {
+		return err
+	}
+	if len(ops) == 0 {
+		return nil
+	}
+	return m.ipt.restore(restoreScript(ops), false)
+}
+
+// teardownOps returns the operations performed by Teardown.
+func (m *ManagedChain) teardownOps() ([]Operation, error) {
+	exists, err := m.ipt.ChainExists(m.Table, m.Name)
+	if err != nil {
+		return nil, err
+	}
+
+	var ops []Operation
+	done := map[string]bool{}
+	for _, jump := range m.Jumps {
+		if done[jump.Chain] {
+			continue
+		}
+		done[jump.Chain] = true
+
+		state, err := m.ipt.chainState(m.Table, jump.Chain)
+		if err != nil {
+			return nil, err
+		}
+		for i := len(state.rules) - 1; i >= 0; i-- {
+			if target, _ := ruleTarget(state.rules[i]); target == m.Name {
+				ops = append(ops, Operation{Kind: OpDeleteRule, Table: m.Table, Chain: jump.Chain, Position: i + 1, Rulespec: state.rules[i]})
+			}
+		}
+	}
+
+	if exists {
+		ops = append(ops,
+			Operation{Kind: opFlushChain, Table: m.Table, Chain: m.Name},
+			Operation{Kind: opDeleteChain, Table: m.Table, Chain: m.Name},
+		)
+	}
+	return ops, nil
+}
+
+// jumpOps returns the operations needed to bring the jump rules to their
+// requested position. Each parent chain is listed once.
+func (m *ManagedChain) jumpOps() ([]Operation, error) {
+	var parents []string
+	jumps := map[string][]JumpRule{}
+	for _, jump := range m.Jumps {
+		if _, ok := jumps[jump.Chain]; !ok {
+			parents = append(parents, jump.Chain)
+		}
+		jumps[jump.Chain] = append(jumps[jump.Chain], jump)
+	}
+
+	var ops []Operation
+	for _, parent := range parents {
+		state, err := m.ipt.chainState(m.Table, parent)
+		if err != nil {
+			return nil, err
+		}
+		ops = append(ops, planJumps(m.Table, m.Name, jumps[parent], state)...)
+	}
+	return ops, nil
+}
+
+// planJumps returns the operations bringing the jump rules of a single
+// parent chain to their requested position. The operations run one after
+// the other, so each jump is planned against the state left by the
+// operations of the previous ones. Jumps are planned by increasing
+// position, so that inserting a jump doesn't move those already placed,
+// and jumps that may be anywhere come last.
+func planJumps(table, chain string, jumps []JumpRule, state *chainState) []Operation {
+	sorted := append([]JumpRule{}, jumps...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		pi, pj := sorted[i].Position, sorted[j].Position
+		return pi != 0 && (pj == 0 || pi < pj)
+	})
+
+	sim := &chainState{
+		exists:   state.exists,
+		rules:    append([][]string{}, state.rules...),
+		counters: make([]Counters, len(state.rules)),
+	}
+	copy(sim.counters, state.counters)
+
+	var ops []Operation
+	for _, jump := range sorted {
+		jumpOps := planJump(table, chain, jump, sim)
+		for _, op := range jumpOps {
+			sim.apply(op)
+		}
+		ops = append(ops, jumpOps...)
+	}
+	return ops
+}
+
+// apply updates the rules of the state with a rule operation, as
+// iptables-restore would.
+func (s *chainState) apply(op Operation) {
+	var counters Counters
+	if op.Counters != nil {
+		counters = *op.Counters
+	}
+	switch op.Kind {
+	case OpDeleteRule:
+		s.rules = append(s.rules[:op.Position-1], s.rules[op.Position:]...)
+		s.counters = append(s.counters[:op.Position-1], s.counters[op.Position:]...)
+	case OpInsertRule:
+		pos := op.Position - 1
+		s.rules = append(s.rules[:pos], append([][]string{op.Rulespec}, s.rules[pos:]...)...)
+		s.counters = append(s.counters[:pos], append([]Counters{counters}, s.counters[pos:]...)...)
+	case OpAppendRule:
+		s.rules = append(s.rules, op.Rulespec)
+		s.counters = append(s.counters, counters)
+	}
+}
+
+// planJump returns the operations that leave exactly one copy of the jump
+// rule in the parent chain, at the requested position. A jump rule that is
+// moved keeps the counters of its first copy.
+func planJump(table, chain string, jump JumpRule, state *chainState) []Operation {
+	spec := jump.rulespec(chain)
+	want := comparableRule(spec)
+
+	var found []int
+	for i, rule := range state.rules {
+		if comparableRule(rule) == want {
+			found = append(found, i+1)
+		}
+	}
+
+	var ops []Operation
+	if jump.Position == 0 {
+		if len(found) == 0 {
+			return append(ops, Operation{Kind: OpAppendRule, Table: table, Chain: jump.Chain, Rulespec: spec})
+		}
+		// keep the first copy, remove the duplicates
+		for i := len(found) - 1; i > 0; i-- {
+			ops = append(ops, Operation{Kind: OpDeleteRule, Table: table, Chain: jump.Chain, Position: found[i], Rulespec: state.rules[found[i]-1]})
+		}
+		return ops
+	}
+
+	// a position past the end of the chain is satisfied by the last rule
+	if len(found) == 1 && (found[0] == jump.Position || found[0] == len(state.rules) && jump.Position > found[0]) {
+		return nil
+	}
+	for i := len(found) - 1; i >= 0; i-- {
+		ops = append(ops, Operation{Kind: OpDeleteRule, Table: table, Chain: jump.Chain, Position: found[i], Rulespec: state.rules[found[i]-1]})
+	}
+	pos := jump.Position
+	if remaining := len(state.rules) - len(found); pos > remaining+1 {
+		pos = remaining + 1
+	}
+	op := Operation{Kind: OpInsertRule, Table: table, Chain: jump.Chain, Position: pos, Rulespec: spec}
+	if len(found) > 0 && found[0] <= len(state.counters) {
+		if counters := state.counters[found[0]-1]; counters != (Counters{}) {
+			op.Counters = &counters
+		}
+	}
+	return append(ops, op)
+}
+
+// ruleTarget returns the target of a rulespec and whether it is a goto.
+func ruleTarget(rulespec []string) (string, bool) {
+	for i := 0; i+1 < len(rulespec); i++ {
+		switch rulespec[i] {
+		case "-j", "--jump":
+			return rulespec[i+1], false
+		case "-g", "--goto":
+			return rulespec[i+1], true
+		}
+	}
+	return "", false
+}
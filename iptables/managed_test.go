@@ -0,0 +1,194 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestPlanJump(t *testing.T) {
+	jump := []string{"-p", "tcp", "-j", "MYAPP"}
+	other := []string{"-j", "ACCEPT"}
+
+	testCases := []struct {
+		name     string
+		jumps    []JumpRule
+		rules    [][]string
+		counters []Counters
+		ops      []string
+	}{
+		{
+			name:  "missing",
+			jumps: []JumpRule{{Chain: "INPUT", Position: 1, Match: []string{"-p", "tcp"}}},
+			rules: [][]string{other},
+			ops:   []string{"-t filter -I INPUT 1 -p tcp -j MYAPP"},
+		},
+		{
+			name:  "in place",
+			jumps: []JumpRule{{Chain: "INPUT", Position: 1, Match: []string{"-p", "tcp"}}},
+			rules: [][]string{jump, other},
+		},
+		{
+			name:  "moved",
+			jumps: []JumpRule{{Chain: "INPUT", Position: 1, Match: []string{"-p", "tcp"}}},
+			rules: [][]string{other, jump},
+			ops: []string{
+				"-t filter -D INPUT 2",
+				"-t filter -I INPUT 1 -p tcp -j MYAPP",
+			},
+		},
+		{
+			name:     "moved with counters",
+			jumps:    []JumpRule{{Chain: "INPUT", Position: 1, Match: []string{"-p", "tcp"}}},
+			rules:    [][]string{other, jump},
+			counters: []Counters{{}, {Packets: 12, Bytes: 3400}},
+			ops: []string{
+				"-t filter -D INPUT 2",
+				"-t filter -I INPUT 1 -c 12 3400 -p tcp -j MYAPP",
+			},
+		},
+		{
+			name:  "position past the end",
+			jumps: []JumpRule{{Chain: "INPUT", Position: 5, Match: []string{"-p", "tcp"}}},
+			rules: [][]string{other, jump},
+		},
+		{
+			name:  "duplicates anywhere",
+			jumps: []JumpRule{{Chain: "INPUT", Match: []string{"-p", "tcp"}}},
+			rules: [][]string{other, jump, other, jump},
+			ops:   []string{"-t filter -D INPUT 4"},
+		},
+		{
+			name:  "missing anywhere",
+			jumps: []JumpRule{{Chain: "INPUT"}},
+			rules: [][]string{other},
+			ops:   []string{"-t filter -A INPUT -j MYAPP"},
+		},
+		{
+			// the second jump is planned after the first one moved
+			name: "two jumps in one parent",
+			jumps: []JumpRule{
+				{Chain: "INPUT", Position: 2, Match: []string{"-i", "eth0"}},
+				{Chain: "INPUT", Position: 1, Match: []string{"-i", "eth1"}},
+			},
+			rules: [][]string{{"-i", "eth0", "-j", "MYAPP"}, {"-i", "eth1", "-j", "MYAPP"}, other},
+			ops: []string{
+				"-t filter -D INPUT 2",
+				"-t filter -I INPUT 1 -i eth1 -j MYAPP",
+			},
+		},
+		{
+			name: "two jumps missing",
+			jumps: []JumpRule{
+				{Chain: "INPUT"},
+				{Chain: "INPUT", Position: 3, Match: []string{"-i", "eth0"}},
+				{Chain: "INPUT", Position: 1, Match: []string{"-i", "eth1"}},
+			},
+			rules: [][]string{other, other},
+			ops: []string{
+				"-t filter -I INPUT 1 -i eth1 -j MYAPP",
+				"-t filter -I INPUT 3 -i eth0 -j MYAPP",
+				"-t filter -A INPUT -j MYAPP",
+			},
+		},
+	}
+
+	for _, tt := range testCases {
+		t.Run(tt.name, func(t *testing.T) {
+			ops := planJumps("filter", "MYAPP", tt.jumps, &chainState{exists: true, rules: tt.rules, counters: tt.counters})
+			var got []string
+			for _, op := range ops {
+				got = append(got, op.String())
+			}
+			if !reflect.DeepEqual(got, tt.ops) {
+				t.Fatalf("planJumps mismatch: \ngot  %#v \nneed %#v", got, tt.ops)
+			}
+		})
+	}
+}
+
+func TestManagedChain(t *testing.T) {
+	for i, ipt := range mustTestableIptables() {
+		t.Run(fmt.Sprint(i), func(t *testing.T) {
+			runManagedChainTests(t, ipt)
+		})
+	}
+}
+
+func runManagedChainTests(t *testing.T, ipt *IPTables) {
+	parent := randChain(t)
+	if err := ipt.ClearChain("filter", parent); err != nil {
+		t.Fatalf("ClearChain failed: %v", err)
+	}
+	defer func() {
+		if err := ipt.ClearAndDeleteChain("filter", parent); err != nil {
+			t.Fatalf("ClearAndDeleteChain failed: %v", err)
+		}
+	}()
+	if err := ipt.Append("filter", parent, "-j", "RETURN"); err != nil {
+		t.Fatalf("Append failed: %v", err)
+	}
+
+	chain := randChain(t)
+	m := ipt.NewManagedChain("filter", chain, JumpRule{Chain: parent, Position: 1})
+
+	if err := m.Sync([][]string{{"-j", "ACCEPT"}}); err != nil {
+		t.Fatalf("Sync failed: %v", err)
+	}
+	// move the jump to the end of the parent chain
+	if err := ipt.Delete("filter", parent, "-j", chain); err != nil {
+		t.Fatalf("Delete failed: %v", err)
+	}
+	if err := ipt.Append("filter", parent, "-j", chain); err != nil {
+		t.Fatalf("Append failed: %v", err)
+	}
+	if err := m.Ensure(); err != nil {
+		t.Fatalf("Ensure failed: %v", err)
+	}
+
+	rules, err := ipt.List("filter", parent)
+	if err != nil {
+		t.Fatalf("List failed: %v", err)
+	}
+	expected := []string{
+		"-N " + parent,
+		"-A " + parent + " -j " + chain,
+		"-A " + parent + " -j RETURN",
+	}
+	if !reflect.DeepEqual(rules, expected) {
+		t.Fatalf("List mismatch: \ngot  %#v \nneed %#v", rules, expected)
+	}
+
+	if err := m.Teardown(); err != nil {
+		t.Fatalf("Teardown failed: %v", err)
+	}
+	exists, err := ipt.ChainExists("filter", chain)
+	if err != nil {
+		t.Fatalf("ChainExists failed: %v", err)
+	}
+	if exists {
+		t.Fatal("Teardown didn't delete the chain")
+	}
+	rules, err = ipt.List("filter", parent)
+	if err != nil {
+		t.Fatalf("List failed: %v", err)
+	}
+	if strings.Contains(strings.Join(rules, "\n"), chain) {
+		t.Fatalf("Teardown left jump rules behind: %#v", rules)
+	}
+}
@@ -0,0 +1,230 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// MangleTarget is a target of the mangle table: TProxy, Mark or Connmark.
+type MangleTarget interface {
+	// args returns the target arguments for the family of ipt.
+	args(ipt *IPTables) ([]string, error)
+	// chains returns the built-in chains the target is valid in, or nil if
+	// it is valid in every chain.
+	chains() []string
+	// protocols returns the protocols the rule must match, or nil if any
+	// protocol is accepted.
+	protocols() []string
+}
+
+// TProxy redirects packets to a local socket without changing them, for
+// transparent proxies.
+type TProxy struct {
+	// Port is the port the proxy listens on.
+	Port int
+	// Address is the address the proxy listens on. It defaults to any
+	// address of the family.
+	Address string
+	// Mark and Mask set the bits of Mask in the packet mark to Mark, so that
+	// a policy routing rule delivers the packets locally. Mask defaults to
+	// 0xffffffff if Mark is set.
+	Mark uint32
+	Mask uint32
+}
+
+func (t TProxy) args(ipt *IPTables) ([]string, error) {
+	if t.Port <= 0 || t.Port > 65535 {
+		return nil, fmt.Errorf("invalid TPROXY port %d", t.Port)
+	}
+	address := "0.0.0.0"
+	if ipt.proto == ProtocolIPv6 {
+		address = "::"
+	}
+	if t.Address != "" {
+		ip := net.ParseIP(t.Address)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid TPROXY address %q", t.Address)
+		}
+		if (ip.To4() == nil) != (ipt.proto == ProtocolIPv6) {
+			return nil, fmt.Errorf("TPROXY address %s doesn't match the family of %s", t.Address, getIptablesCommand(ipt.proto))
+		}
+		address = ip.String()
+	}
+	mask := t.Mask
+	if mask == 0 && t.Mark != 0 {
+		mask = 0xffffffff
+	}
+	return []string{"-j", "TPROXY", "--on-port", strconv.Itoa(t.Port), "--on-ip", address, "--tproxy-mark", markString(t.Mark, mask)}, nil
+}
+
+func (t TProxy) chains() []string    { return []string{"PREROUTING"} }
+func (t TProxy) protocols() []string { return []string{"tcp", "udp"} }
+
+// Mark sets bits of the packet mark.
+type Mark struct {
+	// Value is the new value of the bits of Mask.
+	Value uint32
+	// Mask selects the bits changed. It defaults to 0xffffffff, changing
+	// the whole mark.
+	Mask uint32
+}
+
+func (t Mark) args(ipt *IPTables) ([]string, error) {
+	return []string{"-j", "MARK", "--set-xmark", markString(t.Value, setMask(t.Value, t.Mask))}, nil
+}
+
+func (t Mark) chains() []string    { return nil }
+func (t Mark) protocols() []string { return nil }
+
+// ConnmarkMode is the operation of a Connmark target.
+type ConnmarkMode string
+
+const (
+	// ConnmarkSet sets bits of the connection mark.
+	ConnmarkSet ConnmarkMode = "set"
+	// ConnmarkSave copies bits of the packet mark to the connection mark.
+	ConnmarkSave ConnmarkMode = "save"
+	// ConnmarkRestore copies bits of the connection mark to the packet
+	// mark.
+	ConnmarkRestore ConnmarkMode = "restore"
+)
+
+// Connmark sets, saves or restores the connection mark, which is kept by
+// connection tracking for all the packets of the connection.
+type Connmark struct {
+	Mode ConnmarkMode
+	// Value is the new value of the bits of Mask for ConnmarkSet.
+	Value uint32
+	// Mask selects the bits changed or copied. It defaults to 0xffffffff.
+	Mask uint32
+}
+
+func (t Connmark) args(ipt *IPTables) ([]string, error) {
+	mask := t.Mask
+	if mask == 0 {
+		mask = 0xffffffff
+	}
+	switch t.Mode {
+	case ConnmarkSet:
+		return []string{"-j", "CONNMARK", "--set-xmark", markString(t.Value, setMask(t.Value, t.Mask))}, nil
+	case ConnmarkSave, ConnmarkRestore:
+		if t.Value != 0 {
+			return nil, fmt.Errorf("CONNMARK value is only used by mode %s", ConnmarkSet)
+		}
+		m := "0x" + strconv.FormatUint(uint64(mask), 16)
+		return []string{"-j", "CONNMARK", "--" + string(t.Mode) + "-mark", "--nfmask", m, "--ctmask", m}, nil
+	}
+	return nil, fmt.Errorf("unknown CONNMARK mode %q", t.Mode)
+}
+
+func (t Connmark) chains() []string    { return nil }
+func (t Connmark) protocols() []string { return nil }
+
+// setMask returns the mask of --set-xmark equivalent to --set-mark
+// value/mask, which clears the bits of mask and sets those of value.
+func setMask(value, mask uint32) uint32 {
+	if mask == 0 {
+		mask = 0xffffffff
+	}
+	return value | mask
+}
+
+// markString formats a mark and mask the way iptables lists them.
+func markString(value, mask uint32) string {
+	return fmt.Sprintf("0x%x/0x%x", value, mask)
+}
+
+// Socket is the socket match, matching packets with a local socket.
+type Socket struct {
+	// Transparent only matches transparent sockets, those of a
+	// transparent proxy.
+	Transparent bool
+	// NoWildcard ignores sockets listening on any address.
+	NoWildcard bool
+	// RestoreSkmark sets the packet mark to the mark of the socket.
+	RestoreSkmark bool
+}
+
+// Socket adds a socket match to the rule.
+func (r *Rule) Socket(s Socket) *Rule {
+	r.noNot("socket match")
+	var args []string
+	args = appendFlag(args, s.Transparent, "--transparent")
+	args = appendFlag(args, s.NoWildcard, "--nowildcard")
+	args = appendFlag(args, s.RestoreSkmark, "--restore-skmark")
+	return r.addMatch("socket", args...)
+}
+
+// MangleRulespec returns the rulespec of a rule of the mangle table's chain
+// applying target to the packets matched by match, which may be nil. It
+// checks that the target and the matches are valid in chain and that the
+// protocol the target requires is matched.
+func (ipt *IPTables) MangleRulespec(chain string, match *Rule, target MangleTarget) ([]string, error) {
+	if valid := target.chains(); valid != nil && isBuiltinChain(chain) && !contains(valid, chain) {
+		return nil, fmt.Errorf("%T is not valid in chain %s, only in %s", target, chain, strings.Join(valid, ", "))
+	}
+
+	if match == nil {
+		match = NewRule()
+	}
+	if match.target != nil {
+		return nil, fmt.Errorf("mangle match already has a target")
+	}
+	args, err := match.Args()
+	if err != nil {
+		return nil, err
+	}
+	if err := match.CheckChain(chain); err != nil {
+		return nil, err
+	}
+	if err := ipt.checkRuleFamily(match); err != nil {
+		return nil, err
+	}
+	if protocols := target.protocols(); protocols != nil {
+		if match.protocol == nil || match.protocol.invert || !contains(protocols, match.protocol.value) {
+			return nil, fmt.Errorf("%T requires protocol %s", target, strings.Join(protocols, " or "))
+		}
+	}
+
+	targetArgs, err := target.args(ipt)
+	if err != nil {
+		return nil, err
+	}
+	return append(args, targetArgs...), nil
+}
+
+// EnsureMangle appends the rule built by MangleRulespec to chain of the
+// mangle table, unless it already exists.
+func (ipt *IPTables) EnsureMangle(chain string, match *Rule, target MangleTarget) error {
+	spec, err := ipt.MangleRulespec(chain, match, target)
+	if err != nil {
+		return err
+	}
+	return ipt.AppendUnique("mangle", chain, spec...)
+}
+
+// DeleteMangle deletes the rule built by MangleRulespec from chain of the
+// mangle table, if it exists.
+func (ipt *IPTables) DeleteMangle(chain string, match *Rule, target MangleTarget) error {
+	spec, err := ipt.MangleRulespec(chain, match, target)
+	if err != nil {
+		return err
+	}
+	return ipt.DeleteIfExists("mangle", chain, spec...)
+}
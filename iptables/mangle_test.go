@@ -0,0 +1,121 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables
+
+import "testing"
+
+func TestMangleRulespec(t *testing.T) {
+	ipv4 := &IPTables{proto: ProtocolIPv4}
+	ipv6 := &IPTables{proto: ProtocolIPv6}
+	tcp := func() *Rule { return NewRule().Protocol("tcp").DPort(80) }
+
+	testCases := []struct {
+		name    string
+		ipt     *IPTables
+		chain   string
+		match   *Rule
+		target  MangleTarget
+		args    string
+		wantErr bool
+	}{
+		{
+			name:   "tproxy",
+			ipt:    ipv4,
+			chain:  "PREROUTING",
+			match:  tcp(),
+			target: TProxy{Port: 15001, Mark: 0x1, Mask: 0x1},
+			args:   "-p tcp -m tcp --dport 80 -j TPROXY --on-port 15001 --on-ip 0.0.0.0 --tproxy-mark 0x1/0x1",
+		},
+		{
+			name:   "tproxy ipv6 with address",
+			ipt:    ipv6,
+			chain:  "PREROUTING",
+			match:  NewRule().Protocol("udp"),
+			target: TProxy{Port: 53, Address: "::1", Mark: 0x100},
+			args:   "-p udp -j TPROXY --on-port 53 --on-ip ::1 --tproxy-mark 0x100/0xffffffff",
+		},
+		{
+			name:   "tproxy without mark",
+			ipt:    ipv6,
+			chain:  "PREROUTING",
+			match:  tcp(),
+			target: TProxy{Port: 8080},
+			args:   "-p tcp -m tcp --dport 80 -j TPROXY --on-port 8080 --on-ip :: --tproxy-mark 0x0/0x0",
+		},
+		{
+			name:   "mark",
+			ipt:    ipv4,
+			chain:  "OUTPUT",
+			match:  NewRule().Socket(Socket{Transparent: true, NoWildcard: true}),
+			target: Mark{Value: 0x1},
+			args:   "-m socket --transparent --nowildcard -j MARK --set-xmark 0x1/0xffffffff",
+		},
+		{
+			name:   "mark with mask",
+			ipt:    ipv4,
+			chain:  "FORWARD",
+			target: Mark{Value: 0x10, Mask: 0xf0},
+			args:   "-j MARK --set-xmark 0x10/0xf0",
+		},
+		{
+			name:   "connmark set",
+			ipt:    ipv4,
+			chain:  "PREROUTING",
+			target: Connmark{Mode: ConnmarkSet, Value: 0x2, Mask: 0x2},
+			args:   "-j CONNMARK --set-xmark 0x2/0x2",
+		},
+		{
+			name:   "connmark save",
+			ipt:    ipv4,
+			chain:  "POSTROUTING",
+			target: Connmark{Mode: ConnmarkSave},
+			args:   "-j CONNMARK --save-mark --nfmask 0xffffffff --ctmask 0xffffffff",
+		},
+		{
+			name:   "connmark restore",
+			ipt:    ipv6,
+			chain:  "PREROUTING",
+			target: Connmark{Mode: ConnmarkRestore, Mask: 0xff},
+			args:   "-j CONNMARK --restore-mark --nfmask 0xff --ctmask 0xff",
+		},
+		{name: "tproxy in output", ipt: ipv4, chain: "OUTPUT", match: tcp(), target: TProxy{Port: 1}, wantErr: true},
+		{name: "tproxy without protocol", ipt: ipv4, chain: "PREROUTING", target: TProxy{Port: 1}, wantErr: true},
+		{name: "tproxy with icmp", ipt: ipv4, chain: "PREROUTING", match: NewRule().Protocol("icmp"), target: TProxy{Port: 1}, wantErr: true},
+		{name: "tproxy invalid port", ipt: ipv4, chain: "PREROUTING", match: tcp(), target: TProxy{}, wantErr: true},
+		{name: "tproxy wrong family", ipt: ipv4, chain: "PREROUTING", match: tcp(), target: TProxy{Port: 1, Address: "::1"}, wantErr: true},
+		{name: "connmark unknown mode", ipt: ipv4, chain: "PREROUTING", target: Connmark{}, wantErr: true},
+		{name: "connmark save with value", ipt: ipv4, chain: "PREROUTING", target: Connmark{Mode: ConnmarkSave, Value: 1}, wantErr: true},
+		{name: "wrong match family", ipt: ipv6, chain: "PREROUTING", match: NewRule().Source("10.0.0.1"), target: Mark{Value: 1}, wantErr: true},
+		{name: "match with target", ipt: ipv4, chain: "PREROUTING", match: NewRule().Jump("ACCEPT"), target: Mark{Value: 1}, wantErr: true},
+		{name: "owner in prerouting", ipt: ipv4, chain: "PREROUTING", match: NewRule().SocketOwner(SocketOwner{UID: "1000"}), target: Mark{Value: 1}, wantErr: true},
+	}
+
+	for _, tt := range testCases {
+		t.Run(tt.name, func(t *testing.T) {
+			args, err := tt.ipt.MangleRulespec(tt.chain, tt.match, tt.target)
+			if err == nil && tt.wantErr {
+				t.Fatalf("expected err, got %q", args)
+			} else if err != nil && !tt.wantErr {
+				t.Fatalf("unexpected err %s", err)
+			}
+			if tt.wantErr {
+				return
+			}
+			if got := joinRulespec(args); got != tt.args {
+				t.Fatalf("MangleRulespec mismatch: \ngot  %s \nneed %s", got, tt.args)
+			}
+		})
+	}
+}
@@ -0,0 +1,264 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// NATTarget is a target of the nat table: DNAT, SNAT, Masquerade or
+// Redirect.
+type NATTarget interface {
+	// args returns the target arguments for the family of ipt.
+	args(ipt *IPTables) ([]string, error)
+	// chains returns the built-in chains the target is valid in.
+	chains() []string
+	// hasPorts returns true if the target maps ports, which requires the
+	// rule to match a protocol with ports.
+	hasPorts() bool
+}
+
+// DNAT rewrites the destination address, and optionally port, of packets.
+type DNAT struct {
+	// Address is the new destination address, or range of addresses
+	// ("10.0.0.1-10.0.0.5").
+	Address string
+	// Ports is the new destination port or range of ports. It is unused if
+	// zero.
+	Ports PortRange
+	// Random randomizes the port mapping.
+	Random bool
+	// Persistent gives a client the same address for each connection.
+	Persistent bool
+}
+
+func (t DNAT) args(ipt *IPTables) ([]string, error) {
+	to, err := natAddress(ipt, t.Address, t.Ports)
+	if err != nil {
+		return nil, err
+	}
+	args := []string{"-j", "DNAT", "--to-destination", to}
+	args = appendFlag(args, t.Random, "--random")
+	return appendFlag(args, t.Persistent, "--persistent"), nil
+}
+
+func (t DNAT) chains() []string { return []string{"PREROUTING", "OUTPUT"} }
+func (t DNAT) hasPorts() bool   { return t.Ports != PortRange{} }
+
+// SNAT rewrites the source address, and optionally port, of packets.
+type SNAT struct {
+	// Address is the new source address, or range of addresses.
+	Address string
+	// Ports is the new source port or range of ports. It is unused if zero.
+	Ports PortRange
+	// Random randomizes the port mapping.
+	Random bool
+	// RandomFully fully randomizes the port mapping. It requires iptables
+	// 1.6.2 or later, see HasRandomFully.
+	RandomFully bool
+	// Persistent gives a client the same address for each connection.
+	Persistent bool
+}
+
+func (t SNAT) args(ipt *IPTables) ([]string, error) {
+	to, err := natAddress(ipt, t.Address, t.Ports)
+	if err != nil {
+		return nil, err
+	}
+	if t.RandomFully && !ipt.HasRandomFully() {
+		return nil, fmt.Errorf("--random-fully is not supported by this iptables version")
+	}
+	args := []string{"-j", "SNAT", "--to-source", to}
+	args = appendFlag(args, t.Random, "--random")
+	args = appendFlag(args, t.RandomFully, "--random-fully")
+	return appendFlag(args, t.Persistent, "--persistent"), nil
+}
+
+func (t SNAT) chains() []string { return []string{"POSTROUTING", "INPUT"} }
+func (t SNAT) hasPorts() bool   { return t.Ports != PortRange{} }
+
+// Masquerade rewrites the source address of packets to the address of the
+// outgoing interface.
+type Masquerade struct {
+	// Ports is the source port or range of ports used. It is unused if zero.
+	Ports PortRange
+	// Random randomizes the port mapping.
+	Random bool
+	// RandomFully fully randomizes the port mapping. It requires iptables
+	// 1.6.2 or later, see HasRandomFully.
+	RandomFully bool
+}
+
+func (t Masquerade) args(ipt *IPTables) ([]string, error) {
+	args := []string{"-j", "MASQUERADE"}
+	if t.hasPorts() {
+		ports, err := natPorts(t.Ports)
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, "--to-ports", ports)
+	}
+	if t.RandomFully && !ipt.HasRandomFully() {
+		return nil, fmt.Errorf("--random-fully is not supported by this iptables version")
+	}
+	args = appendFlag(args, t.Random, "--random")
+	return appendFlag(args, t.RandomFully, "--random-fully"), nil
+}
+
+func (t Masquerade) chains() []string { return []string{"POSTROUTING"} }
+func (t Masquerade) hasPorts() bool   { return t.Ports != PortRange{} }
+
+// Redirect redirects packets to the local machine, optionally to another
+// port.
+type Redirect struct {
+	// Ports is the destination port or range of ports. It is unused if
+	// zero.
+	Ports PortRange
+	// Random randomizes the port mapping.
+	Random bool
+}
+
+func (t Redirect) args(ipt *IPTables) ([]string, error) {
+	args := []string{"-j", "REDIRECT"}
+	if t.hasPorts() {
+		ports, err := natPorts(t.Ports)
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, "--to-ports", ports)
+	}
+	return appendFlag(args, t.Random, "--random"), nil
+}
+
+func (t Redirect) chains() []string { return []string{"PREROUTING", "OUTPUT"} }
+func (t Redirect) hasPorts() bool   { return t.Ports != PortRange{} }
+
+func appendFlag(args []string, set bool, flag string) []string {
+	if set {
+		return append(args, flag)
+	}
+	return args
+}
+
+// natPorts formats a port range the way NAT targets list it, e.g. "80" or
+// "8000-8010".
+func natPorts(ports PortRange) (string, error) {
+	if ports.Invert || ports.First == 0 || ports.Last < ports.First {
+		return "", fmt.Errorf("invalid NAT port range %d-%d", ports.First, ports.Last)
+	}
+	s := strconv.Itoa(int(ports.First))
+	if ports.Last != ports.First {
+		s += "-" + strconv.Itoa(int(ports.Last))
+	}
+	return s, nil
+}
+
+// natAddress formats the address, or range of addresses, and ports of a
+// DNAT or SNAT target for the family of ipt. IPv6 addresses are enclosed in
+// brackets when followed by ports.
+func natAddress(ipt *IPTables, address string, ports PortRange) (string, error) {
+	if address == "" {
+		return "", fmt.Errorf("empty NAT address")
+	}
+	parts := strings.SplitN(address, "-", 2)
+	for i, part := range parts {
+		ip := net.ParseIP(part)
+		if ip == nil {
+			return "", fmt.Errorf("invalid NAT address %q", address)
+		}
+		if (ip.To4() == nil) != (ipt.proto == ProtocolIPv6) {
+			return "", fmt.Errorf("NAT address %s doesn't match the family of %s", part, getIptablesCommand(ipt.proto))
+		}
+		parts[i] = ip.String()
+	}
+	to := strings.Join(parts, "-")
+
+	if ports == (PortRange{}) {
+		return to, nil
+	}
+	p, err := natPorts(ports)
+	if err != nil {
+		return "", err
+	}
+	if ipt.proto == ProtocolIPv6 {
+		to = "[" + to + "]"
+	}
+	return to + ":" + p, nil
+}
+
+// NATRulespec returns the rulespec of a rule of the nat table's chain
+// applying target to the packets matched by match, which may be nil. It
+// checks that the target and the matches are valid in chain, and that a
+// protocol with ports is matched if the target maps ports.
+func (ipt *IPTables) NATRulespec(chain string, match *Rule, target NATTarget) ([]string, error) {
+	if isBuiltinChain(chain) {
+		valid := false
+		for _, c := range target.chains() {
+			valid = valid || c == chain
+		}
+		if !valid {
+			return nil, fmt.Errorf("%T is not valid in chain %s, only in %s", target, chain, strings.Join(target.chains(), ", "))
+		}
+	}
+
+	if match == nil {
+		match = NewRule()
+	}
+	if match.target != nil {
+		return nil, fmt.Errorf("NAT match already has a target")
+	}
+	args, err := match.Args()
+	if err != nil {
+		return nil, err
+	}
+	if err := match.CheckChain(chain); err != nil {
+		return nil, err
+	}
+	if err := ipt.checkRuleFamily(match); err != nil {
+		return nil, err
+	}
+	if target.hasPorts() && (match.protocol == nil || match.protocol.invert || !portProtocols[match.protocol.value]) {
+		return nil, fmt.Errorf("NAT ports require protocol tcp, udp, udplite, sctp or dccp")
+	}
+
+	targetArgs, err := target.args(ipt)
+	if err != nil {
+		return nil, err
+	}
+	return append(args, targetArgs...), nil
+}
+
+// EnsureNAT appends the rule built by NATRulespec to chain of the nat table,
+// unless it already exists.
+func (ipt *IPTables) EnsureNAT(chain string, match *Rule, target NATTarget) error {
+	spec, err := ipt.NATRulespec(chain, match, target)
+	if err != nil {
+		return err
+	}
+	return ipt.AppendUnique("nat", chain, spec...)
+}
+
+// DeleteNAT deletes the rule built by NATRulespec from chain of the nat
+// table, if it exists.
+func (ipt *IPTables) DeleteNAT(chain string, match *Rule, target NATTarget) error {
+	spec, err := ipt.NATRulespec(chain, match, target)
+	if err != nil {
+		return err
+	}
+	return ipt.DeleteIfExists("nat", chain, spec...)
+}
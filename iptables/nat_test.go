@@ -0,0 +1,177 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+func TestNATRulespec(t *testing.T) {
+	ipv4 := &IPTables{proto: ProtocolIPv4, hasRandomFully: true}
+	ipv6 := &IPTables{proto: ProtocolIPv6, hasRandomFully: true}
+	old := &IPTables{proto: ProtocolIPv4}
+	tcp := func() *Rule { return NewRule().Protocol("tcp").DPort(8080) }
+
+	testCases := []struct {
+		name    string
+		ipt     *IPTables
+		chain   string
+		match   *Rule
+		target  NATTarget
+		args    string
+		wantErr bool
+	}{
+		{
+			name:   "dnat ipv4",
+			ipt:    ipv4,
+			chain:  "PREROUTING",
+			match:  tcp(),
+			target: DNAT{Address: "10.0.0.1", Ports: PortRange{First: 80, Last: 80}},
+			args:   "-p tcp -m tcp --dport 8080 -j DNAT --to-destination 10.0.0.1:80",
+		},
+		{
+			name:   "dnat ipv6",
+			ipt:    ipv6,
+			chain:  "PREROUTING",
+			match:  tcp(),
+			target: DNAT{Address: "2001:db8:0::1", Ports: PortRange{First: 80, Last: 90}, Random: true, Persistent: true},
+			args:   "-p tcp -m tcp --dport 8080 -j DNAT --to-destination [2001:db8::1]:80-90 --random --persistent",
+		},
+		{
+			name:   "dnat ipv6 without ports",
+			ipt:    ipv6,
+			chain:  "OUTPUT",
+			target: DNAT{Address: "2001:db8::1-2001:db8::5"},
+			args:   "-j DNAT --to-destination 2001:db8::1-2001:db8::5",
+		},
+		{
+			name:   "snat",
+			ipt:    ipv4,
+			chain:  "POSTROUTING",
+			match:  NewRule().Source("192.168.0.0/16").OutInterface("eth0"),
+			target: SNAT{Address: "203.0.113.1-203.0.113.9", RandomFully: true},
+			args:   "-s 192.168.0.0/16 -o eth0 -j SNAT --to-source 203.0.113.1-203.0.113.9 --random-fully",
+		},
+		{
+			name:   "masquerade",
+			ipt:    ipv4,
+			chain:  "POSTROUTING",
+			match:  NewRule().Protocol("udp"),
+			target: Masquerade{Ports: PortRange{First: 1024, Last: 65535}, Random: true},
+			args:   "-p udp -j MASQUERADE --to-ports 1024-65535 --random",
+		},
+		{
+			name:   "redirect",
+			ipt:    ipv6,
+			chain:  "PREROUTING",
+			match:  tcp(),
+			target: Redirect{Ports: PortRange{First: 3128, Last: 3128}},
+			args:   "-p tcp -m tcp --dport 8080 -j REDIRECT --to-ports 3128",
+		},
+		{
+			name:   "user-defined chain",
+			ipt:    ipv4,
+			chain:  "MY-DNAT",
+			target: DNAT{Address: "10.0.0.1"},
+			args:   "-j DNAT --to-destination 10.0.0.1",
+		},
+		{name: "dnat in postrouting", ipt: ipv4, chain: "POSTROUTING", target: DNAT{Address: "10.0.0.1"}, wantErr: true},
+		{name: "masquerade in input", ipt: ipv4, chain: "INPUT", target: Masquerade{}, wantErr: true},
+		{name: "wrong family", ipt: ipv4, chain: "PREROUTING", target: DNAT{Address: "::1"}, wantErr: true},
+		{name: "wrong match family", ipt: ipv6, chain: "PREROUTING", match: NewRule().Source("10.0.0.1"), target: DNAT{Address: "::1"}, wantErr: true},
+		{name: "invalid address", ipt: ipv4, chain: "PREROUTING", target: DNAT{Address: "10.0.0"}, wantErr: true},
+		{name: "missing address", ipt: ipv4, chain: "PREROUTING", target: DNAT{}, wantErr: true},
+		{name: "ports without protocol", ipt: ipv4, chain: "PREROUTING", target: DNAT{Address: "10.0.0.1", Ports: PortRange{First: 80, Last: 80}}, wantErr: true},
+		{name: "reversed ports", ipt: ipv4, chain: "OUTPUT", match: tcp(), target: Redirect{Ports: PortRange{First: 90, Last: 80}}, wantErr: true},
+		{name: "random-fully unsupported", ipt: old, chain: "POSTROUTING", target: Masquerade{RandomFully: true}, wantErr: true},
+		{name: "match with target", ipt: ipv4, chain: "OUTPUT", match: NewRule().Jump("ACCEPT"), target: Redirect{}, wantErr: true},
+		{name: "owner in prerouting", ipt: ipv4, chain: "PREROUTING", match: NewRule().SocketOwner(SocketOwner{UID: "1000"}), target: DNAT{Address: "10.0.0.1"}, wantErr: true},
+		{name: "cgroup in prerouting", ipt: ipv4, chain: "PREROUTING", match: NewRule().Cgroup("user.slice"), target: DNAT{Address: "10.0.0.1"}, wantErr: true},
+	}
+
+	for _, tt := range testCases {
+		t.Run(tt.name, func(t *testing.T) {
+			args, err := tt.ipt.NATRulespec(tt.chain, tt.match, tt.target)
+			if err == nil && tt.wantErr {
+				t.Fatalf("expected err, got %q", args)
+			} else if err != nil && !tt.wantErr {
+				t.Fatalf("unexpected err %s", err)
+			}
+			if tt.wantErr {
+				return
+			}
+			if got := joinRulespec(args); got != tt.args {
+				t.Fatalf("NATRulespec mismatch: \ngot  %s \nneed %s", got, tt.args)
+			}
+		})
+	}
+}
+
+func TestEnsureNAT(t *testing.T) {
+	for i, ipt := range mustTestableIptables() {
+		t.Run(fmt.Sprint(i), func(t *testing.T) {
+			runEnsureNATTests(t, ipt)
+		})
+	}
+}
+
+func runEnsureNATTests(t *testing.T, ipt *IPTables) {
+	chain := randChain(t)
+	if err := ipt.NewChain("nat", chain); err != nil {
+		t.Fatalf("NewChain failed: %v", err)
+	}
+	defer func() {
+		if err := ipt.ClearAndDeleteChain("nat", chain); err != nil {
+			t.Fatalf("ClearAndDeleteChain failed: %v", err)
+		}
+	}()
+
+	address := "10.0.0.1"
+	if ipt.Proto() == ProtocolIPv6 {
+		address = "2001:db8::1"
+	}
+	match := NewRule().Protocol("tcp").DPort(8080)
+	target := DNAT{Address: address, Ports: PortRange{First: 80, Last: 80}}
+
+	// ensuring twice adds a single rule, listed as built
+	for i := 0; i < 2; i++ {
+		if err := ipt.EnsureNAT(chain, match, target); err != nil {
+			t.Fatalf("EnsureNAT failed: %v", err)
+		}
+	}
+	spec, err := ipt.NATRulespec(chain, match, target)
+	if err != nil {
+		t.Fatalf("NATRulespec failed: %v", err)
+	}
+	state, err := ipt.chainState("nat", chain)
+	if err != nil {
+		t.Fatalf("chainState failed: %v", err)
+	}
+	if !reflect.DeepEqual(state.rules, [][]string{spec}) {
+		t.Fatalf("listed rules mismatch: \ngot  %q \nneed %q", state.rules, [][]string{spec})
+	}
+
+	if err := ipt.DeleteNAT(chain, match, target); err != nil {
+		t.Fatalf("DeleteNAT failed: %v", err)
+	}
+	if state, err = ipt.chainState("nat", chain); err != nil {
+		t.Fatalf("chainState failed: %v", err)
+	}
+	if len(state.rules) != 0 {
+		t.Fatalf("DeleteNAT left rules: %q", state.rules)
+	}
+}
@@ -0,0 +1,233 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// PortRange is an inclusive range of ports. A single port has First equal
+// to Last.
+type PortRange struct {
+	First  uint16 `json:"first"`
+	Last   uint16 `json:"last"`
+	Invert bool   `json:"invert,omitempty"`
+}
+
+// String returns the range as listed by iptables, e.g. "80" or "1000:2000".
+func (r PortRange) String() string {
+	s := strconv.Itoa(int(r.First))
+	if r.Last != r.First {
+		s += ":" + strconv.Itoa(int(r.Last))
+	}
+	if r.Invert {
+		s = "!" + s
+	}
+	return s
+}
+
+// StatLimit holds the parameters of a limit match.
+type StatLimit struct {
+	// Rate is the average rate, e.g. "3/min".
+	Rate  string `json:"rate"`
+	Burst int    `json:"burst"`
+}
+
+// StatOptions holds the match and target details parsed from Stat.Options.
+type StatOptions struct {
+	SourcePorts      []PortRange `json:"sports,omitempty"`
+	DestinationPorts []PortRange `json:"dports,omitempty"`
+	// States lists the conntrack states matched by a state or conntrack
+	// match, e.g. {"RELATED", "ESTABLISHED"}.
+	States       []string   `json:"states,omitempty"`
+	InvertStates bool       `json:"invert_states,omitempty"`
+	Comment      string     `json:"comment,omitempty"`
+	Limit        *StatLimit `json:"limit,omitempty"`
+
+	// ToDestination is the "to:" address of a DNAT target, e.g.
+	// "10.0.0.1:80" or "[2001:db8::1]:80".
+	ToDestination string `json:"to_destination,omitempty"`
+	// ToSource is the "to:" address of a SNAT target.
+	ToSource string `json:"to_source,omitempty"`
+	// ToPorts are the ports of a MASQUERADE or REDIRECT target.
+	ToPorts     string `json:"to_ports,omitempty"`
+	Random      bool   `json:"random,omitempty"`
+	RandomFully bool   `json:"random_fully,omitempty"`
+	Persistent  bool   `json:"persistent,omitempty"`
+	RejectWith  string `json:"reject_with,omitempty"`
+
+	// Unparsed holds the words that were not recognized.
+	Unparsed []string `json:"unparsed,omitempty"`
+}
+
+// ParsedOptions parses the Options field of the statistic.
+func (s Stat) ParsedOptions() StatOptions {
+	return ParseStatOptions(s.Target, s.Options)
+}
+
+// ParseStatOptions parses the options column of "iptables -L -n" output for
+// a rule with the given target. Parsing is best-effort: words that are not
+// recognized are collected in Unparsed.
+func ParseStatOptions(target, options string) StatOptions {
+	var opts StatOptions
+
+	// the comment may contain anything, extract it first
+	if start := strings.Index(options, "/* "); start >= 0 {
+		if end := strings.Index(options[start+3:], " */"); end >= 0 {
+			opts.Comment = options[start+3 : start+3+end]
+			options = options[:start] + options[start+3+end+3:]
+		}
+	}
+
+	words := strings.Fields(options)
+	invert := false
+	for i := 0; i < len(words); i++ {
+		word := words[i]
+		next := ""
+		if i+1 < len(words) {
+			next = words[i+1]
+		}
+
+		// "!" applies to the following word
+		if word == "!" {
+			invert = true
+			continue
+		}
+		inverted := invert
+		invert = false
+
+		parsed := true
+		switch {
+		case word == "tcp" || word == "udp" || word == "sctp" || word == "udplite" || word == "dccp":
+			// protocol match name, followed by its options
+		case strings.HasPrefix(word, "spt:") || strings.HasPrefix(word, "spts:"):
+			parsed = parsePortsInto(&opts.SourcePorts, word[strings.IndexByte(word, ':')+1:], false)
+		case strings.HasPrefix(word, "dpt:") || strings.HasPrefix(word, "dpts:"):
+			parsed = parsePortsInto(&opts.DestinationPorts, word[strings.IndexByte(word, ':')+1:], false)
+		case word == "multiport" && (next == "sports" || next == "dports" || next == "ports") && i+2 < len(words):
+			list := words[i+2]
+			switch next {
+			case "sports":
+				parsed = parsePortsInto(&opts.SourcePorts, list, true)
+			case "dports":
+				parsed = parsePortsInto(&opts.DestinationPorts, list, true)
+			default:
+				parsed = parsePortsInto(&opts.SourcePorts, list, true) &&
+					parsePortsInto(&opts.DestinationPorts, list, true)
+			}
+			if parsed {
+				i += 2
+			}
+		case (word == "state" || word == "ctstate") && next != "":
+			states := next
+			if strings.HasPrefix(states, "!") {
+				inverted = true
+				states = states[1:]
+			}
+			opts.States = strings.Split(states, ",")
+			opts.InvertStates = inverted
+			i++
+		case word == "limit:" && next == "avg" && i+2 < len(words):
+			opts.Limit = &StatLimit{Rate: words[i+2]}
+			i += 2
+			if i+2 < len(words) && words[i+1] == "burst" {
+				if burst, err := strconv.Atoi(words[i+2]); err == nil {
+					opts.Limit.Burst = burst
+					i += 2
+				}
+			}
+		case strings.HasPrefix(word, "to:"):
+			if target == "SNAT" {
+				opts.ToSource = word[3:]
+			} else {
+				opts.ToDestination = word[3:]
+			}
+		case word == "masq" && next == "ports:" && i+2 < len(words):
+			opts.ToPorts = words[i+2]
+			i += 2
+		case word == "redir" && next == "ports" && i+2 < len(words):
+			opts.ToPorts = words[i+2]
+			i += 2
+		case word == "random":
+			opts.Random = true
+		case word == "random-fully":
+			opts.RandomFully = true
+		case word == "persistent":
+			opts.Persistent = true
+		case word == "reject-with" && next != "":
+			opts.RejectWith = next
+			i++
+		default:
+			parsed = false
+		}
+
+		if !parsed {
+			if inverted {
+				opts.Unparsed = append(opts.Unparsed, "!")
+			}
+			opts.Unparsed = append(opts.Unparsed, word)
+		}
+	}
+	return opts
+}
+
+// parsePortsInto parses a port, a port range ("1000:2000") or, if list is
+// set, a comma-separated list of them, and appends the result to ranges.
+// A leading "!" inverts every range.
+func parsePortsInto(ranges *[]PortRange, s string, list bool) bool {
+	invert := false
+	if strings.HasPrefix(s, "!") {
+		invert = true
+		s = s[1:]
+	}
+
+	items := []string{s}
+	if list {
+		items = strings.Split(s, ",")
+	}
+
+	var parsed []PortRange
+	for _, item := range items {
+		r, err := parsePortRange(item)
+		if err != nil {
+			return false
+		}
+		r.Invert = invert
+		parsed = append(parsed, r)
+	}
+	*ranges = append(*ranges, parsed...)
+	return true
+}
+
+// parsePortRange parses "80" or "1000:2000".
+func parsePortRange(s string) (PortRange, error) {
+	parts := strings.SplitN(s, ":", 2)
+	first, err := strconv.ParseUint(parts[0], 10, 16)
+	if err != nil {
+		return PortRange{}, fmt.Errorf("invalid port %q", parts[0])
+	}
+	last := first
+	if len(parts) == 2 {
+		if last, err = strconv.ParseUint(parts[1], 10, 16); err != nil {
+			return PortRange{}, fmt.Errorf("invalid port %q", parts[1])
+		}
+	}
+	if last < first {
+		return PortRange{}, fmt.Errorf("invalid port range %q", s)
+	}
+	return PortRange{First: uint16(first), Last: uint16(last)}, nil
+}
@@ -0,0 +1,113 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseStatOptions(t *testing.T) {
+	testCases := []struct {
+		target  string
+		options string
+		out     StatOptions
+	}{
+		{
+			"ACCEPT",
+			"tcp dpt:22 state NEW /* ssh */ limit: avg 3/min burst 5",
+			StatOptions{
+				DestinationPorts: []PortRange{{First: 22, Last: 22}},
+				States:           []string{"NEW"},
+				Comment:          "ssh",
+				Limit:            &StatLimit{Rate: "3/min", Burst: 5},
+			},
+		},
+		{
+			"REJECT",
+			"udp spts:1000:2000 dpt:!53 reject-with icmp-port-unreachable",
+			StatOptions{
+				SourcePorts:      []PortRange{{First: 1000, Last: 2000}},
+				DestinationPorts: []PortRange{{First: 53, Last: 53, Invert: true}},
+				RejectWith:       "icmp-port-unreachable",
+			},
+		},
+		{
+			"ACCEPT",
+			"multiport dports 80,443,8000:8080 ! ctstate INVALID",
+			StatOptions{
+				DestinationPorts: []PortRange{{First: 80, Last: 80}, {First: 443, Last: 443}, {First: 8000, Last: 8080}},
+				States:           []string{"INVALID"},
+				InvertStates:     true,
+			},
+		},
+		{
+			"DNAT",
+			"/* kube-system/kube-dns:dns */ udp to:10.244.0.2:53",
+			StatOptions{Comment: "kube-system/kube-dns:dns", ToDestination: "10.244.0.2:53"},
+		},
+		{
+			"DNAT",
+			"tcp dpt:80 to:[2001:db8::1]:8080 random persistent",
+			StatOptions{
+				DestinationPorts: []PortRange{{First: 80, Last: 80}},
+				ToDestination:    "[2001:db8::1]:8080",
+				Random:           true,
+				Persistent:       true,
+			},
+		},
+		{
+			"SNAT",
+			"tcp to:203.0.113.1:1024-65535 random-fully",
+			StatOptions{ToSource: "203.0.113.1:1024-65535", RandomFully: true},
+		},
+		{
+			"MASQUERADE",
+			"masq ports: 1024-65535",
+			StatOptions{ToPorts: "1024-65535"},
+		},
+		{
+			"REDIRECT",
+			"tcp dpt:80 redir ports 3128",
+			StatOptions{DestinationPorts: []PortRange{{First: 80, Last: 80}}, ToPorts: "3128"},
+		},
+		{
+			"ACCEPT",
+			"ADDRTYPE match dst-type LOCAL",
+			StatOptions{Unparsed: []string{"ADDRTYPE", "match", "dst-type", "LOCAL"}},
+		},
+	}
+
+	for _, tt := range testCases {
+		t.Run(tt.options, func(t *testing.T) {
+			opts := Stat{Target: tt.target, Options: tt.options}.ParsedOptions()
+			if !reflect.DeepEqual(opts, tt.out) {
+				t.Fatalf("ParseStatOptions mismatch: \ngot  %#v \nneed %#v", opts, tt.out)
+			}
+		})
+	}
+}
+
+func TestPortRangeString(t *testing.T) {
+	for in, out := range map[PortRange]string{
+		{First: 22, Last: 22}:               "22",
+		{First: 1000, Last: 2000}:           "1000:2000",
+		{First: 53, Last: 53, Invert: true}: "!53",
+	} {
+		if s := in.String(); s != out {
+			t.Fatalf("expected %s, got %s", out, s)
+		}
+	}
+}
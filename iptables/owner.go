@@ -0,0 +1,201 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables
+
+import (
+	"fmt"
+	"strings"
+)
+
+// maxCommentLen is the maximum length of a comment match, see
+// XT_MAX_COMMENT_LEN in the kernel (256 including the terminating NUL)
+const maxCommentLen = 255
+
+// OwnerScope manipulates rules on behalf of a single owner. Every rule added
+// through it is tagged with a comment match of the form "<owner>:<id>", so
+// that rules of different owners can share a chain.
+type OwnerScope struct {
+	ipt   *IPTables
+	owner string
+}
+
+// Owner returns an OwnerScope for the given owner name. The name must not be
+// empty or contain a colon.
+func (ipt *IPTables) Owner(name string) *OwnerScope {
+	return &OwnerScope{ipt: ipt, owner: name}
+}
+
+// Name returns the name of the owner.
+func (o *OwnerScope) Name() string {
+	return o.owner
+}
+
+// Rulespec returns rulespec tagged with the owner and id.
+func (o *OwnerScope) Rulespec(id string, rulespec ...string) ([]string, error) {
+	if o.owner == "" || strings.Contains(o.owner, ":") {
+		return nil, fmt.Errorf("invalid owner name %q", o.owner)
+	}
+	if id == "" {
+		return nil, fmt.Errorf("empty rule id for owner %s", o.owner)
+	}
+	tag := o.owner + ":" + id
+	if len(tag) > maxCommentLen {
+		return nil, fmt.Errorf("owner tag %q exceeds %d characters", tag, maxCommentLen)
+	}
+
+	return withComment(rulespec, tag), nil
+}
+
+// withComment returns a copy of rulespec with a comment match added in front
+// of the target, where "iptables -S" lists it.
+func withComment(rulespec []string, comment string) []string {
+	pos := len(rulespec)
+	for i, arg := range rulespec {
+		if arg == "-j" || arg == "-g" || arg == "--jump" || arg == "--goto" {
+			pos = i
+			break
+		}
+	}
+	spec := make([]string, 0, len(rulespec)+4)
+	spec = append(spec, rulespec[:pos]...)
+	spec = append(spec, "-m", "comment", "--comment", comment)
+	return append(spec, rulespec[pos:]...)
+}
+
+// Exists checks if the rule with the given id exists in table/chain
+func (o *OwnerScope) Exists(table, chain, id string, rulespec ...string) (bool, error) {
+	spec, err := o.Rulespec(id, rulespec...)
+	if err != nil {
+		return false, err
+	}
+	return o.ipt.Exists(table, chain, spec...)
+}
+
+// Append appends the rule with the given id to table/chain
+func (o *OwnerScope) Append(table, chain, id string, rulespec ...string) error {
+	spec, err := o.Rulespec(id, rulespec...)
+	if err != nil {
+		return err
+	}
+	return o.ipt.Append(table, chain, spec...)
+}
+
+// AppendUnique acts like Append except that it won't add a duplicate
+func (o *OwnerScope) AppendUnique(table, chain, id string, rulespec ...string) error {
+	spec, err := o.Rulespec(id, rulespec...)
+	if err != nil {
+		return err
+	}
+	return o.ipt.AppendUnique(table, chain, spec...)
+}
+
+// Insert inserts the rule with the given id to table/chain (in specified pos)
+func (o *OwnerScope) Insert(table, chain string, pos int, id string, rulespec ...string) error {
+	spec, err := o.Rulespec(id, rulespec...)
+	if err != nil {
+		return err
+	}
+	return o.ipt.Insert(table, chain, pos, spec...)
+}
+
+// InsertUnique acts like Insert except that it won't insert a duplicate
+func (o *OwnerScope) InsertUnique(table, chain string, pos int, id string, rulespec ...string) error {
+	spec, err := o.Rulespec(id, rulespec...)
+	if err != nil {
+		return err
+	}
+	return o.ipt.InsertUnique(table, chain, pos, spec...)
+}
+
+// Delete removes the rule with the given id in table/chain
+func (o *OwnerScope) Delete(table, chain, id string, rulespec ...string) error {
+	spec, err := o.Rulespec(id, rulespec...)
+	if err != nil {
+		return err
+	}
+	return o.ipt.Delete(table, chain, spec...)
+}
+
+// DeleteIfExists acts like Delete except that it doesn't fail if the rule
+// doesn't exist
+func (o *OwnerScope) DeleteIfExists(table, chain, id string, rulespec ...string) error {
+	spec, err := o.Rulespec(id, rulespec...)
+	if err != nil {
+		return err
+	}
+	return o.ipt.DeleteIfExists(table, chain, spec...)
+}
+
+// GarbageCollect removes all rules of the owner whose id is not in keep.
+// See IPTables.GarbageCollect.
+func (o *OwnerScope) GarbageCollect(keep []string) (int, error) {
+	return o.ipt.GarbageCollect(o.owner, keep)
+}
+
+// GarbageCollect removes, from all tables, the rules tagged with owner whose
+// id is not in keep. Rules of other owners and untagged rules are left
+// untouched. All removals are done in a single iptables-restore transaction.
+// It returns the number of rules removed.
+func (ipt *IPTables) GarbageCollect(owner string, keep []string) (int, error) {
+	keepSet := make(map[string]bool, len(keep))
+	for _, id := range keep {
+		keepSet[id] = true
+	}
+
+	lines, err := ipt.save("")
+	if err != nil {
+		return 0, err
+	}
+
+	var ops []Operation
+	table := ""
+	for _, line := range lines {
+		switch {
+		case strings.HasPrefix(line, "*"):
+			table = line[1:]
+		case strings.HasPrefix(line, "-A "):
+			args, err := splitRulespec(line)
+			if err != nil {
+				return 0, err
+			}
+			o, id, ok := ruleOwner(args)
+			if !ok || o != owner || keepSet[id] {
+				continue
+			}
+			ops = append(ops, Operation{Kind: opDeleteRuleSpec, Table: table, Chain: args[1], Rulespec: args[2:]})
+		}
+	}
+
+	if len(ops) == 0 {
+		return 0, nil
+	}
+	if err := ipt.restore(restoreScript(ops), false); err != nil {
+		return 0, err
+	}
+	return len(ops), nil
+}
+
+// ruleOwner returns the owner and id of a rule tagged by an OwnerScope.
+func ruleOwner(rulespec []string) (string, string, bool) {
+	for i := 0; i+1 < len(rulespec); i++ {
+		if rulespec[i] != "--comment" {
+			continue
+		}
+		if parts := strings.SplitN(rulespec[i+1], ":", 2); len(parts) == 2 && parts[0] != "" && parts[1] != "" {
+			return parts[0], parts[1], true
+		}
+	}
+	return "", "", false
+}
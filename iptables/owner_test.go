@@ -0,0 +1,105 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+func TestOwnerRulespec(t *testing.T) {
+	o := (&IPTables{}).Owner("app")
+
+	spec, err := o.Rulespec("ssh", "-p", "tcp", "--dport", "22", "-j", "ACCEPT")
+	if err != nil {
+		t.Fatalf("Rulespec failed: %v", err)
+	}
+	expected := []string{"-p", "tcp", "--dport", "22", "-m", "comment", "--comment", "app:ssh", "-j", "ACCEPT"}
+	if !reflect.DeepEqual(spec, expected) {
+		t.Fatalf("Rulespec mismatch: \ngot  %#v \nneed %#v", spec, expected)
+	}
+
+	owner, id, ok := ruleOwner(spec)
+	if !ok || owner != "app" || id != "ssh" {
+		t.Fatalf("ruleOwner returned %q %q %t", owner, id, ok)
+	}
+
+	if _, err := (&IPTables{}).Owner("a:b").Rulespec("x"); err == nil {
+		t.Fatal("expected error for owner containing a colon")
+	}
+	if _, err := o.Rulespec(""); err == nil {
+		t.Fatal("expected error for empty id")
+	}
+}
+
+func TestGarbageCollect(t *testing.T) {
+	for i, ipt := range mustTestableIptables() {
+		t.Run(fmt.Sprint(i), func(t *testing.T) {
+			runGarbageCollectTests(t, ipt)
+		})
+	}
+}
+
+func runGarbageCollectTests(t *testing.T, ipt *IPTables) {
+	chain := randChain(t)
+	if err := ipt.NewChain("filter", chain); err != nil {
+		t.Fatalf("NewChain failed: %v", err)
+	}
+	defer func() {
+		if err := ipt.ClearAndDeleteChain("filter", chain); err != nil {
+			t.Fatalf("ClearAndDeleteChain failed: %v", err)
+		}
+	}()
+
+	a := ipt.Owner(chain + "-a")
+	b := ipt.Owner(chain + "-b")
+	for _, id := range []string{"1", "2", "3"} {
+		if err := a.Append("filter", chain, id, "-p", "tcp", "-j", "ACCEPT"); err != nil {
+			t.Fatalf("Append failed: %v", err)
+		}
+		if err := b.Append("filter", chain, id, "-p", "tcp", "-j", "ACCEPT"); err != nil {
+			t.Fatalf("Append failed: %v", err)
+		}
+	}
+	if err := ipt.Append("filter", chain, "-p", "udp", "-j", "ACCEPT"); err != nil {
+		t.Fatalf("Append failed: %v", err)
+	}
+
+	removed, err := a.GarbageCollect([]string{"2"})
+	if err != nil {
+		t.Fatalf("GarbageCollect failed: %v", err)
+	}
+	if removed != 2 {
+		t.Fatalf("expected 2 rules removed, got %d", removed)
+	}
+
+	rules, err := ipt.List("filter", chain)
+	if err != nil {
+		t.Fatalf("List failed: %v", err)
+	}
+	if len(rules) != 6 {
+		t.Fatalf("expected chain and 5 rules to remain, got %#v", rules)
+	}
+	for _, id := range []string{"1", "3"} {
+		exists, err := a.Exists("filter", chain, id, "-p", "tcp", "-j", "ACCEPT")
+		if err != nil {
+			t.Fatalf("Exists failed: %v", err)
+		}
+		if exists {
+			t.Fatalf("rule %s of %s was not removed", id, a.Name())
+		}
+	}
+}
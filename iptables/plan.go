@@ -0,0 +1,479 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// ErrPlanDrift is returned by Apply when the chains covered by a plan were
+// modified after the plan was computed.
+var ErrPlanDrift = errors.New("chains changed since the plan was computed")
+
+// ChainSpec describes the desired state of a single chain.
+type ChainSpec struct {
+	Table string
+	Chain string
+	// Policy is the desired policy of a built-in chain. If empty, the
+	// current policy is left untouched.
+	Policy string
+	// Rules are the desired rules of the chain, in order. Each rule is a
+	// rulespec as passed to Append. Rules are compared against the output
+	// of "iptables -S", so they should be written in the same canonical
+	// form (e.g. "-s 10.0.0.1/32" rather than "-s 10.0.0.1").
+	Rules [][]string
+}
+
+// Ruleset is the desired state of a set of chains. Chains that are not part
+// of the ruleset are never modified.
+type Ruleset []ChainSpec
+
+// OperationKind is the type of change made by an Operation.
+type OperationKind string
+
+// The kinds of the operations of a Plan.
+const (
+	OpNewChain   OperationKind = "new-chain"
+	OpSetPolicy  OperationKind = "set-policy"
+	OpDeleteRule OperationKind = "delete-rule"
+	OpInsertRule OperationKind = "insert-rule"
+	OpAppendRule OperationKind = "append-rule"
+)
+
+// The kinds of operations only used by the restore scripts of helpers such
+// as ManagedChain, DeleteChainRecursive and GarbageCollect, never by Plan.
+const (
+	opFlushChain  OperationKind = "flush-chain"
+	opDeleteChain OperationKind = "delete-chain"
+	// opDeleteRuleSpec deletes a rule by its rulespec instead of its position
+	opDeleteRuleSpec OperationKind = "delete-rule-spec"
+)
+
+// Operation is a single change to a chain.
+type Operation struct {
+	Kind  OperationKind
+	Table string
+	Chain string
+	// Position is the 1-based rule number for OpDeleteRule and OpInsertRule.
+	Position int
+	// Rulespec is the rule inserted, appended or deleted.
+	Rulespec []string
+	// Policy is the new policy for OpSetPolicy.
+	Policy string
+	// Counters, if set, are the initial counters of the rule inserted or
+	// appended, e.g. those of the rule it recreates, or the policy counters
+	// kept by OpSetPolicy.
+	Counters *Counters
+}
+
+// String returns the operation as iptables command line arguments.
+func (op Operation) String() string {
+	args := []string{"-t", op.Table}
+	switch op.Kind {
+	case OpNewChain:
+		args = append(args, "-N", op.Chain)
+	case opFlushChain:
+		args = append(args, "-F", op.Chain)
+	case opDeleteChain:
+		args = append(args, "-X", op.Chain)
+	case OpSetPolicy:
+		args = append(args, "-P", op.Chain, op.Policy)
+	case OpDeleteRule:
+		args = append(args, "-D", op.Chain, strconv.Itoa(op.Position))
+	case opDeleteRuleSpec:
+		args = append(args, "-D", op.Chain)
+		args = append(args, op.Rulespec...)
+	case OpInsertRule:
+		args = append(args, "-I", op.Chain, strconv.Itoa(op.Position))
+		args = append(args, op.counterArgs()...)
+		args = append(args, op.Rulespec...)
+	case OpAppendRule:
+		args = append(args, "-A", op.Chain)
+		args = append(args, op.counterArgs()...)
+		args = append(args, op.Rulespec...)
+	}
+	return joinRulespec(args)
+}
+
+func (op Operation) counterArgs() []string {
+	if op.Counters == nil {
+		return nil
+	}
+	return op.Counters.args()
+}
+
+// Plan is the set of operations needed to move the chains of a Ruleset from
+// their state at planning time to the desired state.
+type Plan struct {
+	Operations []Operation
+	// Script is the iptables-restore input Apply feeds to iptables-restore
+	// (with --noflush, and --counters if it declares policy counters) to
+	// perform the operations.
+	Script string
+
+	chains      []tableChain
+	fingerprint string
+	// counters is set if Script declares policy counters, which
+	// iptables-restore only applies with --counters
+	counters bool
+}
+
+type tableChain struct {
+	table, chain string
+}
+
+// Empty returns true if the plan doesn't change anything.
+func (p *Plan) Empty() bool {
+	return len(p.Operations) == 0
+}
+
+// String returns the operations of the plan, one per line.
+func (p *Plan) String() string {
+	var b strings.Builder
+	for _, op := range p.Operations {
+		b.WriteString(op.String())
+		b.WriteByte('\n')
+	}
+	return b.String()
+}
+
+// chainState is the state of a chain as listed by "iptables -v -S".
+type chainState struct {
+	exists bool
+	policy string
+	// policyCounters are the counters of the policy of a built-in chain
+	policyCounters Counters
+	// rules are the rules of the chain, without their counters
+	rules    [][]string
+	counters []Counters
+	// raw is the listing without counters, used for fingerprinting
+	raw []string
+}
+
+// Plan computes the minimal sequence of operations that turns the current
+// state of the chains in desired into the desired state.
+func (ipt *IPTables) Plan(desired Ruleset) (*Plan, error) {
+	plan := &Plan{}
+	seen := map[tableChain]bool{}
+	states := make([]*chainState, 0, len(desired))
+
+	for _, spec := range desired {
+		tc := tableChain{spec.Table, spec.Chain}
+		if seen[tc] {
+			return nil, fmt.Errorf("chain %s in table %s specified more than once", spec.Chain, spec.Table)
+		}
+		seen[tc] = true
+
+		state, err := ipt.chainState(spec.Table, spec.Chain)
+		if err != nil {
+			return nil, err
+		}
+		ops, err := planChain(spec, state)
+		if err != nil {
+			return nil, err
+		}
+		plan.Operations = append(plan.Operations, ops...)
+		plan.chains = append(plan.chains, tc)
+		states = append(states, state)
+	}
+
+	plan.Script = restoreScript(plan.Operations)
+	plan.counters = hasPolicyCounters(plan.Operations)
+	plan.fingerprint = fingerprintChains(plan.chains, states)
+	return plan, nil
+}
+
+// Apply performs the operations of plan. It fails with ErrPlanDrift if any
+// chain covered by the plan changed since the plan was computed.
+//
+// The check and the update are not a single atomic step: a change made by
+// another process between the two can still be overwritten.
+func (ipt *IPTables) Apply(plan *Plan) error {
+	states := make([]*chainState, 0, len(plan.chains))
+	for _, tc := range plan.chains {
+		state, err := ipt.chainState(tc.table, tc.chain)
+		if err != nil {
+			return err
+		}
+		states = append(states, state)
+	}
+	if fingerprintChains(plan.chains, states) != plan.fingerprint {
+		return ErrPlanDrift
+	}
+
+	if plan.Empty() {
+		return nil
+	}
+	if plan.counters {
+		return ipt.restoreWithCounters(plan.Script, false)
+	}
+	return ipt.restore(plan.Script, false)
+}
+
+// chainState lists the given chain. A missing chain is not an error.
+func (ipt *IPTables) chainState(table, chain string) (*chainState, error) {
+	lines, err := ipt.ListWithCounters(table, chain)
+	if err != nil {
+		if eerr, ok := err.(*Error); ok && eerr.IsNotExist() {
+			return &chainState{}, nil
+		}
+		return nil, err
+	}
+
+	state := &chainState{exists: true}
+	for _, line := range lines {
+		args, err := splitRulespec(line)
+		if err != nil {
+			return nil, err
+		}
+		args, counters, err := splitCounters(args)
+		if err != nil {
+			return nil, err
+		}
+		// counters change with every packet, leave them out so that
+		// traffic isn't mistaken for drift
+		state.raw = append(state.raw, joinRulespec(args))
+		switch {
+		case len(args) == 3 && args[0] == "-P":
+			state.policy = args[2]
+			state.policyCounters = counters
+		case len(args) >= 2 && args[0] == "-A":
+			state.rules = append(state.rules, args[2:])
+			state.counters = append(state.counters, counters)
+		}
+	}
+	return state, nil
+}
+
+// planChain computes the operations for a single chain. Rules that are kept
+// are never touched: rules missing from the desired state are deleted
+// (last first, so positions stay valid), then the desired rules that are
+// missing are inserted in order. A rule that is deleted and inserted again,
+// i.e. moved, keeps its counters.
+func planChain(spec ChainSpec, state *chainState) ([]Operation, error) {
+	var ops []Operation
+
+	if !state.exists {
+		if isBuiltinChain(spec.Chain) {
+			return nil, fmt.Errorf("built-in chain %s does not exist in table %s", spec.Chain, spec.Table)
+		}
+		ops = append(ops, Operation{Kind: OpNewChain, Table: spec.Table, Chain: spec.Chain})
+	}
+
+	if spec.Policy != "" && spec.Policy != state.policy {
+		if !isBuiltinChain(spec.Chain) {
+			return nil, fmt.Errorf("cannot set policy of user-defined chain %s", spec.Chain)
+		}
+		// carry the policy counters over, restoring the declaration resets
+		// them otherwise
+		counters := state.policyCounters
+		ops = append(ops, Operation{Kind: OpSetPolicy, Table: spec.Table, Chain: spec.Chain, Policy: spec.Policy, Counters: &counters})
+	}
+
+	current := make([]string, len(state.rules))
+	for i, rule := range state.rules {
+		current[i] = comparableRule(rule)
+	}
+	desired := make([]string, len(spec.Rules))
+	for i, rule := range spec.Rules {
+		desired[i] = comparableRule(rule)
+	}
+	keepCurrent, keepDesired := longestCommonSubsequence(current, desired)
+
+	deleted := counterPool{}
+	for i := len(current) - 1; i >= 0; i-- {
+		if !keepCurrent[i] {
+			if i < len(state.counters) {
+				deleted.put(current[i], state.counters[i])
+			}
+			ops = append(ops, Operation{
+				Kind:     OpDeleteRule,
+				Table:    spec.Table,
+				Chain:    spec.Chain,
+				Position: i + 1,
+				Rulespec: state.rules[i],
+			})
+		}
+	}
+
+	length := 0
+	for _, keep := range keepCurrent {
+		if keep {
+			length++
+		}
+	}
+	for i, rule := range spec.Rules {
+		if keepDesired[i] {
+			continue
+		}
+		op := Operation{Kind: OpInsertRule, Table: spec.Table, Chain: spec.Chain, Position: i + 1, Rulespec: rule}
+		op.Counters = deleted.take(desired[i])
+		if i == length {
+			op.Kind = OpAppendRule
+			op.Position = 0
+		}
+		ops = append(ops, op)
+		length++
+	}
+
+	return ops, nil
+}
+
+// counterPool holds the counters of rules being removed, so that rules
+// recreated with the same rulespec can take them over.
+type counterPool map[string][]Counters
+
+// put adds the counters of a removed rule. Identical rules must be put in
+// reverse chain order, so that take returns them in chain order.
+func (p counterPool) put(rule string, counters Counters) {
+	if counters == (Counters{}) {
+		return
+	}
+	p[rule] = append(p[rule], counters)
+}
+
+// take returns the counters of a removed rule identical to rule, or nil.
+func (p counterPool) take(rule string) *Counters {
+	pool := p[rule]
+	if len(pool) == 0 {
+		return nil
+	}
+	counters := pool[len(pool)-1]
+	p[rule] = pool[:len(pool)-1]
+	return &counters
+}
+
+// longestCommonSubsequence marks the elements of a and b that belong to
+// their longest common subsequence.
+func longestCommonSubsequence(a, b []string) ([]bool, []bool) {
+	// lengths[i][j] is the LCS length of a[i:] and b[j:]
+	lengths := make([][]int, len(a)+1)
+	for i := range lengths {
+		lengths[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			switch {
+			case a[i] == b[j]:
+				lengths[i][j] = lengths[i+1][j+1] + 1
+			case lengths[i+1][j] >= lengths[i][j+1]:
+				lengths[i][j] = lengths[i+1][j]
+			default:
+				lengths[i][j] = lengths[i][j+1]
+			}
+		}
+	}
+
+	inA := make([]bool, len(a))
+	inB := make([]bool, len(b))
+	for i, j := 0, 0; i < len(a) && j < len(b); {
+		switch {
+		case a[i] == b[j]:
+			inA[i], inB[j] = true, true
+			i++
+			j++
+		case lengths[i+1][j] >= lengths[i][j+1]:
+			i++
+		default:
+			j++
+		}
+	}
+	return inA, inB
+}
+
+// restoreScript renders ops as iptables-restore input. Chain declarations
+// (new or flushed chains and policy changes) come first in each table
+// section, followed by the other changes in order. Note that declaring a
+// user-defined chain creates it if missing and flushes it otherwise.
+func restoreScript(ops []Operation) string {
+	var tables []string
+	decls := map[string][]string{}
+	cmds := map[string][]string{}
+
+	for _, op := range ops {
+		if _, ok := decls[op.Table]; !ok {
+			tables = append(tables, op.Table)
+			decls[op.Table] = nil
+		}
+		switch op.Kind {
+		case OpNewChain, opFlushChain:
+			decls[op.Table] = append(decls[op.Table], ":"+op.Chain+" - [0:0]")
+		case OpSetPolicy:
+			var counters Counters
+			if op.Counters != nil {
+				counters = *op.Counters
+			}
+			decls[op.Table] = append(decls[op.Table], fmt.Sprintf(":%s %s [%d:%d]", op.Chain, op.Policy, counters.Packets, counters.Bytes))
+		default:
+			// drop the leading "-t table"
+			cmds[op.Table] = append(cmds[op.Table], strings.SplitN(op.String(), " ", 3)[2])
+		}
+	}
+
+	var b strings.Builder
+	for _, table := range tables {
+		b.WriteString("*" + table + "\n")
+		for _, line := range decls[table] {
+			b.WriteString(line + "\n")
+		}
+		for _, line := range cmds[table] {
+			b.WriteString(line + "\n")
+		}
+		b.WriteString("COMMIT\n")
+	}
+	return b.String()
+}
+
+// hasPolicyCounters returns true if ops set a policy with non-zero counters,
+// which the script of ops declares.
+func hasPolicyCounters(ops []Operation) bool {
+	for _, op := range ops {
+		if op.Kind == OpSetPolicy && op.Counters != nil && *op.Counters != (Counters{}) {
+			return true
+		}
+	}
+	return false
+}
+
+// fingerprintChains hashes the listing of the given chains.
+func fingerprintChains(chains []tableChain, states []*chainState) string {
+	h := sha256.New()
+	for i, tc := range chains {
+		fmt.Fprintf(h, "*%s %s\n", tc.table, tc.chain)
+		if !states[i].exists {
+			h.Write([]byte("!missing\n"))
+			continue
+		}
+		for _, line := range states[i].raw {
+			h.Write([]byte(line + "\n"))
+		}
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// isBuiltinChain returns true if chain is one of the chains built into the
+// standard tables.
+func isBuiltinChain(chain string) bool {
+	switch chain {
+	case "INPUT", "OUTPUT", "FORWARD", "PREROUTING", "POSTROUTING":
+		return true
+	}
+	return false
+}
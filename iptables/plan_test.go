@@ -0,0 +1,273 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestSplitRulespec(t *testing.T) {
+	testCases := []struct {
+		in  string
+		out []string
+	}{
+		{
+			"-A INPUT -p tcp -m tcp --dport 22 -j ACCEPT",
+			[]string{"-A", "INPUT", "-p", "tcp", "-m", "tcp", "--dport", "22", "-j", "ACCEPT"},
+		},
+		{
+			`-A INPUT -m comment --comment "allow ssh" -j ACCEPT`,
+			[]string{"-A", "INPUT", "-m", "comment", "--comment", "allow ssh", "-j", "ACCEPT"},
+		},
+		{
+			`-A INPUT -m comment --comment "say \"hi\"" -j ACCEPT`,
+			[]string{"-A", "INPUT", "-m", "comment", "--comment", `say "hi"`, "-j", "ACCEPT"},
+		},
+		{
+			`-A INPUT -j LOG --log-prefix ""`,
+			[]string{"-A", "INPUT", "-j", "LOG", "--log-prefix", ""},
+		},
+	}
+
+	for _, tt := range testCases {
+		t.Run(tt.in, func(t *testing.T) {
+			args, err := splitRulespec(tt.in)
+			if err != nil {
+				t.Fatalf("splitRulespec failed: %v", err)
+			}
+			if !reflect.DeepEqual(args, tt.out) {
+				t.Fatalf("splitRulespec mismatch: \ngot  %#v \nneed %#v", args, tt.out)
+			}
+			if joined := joinRulespec(args); joined != tt.in {
+				t.Fatalf("joinRulespec mismatch: \ngot  %s \nneed %s", joined, tt.in)
+			}
+		})
+	}
+
+	if _, err := splitRulespec(`-m comment --comment "oops`); err == nil {
+		t.Fatal("expected error for unterminated quote")
+	}
+}
+
+func TestPlanChain(t *testing.T) {
+	rule := func(s string) []string {
+		return strings.Fields(s)
+	}
+	a := rule("-s 10.0.0.1/32 -j ACCEPT")
+	b := rule("-s 10.0.0.2/32 -j ACCEPT")
+	c := rule("-s 10.0.0.3/32 -j ACCEPT")
+	d := rule("-s 10.0.0.4/32 -j ACCEPT")
+
+	testCases := []struct {
+		name    string
+		spec    ChainSpec
+		state   *chainState
+		ops     []string
+		wantErr bool
+	}{
+		{
+			name:  "missing chain",
+			spec:  ChainSpec{Table: "filter", Chain: "TEST", Rules: [][]string{a, b}},
+			state: &chainState{},
+			ops: []string{
+				"-t filter -N TEST",
+				"-t filter -A TEST -s 10.0.0.1/32 -j ACCEPT",
+				"-t filter -A TEST -s 10.0.0.2/32 -j ACCEPT",
+			},
+		},
+		{
+			name:  "up to date",
+			spec:  ChainSpec{Table: "filter", Chain: "TEST", Rules: [][]string{a, b}},
+			state: &chainState{exists: true, rules: [][]string{a, b}},
+		},
+		{
+			name:  "delete, insert and append",
+			spec:  ChainSpec{Table: "filter", Chain: "TEST", Rules: [][]string{d, a, c, b}},
+			state: &chainState{exists: true, rules: [][]string{a, b, c}},
+			ops: []string{
+				"-t filter -D TEST 2",
+				"-t filter -I TEST 1 -s 10.0.0.4/32 -j ACCEPT",
+				"-t filter -A TEST -s 10.0.0.2/32 -j ACCEPT",
+			},
+		},
+		{
+			name: "moved rule keeps its counters",
+			spec: ChainSpec{Table: "filter", Chain: "TEST", Rules: [][]string{b, a}},
+			state: &chainState{
+				exists:   true,
+				rules:    [][]string{a, b},
+				counters: []Counters{{Packets: 3, Bytes: 180}, {Packets: 7, Bytes: 420}},
+			},
+			ops: []string{
+				"-t filter -D TEST 1",
+				"-t filter -A TEST -c 3 180 -s 10.0.0.1/32 -j ACCEPT",
+			},
+		},
+		{
+			name:  "policy",
+			spec:  ChainSpec{Table: "filter", Chain: "INPUT", Policy: "DROP"},
+			state: &chainState{exists: true, policy: "ACCEPT", policyCounters: Counters{Packets: 12, Bytes: 960}, rules: [][]string{a}},
+			ops: []string{
+				"-t filter -P INPUT DROP",
+				"-t filter -D INPUT 1",
+			},
+		},
+		{
+			name:    "policy on user chain",
+			spec:    ChainSpec{Table: "filter", Chain: "TEST", Policy: "DROP"},
+			state:   &chainState{exists: true},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range testCases {
+		t.Run(tt.name, func(t *testing.T) {
+			ops, err := planChain(tt.spec, tt.state)
+			if err == nil && tt.wantErr {
+				t.Fatal("expected err, got none")
+			} else if err != nil && !tt.wantErr {
+				t.Fatalf("unexpected err %s", err)
+			}
+
+			var got []string
+			for _, op := range ops {
+				got = append(got, op.String())
+			}
+			if !reflect.DeepEqual(got, tt.ops) {
+				t.Fatalf("planChain mismatch: \ngot  %#v \nneed %#v", got, tt.ops)
+			}
+		})
+	}
+
+	// policy changes keep the policy counters
+	ops, err := planChain(
+		ChainSpec{Table: "filter", Chain: "INPUT", Policy: "DROP"},
+		&chainState{exists: true, policy: "ACCEPT", policyCounters: Counters{Packets: 12, Bytes: 960}},
+	)
+	if err != nil {
+		t.Fatalf("planChain failed: %v", err)
+	}
+	if expected := (Counters{Packets: 12, Bytes: 960}); ops[0].Counters == nil || *ops[0].Counters != expected {
+		t.Fatalf("policy counters mismatch: \ngot  %#v \nneed %#v", ops[0].Counters, expected)
+	}
+}
+
+func TestRestoreScript(t *testing.T) {
+	ops := []Operation{
+		{Kind: OpNewChain, Table: "filter", Chain: "TEST"},
+		{Kind: OpAppendRule, Table: "filter", Chain: "TEST", Rulespec: []string{"-m", "comment", "--comment", "a b", "-j", "ACCEPT"}},
+		{Kind: OpSetPolicy, Table: "filter", Chain: "FORWARD", Policy: "DROP", Counters: &Counters{Packets: 12, Bytes: 960}},
+		{Kind: OpSetPolicy, Table: "filter", Chain: "OUTPUT", Policy: "ACCEPT"},
+		{Kind: OpDeleteRule, Table: "nat", Chain: "POSTROUTING", Position: 2},
+	}
+	expected := `*filter
+:TEST - [0:0]
+:FORWARD DROP [12:960]
+:OUTPUT ACCEPT [0:0]
+-A TEST -m comment --comment "a b" -j ACCEPT
+COMMIT
+*nat
+-D POSTROUTING 2
+COMMIT
+`
+	if script := restoreScript(ops); script != expected {
+		t.Fatalf("restoreScript mismatch: \ngot  %s \nneed %s", script, expected)
+	}
+
+	// only non-zero policy counters need iptables-restore --counters
+	if !hasPolicyCounters(ops) {
+		t.Fatalf("hasPolicyCounters missed the counters of FORWARD")
+	}
+	if hasPolicyCounters(append(ops[:1:1], ops[3:]...)) {
+		t.Fatalf("hasPolicyCounters found counters in ops without any")
+	}
+}
+
+func TestPlanApply(t *testing.T) {
+	for i, ipt := range mustTestableIptables() {
+		t.Run(fmt.Sprint(i), func(t *testing.T) {
+			runPlanApplyTests(t, ipt)
+		})
+	}
+}
+
+func runPlanApplyTests(t *testing.T, ipt *IPTables) {
+	t.Logf("testing %s (hasWait=%t, hasCheck=%t)", ipt.path, ipt.hasWait, ipt.hasCheck)
+
+	chain := randChain(t)
+	defer func() {
+		if err := ipt.ClearAndDeleteChain("filter", chain); err != nil {
+			t.Fatalf("ClearAndDeleteChain failed: %v", err)
+		}
+	}()
+
+	desired := Ruleset{{
+		Table: "filter",
+		Chain: chain,
+		Rules: [][]string{
+			{"-p", "tcp", "-m", "tcp", "--dport", "22", "-j", "ACCEPT"},
+			{"-m", "comment", "--comment", "plan test", "-j", "RETURN"},
+		},
+	}}
+
+	plan, err := ipt.Plan(desired)
+	if err != nil {
+		t.Fatalf("Plan failed: %v", err)
+	}
+	if len(plan.Operations) != 3 {
+		t.Fatalf("expected 3 operations, got:\n%s", plan)
+	}
+	if err := ipt.Apply(plan); err != nil {
+		t.Fatalf("Apply failed: %v", err)
+	}
+
+	rules, err := ipt.List("filter", chain)
+	if err != nil {
+		t.Fatalf("List failed: %v", err)
+	}
+	expected := []string{
+		"-N " + chain,
+		"-A " + chain + " -p tcp -m tcp --dport 22 -j ACCEPT",
+		"-A " + chain + ` -m comment --comment "plan test" -j RETURN`,
+	}
+	if !reflect.DeepEqual(rules, expected) {
+		t.Fatalf("List mismatch: \ngot  %#v \nneed %#v", rules, expected)
+	}
+
+	// nothing left to do
+	plan, err = ipt.Plan(desired)
+	if err != nil {
+		t.Fatalf("Plan failed: %v", err)
+	}
+	if !plan.Empty() {
+		t.Fatalf("expected empty plan, got:\n%s", plan)
+	}
+
+	// a plan must not be applied once the chain changed
+	desired[0].Rules = desired[0].Rules[:1]
+	plan, err = ipt.Plan(desired)
+	if err != nil {
+		t.Fatalf("Plan failed: %v", err)
+	}
+	if err := ipt.Append("filter", chain, "-j", "DROP"); err != nil {
+		t.Fatalf("Append failed: %v", err)
+	}
+	if err := ipt.Apply(plan); err != ErrPlanDrift {
+		t.Fatalf("expected ErrPlanDrift, got %v", err)
+	}
+}
@@ -0,0 +1,370 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// limitScale is the resolution of packet rates, see XT_LIMIT_SCALE in
+	// the kernel
+	limitScale = 10000
+	// defaultLimitBurst is the default burst of the limit and hashlimit
+	// matches
+	defaultLimitBurst = 5
+	// maxHashLimitNameLen is the maximum length of a hashlimit name
+	maxHashLimitNameLen = 15
+)
+
+// Rate is the rate of a limit or hashlimit match: a number of packets per
+// second, minute, hour or day, or a number of bytes per second.
+type Rate struct {
+	Count uint64
+	// Per is time.Second, time.Minute, time.Hour or 24*time.Hour.
+	Per time.Duration
+	// Bytes makes Count a number of bytes per second. Byte rates are only
+	// supported by hashlimit.
+	Bytes bool
+}
+
+// rateUnits maps the units accepted by iptables to their duration.
+var rateUnits = map[string]time.Duration{
+	"s": time.Second, "sec": time.Second, "second": time.Second,
+	"m": time.Minute, "min": time.Minute, "minute": time.Minute,
+	"h": time.Hour, "hour": time.Hour,
+	"d": 24 * time.Hour, "day": 24 * time.Hour,
+}
+
+// byteUnits maps the byte rate prefixes to their multiplier.
+var byteUnits = map[string]uint64{"b": 1, "kb": 1 << 10, "mb": 1 << 20}
+
+var rateRegex = regexp.MustCompile(`^([0-9]+)(b|kb|mb)?/([a-z]+)$`)
+
+// ParseRate parses a rate as accepted by iptables, e.g. "3/min",
+// "10/second" or "512kb/s".
+func ParseRate(s string) (Rate, error) {
+	groups := rateRegex.FindStringSubmatch(s)
+	if groups == nil {
+		return Rate{}, fmt.Errorf("invalid rate %q", s)
+	}
+	count, err := strconv.ParseUint(groups[1], 10, 64)
+	if err != nil {
+		return Rate{}, fmt.Errorf("invalid rate %q: %v", s, err)
+	}
+	per, ok := rateUnits[groups[3]]
+	if !ok {
+		return Rate{}, fmt.Errorf("invalid rate unit %q", groups[3])
+	}
+	rate := Rate{Count: count, Per: per}
+	if groups[2] != "" {
+		if per != time.Second {
+			return Rate{}, fmt.Errorf("byte rates must be per second: %q", s)
+		}
+		rate.Bytes = true
+		rate.Count *= byteUnits[groups[2]]
+	}
+	return rate, rate.validate()
+}
+
+func (r Rate) validate() error {
+	if r.Count == 0 {
+		return fmt.Errorf("rate must be positive")
+	}
+	if r.Bytes {
+		if r.Per != time.Second {
+			return fmt.Errorf("byte rates must be per second")
+		}
+		return nil
+	}
+	switch r.Per {
+	case time.Second, time.Minute, time.Hour, 24 * time.Hour:
+	default:
+		return fmt.Errorf("invalid rate period %v", r.Per)
+	}
+	if r.period() == 0 {
+		return fmt.Errorf("rate %d per %v is too fast", r.Count, r.Per)
+	}
+	return nil
+}
+
+// period returns the average time between packets in units of
+// 1/limitScale second, as stored by the kernel.
+func (r Rate) period() uint64 {
+	return limitScale * uint64(r.Per/time.Second) / r.Count
+}
+
+// String returns the rate as listed by iptables, which picks the largest
+// unit that represents the rate exactly, e.g. "3/min" or "512kb/s".
+func (r Rate) String() string {
+	if r.Bytes {
+		switch {
+		case r.Count%(1<<20) == 0:
+			return strconv.FormatUint(r.Count>>20, 10) + "mb/s"
+		case r.Count%(1<<10) == 0:
+			return strconv.FormatUint(r.Count>>10, 10) + "kb/s"
+		}
+		return strconv.FormatUint(r.Count, 10) + "b/s"
+	}
+
+	// see print_rate in libxt_limit
+	units := []struct {
+		name string
+		mult uint64
+	}{
+		{"day", limitScale * 24 * 60 * 60},
+		{"hour", limitScale * 60 * 60},
+		{"min", limitScale * 60},
+		{"sec", limitScale},
+	}
+	period := r.period()
+	if period == 0 {
+		return "invalid"
+	}
+	i := 1
+	for ; i < len(units); i++ {
+		if period > units[i].mult || units[i].mult/period < units[i].mult%period {
+			break
+		}
+	}
+	return strconv.FormatUint(units[i-1].mult/period, 10) + "/" + units[i-1].name
+}
+
+// RateMatch is a match limiting the rate of packets: Limit or HashLimit.
+type RateMatch interface {
+	// matchArgs returns the match, including "-m module".
+	matchArgs() ([]string, error)
+	// above returns true if the match matches the packets over the limit
+	// instead of under it.
+	above() bool
+}
+
+// Limit is the limit match, matching packets until a global rate is
+// reached.
+type Limit struct {
+	Rate Rate
+	// Burst is the number of packets matched before the rate applies. It
+	// defaults to 5.
+	Burst int
+}
+
+func (l Limit) matchArgs() ([]string, error) {
+	if l.Rate.Bytes {
+		return nil, fmt.Errorf("the limit match doesn't support byte rates")
+	}
+	if err := l.Rate.validate(); err != nil {
+		return nil, err
+	}
+	if l.Burst < 0 {
+		return nil, fmt.Errorf("invalid burst %d", l.Burst)
+	}
+	args := []string{"-m", "limit", "--limit", l.Rate.String()}
+	if l.Burst != 0 && l.Burst != defaultLimitBurst {
+		args = append(args, "--limit-burst", strconv.Itoa(l.Burst))
+	}
+	return args, nil
+}
+
+func (l Limit) above() bool { return false }
+
+// hashLimitModes are the valid hashlimit modes, in the order iptables lists
+// them.
+var hashLimitModes = []string{"srcip", "srcport", "dstip", "dstport"}
+
+// HashLimit is the hashlimit match, which limits the rate per group of
+// packets, e.g. per source address.
+type HashLimit struct {
+	// Name is the name of the hash table, listed in /proc/net/ipt_hashlimit.
+	Name string
+	Rate Rate
+	// Above makes the match match the packets over the rate, instead of
+	// those under it.
+	Above bool
+	// Burst is the number of packets matched before the rate applies. It
+	// defaults to 5 for packet rates.
+	Burst int
+	// Mode lists what packets are grouped by: "srcip", "srcport", "dstip"
+	// and "dstport". All packets are in the same group if empty.
+	Mode []string
+	// SrcMask and DstMask are the prefix lengths applied to the addresses
+	// before grouping, e.g. 24 to group by /24 network. They default to
+	// the full address length if 0.
+	SrcMask int
+	DstMask int
+	// HTableSize and HTableMax are the number of buckets and the maximum
+	// number of entries of the hash table. Kernel defaults apply if 0.
+	HTableSize int
+	HTableMax  int
+	// HTableExpire is the time after which idle entries expire. The kernel
+	// default of 10s applies if 0.
+	HTableExpire time.Duration
+	// HTableGCInterval is the interval between garbage collections. The
+	// kernel default of 1s applies if 0.
+	HTableGCInterval time.Duration
+}
+
+func (h HashLimit) matchArgs() ([]string, error) {
+	if h.Name == "" || len(h.Name) > maxHashLimitNameLen {
+		return nil, fmt.Errorf("hashlimit name must be 1 to %d characters long", maxHashLimitNameLen)
+	}
+	if err := h.Rate.validate(); err != nil {
+		return nil, err
+	}
+
+	flag := "--hashlimit-upto"
+	if h.Above {
+		flag = "--hashlimit-above"
+	}
+	args := []string{"-m", "hashlimit", flag, h.Rate.String()}
+
+	switch {
+	case h.Burst < 0:
+		return nil, fmt.Errorf("invalid burst %d", h.Burst)
+	case h.Burst != 0 && (h.Rate.Bytes || h.Burst != defaultLimitBurst):
+		args = append(args, "--hashlimit-burst", strconv.Itoa(h.Burst))
+	}
+
+	if len(h.Mode) > 0 {
+		want := map[string]bool{}
+		for _, m := range h.Mode {
+			want[m] = true
+		}
+		var modes []string
+		for _, m := range hashLimitModes {
+			if want[m] {
+				modes = append(modes, m)
+				delete(want, m)
+			}
+		}
+		if len(want) > 0 {
+			return nil, fmt.Errorf("invalid hashlimit mode in %q", h.Mode)
+		}
+		args = append(args, "--hashlimit-mode", strings.Join(modes, ","))
+	}
+
+	if h.SrcMask > 128 || h.DstMask > 128 {
+		return nil, fmt.Errorf("invalid hashlimit mask")
+	}
+
+	args = append(args, "--hashlimit-name", h.Name)
+	for _, opt := range []struct {
+		flag  string
+		value int
+	}{
+		{"--hashlimit-htable-size", h.HTableSize},
+		{"--hashlimit-htable-max", h.HTableMax},
+		{"--hashlimit-htable-gcinterval", int(h.HTableGCInterval / time.Millisecond)},
+		{"--hashlimit-htable-expire", int(h.HTableExpire / time.Millisecond)},
+		{"--hashlimit-srcmask", h.SrcMask},
+		{"--hashlimit-dstmask", h.DstMask},
+	} {
+		switch {
+		case opt.value < 0:
+			return nil, fmt.Errorf("invalid %s %d", opt.flag, opt.value)
+		case opt.value > 0:
+			args = append(args, opt.flag, strconv.Itoa(opt.value))
+		}
+	}
+	return args, nil
+}
+
+func (h HashLimit) above() bool { return h.Above }
+
+// RateLimit adds a limit or hashlimit match to the rule.
+func (r *Rule) RateLimit(m RateMatch) *Rule {
+	r.noNot("rate limit")
+	args, err := m.matchArgs()
+	if err != nil {
+		r.errs = append(r.errs, err)
+		return r
+	}
+	return r.addMatch(args[1], args[2:]...)
+}
+
+// RateLimit sends the packets of table/chain matched by match, which may be
+// nil, to a dedicated chain that accepts them while under the rate of limit
+// and applies action, e.g. "DROP", to the others. The dedicated chain is
+// named after the table, chain and match, so calling RateLimit again with
+// the same match updates the limit in place. The jump into the dedicated
+// chain is appended to chain if missing. The returned ManagedChain can be
+// used to remove the dedicated chain and its jump.
+func (ipt *IPTables) RateLimit(table, chain string, match *Rule, limit RateMatch, action string) (*ManagedChain, error) {
+	if action == "" {
+		return nil, fmt.Errorf("empty rate limit action")
+	}
+	if match == nil {
+		match = NewRule()
+	}
+	if match.target != nil {
+		return nil, fmt.Errorf("rate limit match already has a target")
+	}
+	matchArgs, err := match.Args()
+	if err != nil {
+		return nil, err
+	}
+	if err := match.CheckChain(chain); err != nil {
+		return nil, err
+	}
+	if err := ipt.checkRuleFamily(match); err != nil {
+		return nil, err
+	}
+	if err := ipt.checkRateFamily(limit); err != nil {
+		return nil, err
+	}
+
+	limited, err := NewRule().RateLimit(limit).Jump("ACCEPT").Args()
+	if err != nil {
+		return nil, err
+	}
+	rules := [][]string{limited, {"-j", action}}
+	if limit.above() {
+		// the match selects the packets over the limit
+		limited[len(limited)-1] = action
+		rules = [][]string{limited, {"-j", "ACCEPT"}}
+	}
+
+	name := "RL-" + chainHash(table+" "+chain+" "+joinRulespec(matchArgs), 16)
+	m := ipt.NewManagedChain(table, name, JumpRule{Chain: chain, Match: matchArgs})
+	return m, m.Sync(rules)
+}
+
+// checkRateFamily returns an error if the masks of a hashlimit match are
+// longer than the addresses of the family of ipt.
+func (ipt *IPTables) checkRateFamily(limit RateMatch) error {
+	var h HashLimit
+	switch l := limit.(type) {
+	case HashLimit:
+		h = l
+	case *HashLimit:
+		if l == nil {
+			return nil
+		}
+		h = *l
+	default:
+		return nil
+	}
+	bits := 32
+	if ipt.proto == ProtocolIPv6 {
+		bits = 128
+	}
+	if h.SrcMask > bits || h.DstMask > bits {
+		return fmt.Errorf("hashlimit mask longer than the %d bits of %s addresses", bits, getIptablesCommand(ipt.proto))
+	}
+	return nil
+}
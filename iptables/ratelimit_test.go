@@ -0,0 +1,257 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseRate(t *testing.T) {
+	testCases := []struct {
+		in      string
+		rate    Rate
+		out     string
+		wantErr bool
+	}{
+		{in: "3/min", rate: Rate{Count: 3, Per: time.Minute}, out: "3/min"},
+		{in: "10/second", rate: Rate{Count: 10, Per: time.Second}, out: "10/sec"},
+		{in: "60/m", rate: Rate{Count: 60, Per: time.Minute}, out: "1/sec"},
+		{in: "100/min", rate: Rate{Count: 100, Per: time.Minute}, out: "100/min"},
+		{in: "24/day", rate: Rate{Count: 24, Per: 24 * time.Hour}, out: "1/hour"},
+		{in: "7/d", rate: Rate{Count: 7, Per: 24 * time.Hour}, out: "7/day"},
+		{in: "512kb/s", rate: Rate{Count: 512 << 10, Per: time.Second, Bytes: true}, out: "512kb/s"},
+		{in: "2048kb/s", rate: Rate{Count: 2 << 20, Per: time.Second, Bytes: true}, out: "2mb/s"},
+		{in: "1500b/s", rate: Rate{Count: 1500, Per: time.Second, Bytes: true}, out: "1500b/s"},
+		{in: "0/sec", wantErr: true},
+		{in: "20000/sec", wantErr: true},
+		{in: "3/week", wantErr: true},
+		{in: "1kb/min", wantErr: true},
+		{in: "3", wantErr: true},
+		{in: "-3/sec", wantErr: true},
+	}
+
+	for _, tt := range testCases {
+		rate, err := ParseRate(tt.in)
+		if err == nil && tt.wantErr {
+			t.Fatalf("expected err for %q, got %#v", tt.in, rate)
+		} else if err != nil && !tt.wantErr {
+			t.Fatalf("unexpected err for %q: %s", tt.in, err)
+		}
+		if tt.wantErr {
+			continue
+		}
+		if rate != tt.rate {
+			t.Fatalf("ParseRate(%q) mismatch: \ngot  %#v \nneed %#v", tt.in, rate, tt.rate)
+		}
+		if rate.String() != tt.out {
+			t.Fatalf("String of %q mismatch: \ngot  %s \nneed %s", tt.in, rate.String(), tt.out)
+		}
+	}
+}
+
+func TestRateMatchArgs(t *testing.T) {
+	perMinute := Rate{Count: 3, Per: time.Minute}
+	bytes := Rate{Count: 1 << 20, Per: time.Second, Bytes: true}
+
+	testCases := []struct {
+		name    string
+		match   RateMatch
+		args    string
+		wantErr bool
+	}{
+		{
+			name:  "limit",
+			match: Limit{Rate: perMinute},
+			args:  "-m limit --limit 3/min",
+		},
+		{
+			name:  "limit with default burst",
+			match: Limit{Rate: perMinute, Burst: 5},
+			args:  "-m limit --limit 3/min",
+		},
+		{
+			name:  "limit with burst",
+			match: Limit{Rate: perMinute, Burst: 10},
+			args:  "-m limit --limit 3/min --limit-burst 10",
+		},
+		{
+			name: "hashlimit",
+			match: HashLimit{
+				Name:         "ssh",
+				Rate:         Rate{Count: 10, Per: time.Second},
+				Burst:        20,
+				Mode:         []string{"dstport", "srcip"},
+				SrcMask:      24,
+				HTableSize:   1024,
+				HTableMax:    4096,
+				HTableExpire: 30 * time.Second,
+			},
+			args: "-m hashlimit --hashlimit-upto 10/sec --hashlimit-burst 20 --hashlimit-mode srcip,dstport --hashlimit-name ssh --hashlimit-htable-size 1024 --hashlimit-htable-max 4096 --hashlimit-htable-expire 30000 --hashlimit-srcmask 24",
+		},
+		{
+			name:  "hashlimit above with bytes",
+			match: HashLimit{Name: "bw", Rate: bytes, Above: true, Burst: 5, Mode: []string{"dstip"}, HTableGCInterval: 2 * time.Second},
+			args:  "-m hashlimit --hashlimit-above 1mb/s --hashlimit-burst 5 --hashlimit-mode dstip --hashlimit-name bw --hashlimit-htable-gcinterval 2000",
+		},
+		{name: "limit with bytes", match: Limit{Rate: bytes}, wantErr: true},
+		{name: "limit without rate", match: Limit{}, wantErr: true},
+		{name: "negative burst", match: Limit{Rate: perMinute, Burst: -1}, wantErr: true},
+		{name: "hashlimit without name", match: HashLimit{Rate: perMinute}, wantErr: true},
+		{name: "hashlimit long name", match: HashLimit{Name: "0123456789abcdef", Rate: perMinute}, wantErr: true},
+		{name: "hashlimit invalid mode", match: HashLimit{Name: "x", Rate: perMinute, Mode: []string{"srcmac"}}, wantErr: true},
+		{name: "hashlimit invalid mask", match: HashLimit{Name: "x", Rate: perMinute, SrcMask: 129}, wantErr: true},
+		{name: "hashlimit invalid period", match: HashLimit{Name: "x", Rate: Rate{Count: 1, Per: time.Millisecond}}, wantErr: true},
+	}
+
+	for _, tt := range testCases {
+		t.Run(tt.name, func(t *testing.T) {
+			args, err := NewRule().Protocol("tcp").RateLimit(tt.match).Jump("ACCEPT").Args()
+			if err == nil && tt.wantErr {
+				t.Fatalf("expected err, got %q", args)
+			} else if err != nil && !tt.wantErr {
+				t.Fatalf("unexpected err %s", err)
+			}
+			if tt.wantErr {
+				return
+			}
+			if got, need := joinRulespec(args), "-p tcp "+tt.args+" -j ACCEPT"; got != need {
+				t.Fatalf("args mismatch: \ngot  %s \nneed %s", got, need)
+			}
+		})
+	}
+
+	if _, err := NewRule().Not().RateLimit(Limit{Rate: perMinute}).Args(); err == nil {
+		t.Fatalf("expected err for inverted rate limit, got none")
+	}
+}
+
+func TestCheckRateFamily(t *testing.T) {
+	ipv4 := &IPTables{proto: ProtocolIPv4}
+	ipv6 := &IPTables{proto: ProtocolIPv6}
+	perMinute := Rate{Count: 3, Per: time.Minute}
+
+	for _, tt := range []struct {
+		name    string
+		ipt     *IPTables
+		limit   RateMatch
+		wantErr bool
+	}{
+		{name: "limit", ipt: ipv4, limit: Limit{Rate: perMinute}},
+		{name: "ipv4 mask", ipt: ipv4, limit: HashLimit{Name: "x", Rate: perMinute, SrcMask: 32, DstMask: 24}},
+		{name: "ipv4 src mask too long", ipt: ipv4, limit: HashLimit{Name: "x", Rate: perMinute, SrcMask: 33}, wantErr: true},
+		{name: "ipv4 dst mask too long", ipt: ipv4, limit: &HashLimit{Name: "x", Rate: perMinute, DstMask: 64}, wantErr: true},
+		{name: "ipv6 mask", ipt: ipv6, limit: HashLimit{Name: "x", Rate: perMinute, SrcMask: 64, DstMask: 128}},
+	} {
+		err := tt.ipt.checkRateFamily(tt.limit)
+		if (err != nil) != tt.wantErr {
+			t.Fatalf("%s: unexpected err %v", tt.name, err)
+		}
+	}
+}
+
+func TestRateLimitValidation(t *testing.T) {
+	ipt := &IPTables{proto: ProtocolIPv4}
+	perMinute := Rate{Count: 3, Per: time.Minute}
+
+	// each case fails before running iptables
+	for _, tt := range []struct {
+		name   string
+		match  *Rule
+		limit  RateMatch
+		action string
+	}{
+		{name: "empty action", limit: Limit{Rate: perMinute}},
+		{name: "match with target", match: NewRule().Jump("ACCEPT"), limit: Limit{Rate: perMinute}, action: "DROP"},
+		{name: "owner in input", match: NewRule().SocketOwner(SocketOwner{UID: "1000"}), limit: Limit{Rate: perMinute}, action: "DROP"},
+		{name: "wrong match family", match: NewRule().Source("2001:db8::1"), limit: Limit{Rate: perMinute}, action: "DROP"},
+		{name: "ipv4 mask too long", limit: HashLimit{Name: "x", Rate: perMinute, SrcMask: 48}, action: "DROP"},
+	} {
+		if _, err := ipt.RateLimit("filter", "INPUT", tt.match, tt.limit, tt.action); err == nil {
+			t.Fatalf("expected err for %s, got none", tt.name)
+		}
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	for i, ipt := range mustTestableIptables() {
+		t.Run(fmt.Sprint(i), func(t *testing.T) {
+			runRateLimitTests(t, ipt)
+		})
+	}
+}
+
+func runRateLimitTests(t *testing.T, ipt *IPTables) {
+	chain := randChain(t)
+	if err := ipt.NewChain("filter", chain); err != nil {
+		t.Fatalf("NewChain failed: %v", err)
+	}
+	defer func() {
+		if err := ipt.ClearAndDeleteChain("filter", chain); err != nil {
+			t.Fatalf("ClearAndDeleteChain failed: %v", err)
+		}
+	}()
+
+	match := NewRule().Protocol("tcp").DPort(22)
+	limit := HashLimit{Name: chain, Rate: Rate{Count: 3, Per: time.Minute}, Mode: []string{"srcip"}}
+	m, err := ipt.RateLimit("filter", chain, match, limit, "DROP")
+	if err != nil {
+		t.Fatalf("RateLimit failed: %v", err)
+	}
+	defer func() {
+		if err := m.Teardown(); err != nil {
+			t.Fatalf("Teardown failed: %v", err)
+		}
+	}()
+
+	checkRules := func(need [][]string) {
+		state, err := ipt.chainState("filter", m.Name)
+		if err != nil {
+			t.Fatalf("chainState failed: %v", err)
+		}
+		if !reflect.DeepEqual(state.rules, need) {
+			t.Fatalf("rules of %s mismatch: \ngot  %q \nneed %q", m.Name, state.rules, need)
+		}
+	}
+	checkRules([][]string{
+		{"-m", "hashlimit", "--hashlimit-upto", "3/min", "--hashlimit-mode", "srcip", "--hashlimit-name", limit.Name, "-j", "ACCEPT"},
+		{"-j", "DROP"},
+	})
+
+	// the same match updates the dedicated chain in place
+	limit.Above = true
+	m2, err := ipt.RateLimit("filter", chain, match, limit, "REJECT")
+	if err != nil {
+		t.Fatalf("RateLimit failed: %v", err)
+	}
+	if m2.Name != m.Name {
+		t.Fatalf("dedicated chain changed: %s, was %s", m2.Name, m.Name)
+	}
+	checkRules([][]string{
+		{"-m", "hashlimit", "--hashlimit-above", "3/min", "--hashlimit-mode", "srcip", "--hashlimit-name", limit.Name, "-j", "REJECT"},
+		{"-j", "ACCEPT"},
+	})
+
+	state, err := ipt.chainState("filter", chain)
+	if err != nil {
+		t.Fatalf("chainState failed: %v", err)
+	}
+	need := [][]string{{"-p", "tcp", "-m", "tcp", "--dport", "22", "-j", m.Name}}
+	if !reflect.DeepEqual(state.rules, need) {
+		t.Fatalf("rules of %s mismatch: \ngot  %q \nneed %q", chain, state.rules, need)
+	}
+}
@@ -0,0 +1,133 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables
+
+import (
+	"bytes"
+	"fmt"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// toolPath returns the path of an iptables companion tool, e.g.
+// "iptables-restore" or "ip6tables-legacy-save". The directory of the
+// iptables binary is searched first so that the tool matches the binary
+// (and its legacy/nf_tables mode) in use.
+func (ipt *IPTables) toolPath(suffix string) (string, error) {
+	name := filepath.Base(ipt.path) + suffix
+	if path, err := exec.LookPath(filepath.Join(filepath.Dir(ipt.path), name)); err == nil {
+		return path, nil
+	}
+	return exec.LookPath(name)
+}
+
+// restore feeds script to iptables-restore. Unless flush is set, tables
+// are not flushed before the script is applied.
+func (ipt *IPTables) restore(script string, flush bool) error {
+	return ipt.runRestore(script, flush, nil)
+}
+
+// restoreWithCounters acts like restore, except that the counters of the
+// chain declarations of script, e.g. ":INPUT DROP [12:3400]", are applied
+// instead of ignored.
+func (ipt *IPTables) restoreWithCounters(script string, flush bool) error {
+	return ipt.runRestore(script, flush, []string{"--counters"})
+}
+
+func (ipt *IPTables) runRestore(script string, flush bool, args []string) error {
+	path, err := ipt.toolPath("-restore")
+	if err != nil {
+		return err
+	}
+
+	if !flush {
+		args = append(args, "--noflush")
+	}
+	return ipt.runTool(path, args, strings.NewReader(script), nil, ipt.hasRestoreWait)
+}
+
+// save returns the output of iptables-save for the given table, or for all
+// tables if table is empty.
+func (ipt *IPTables) save(table string) ([]string, error) {
+	path, err := ipt.toolPath("-save")
+	if err != nil {
+		return nil, err
+	}
+
+	args := []string{}
+	if table != "" {
+		args = append(args, "-t", table)
+	}
+
+	var stdout bytes.Buffer
+	if err := ipt.runTool(path, args, nil, &stdout, false); err != nil {
+		return nil, err
+	}
+	return strings.Split(strings.TrimSuffix(stdout.String(), "\n"), "\n"), nil
+}
+
+// splitRulespec splits a rule as printed by "iptables -S" or iptables-save
+// into its arguments, removing the double quotes iptables puts around
+// arguments such as comments and log prefixes.
+func splitRulespec(rule string) ([]string, error) {
+	var (
+		args    []string
+		cur     strings.Builder
+		inArg   bool
+		inQuote bool
+	)
+	for i := 0; i < len(rule); i++ {
+		c := rule[i]
+		switch {
+		case c == '\\' && inQuote && i+1 < len(rule):
+			i++
+			cur.WriteByte(rule[i])
+		case c == '"':
+			inQuote = !inQuote
+			inArg = true
+		case (c == ' ' || c == '\t') && !inQuote:
+			if inArg {
+				args = append(args, cur.String())
+				cur.Reset()
+				inArg = false
+			}
+		default:
+			cur.WriteByte(c)
+			inArg = true
+		}
+	}
+	if inQuote {
+		return nil, fmt.Errorf("unterminated quote in rule: %s", rule)
+	}
+	if inArg {
+		args = append(args, cur.String())
+	}
+	return args, nil
+}
+
+// joinRulespec is the inverse of splitRulespec: it joins args into a single
+// line, quoting arguments the way iptables-save does so that the result can
+// be fed to iptables-restore.
+func joinRulespec(args []string) string {
+	quoted := make([]string, len(args))
+	for i, arg := range args {
+		if arg == "" || strings.ContainsAny(arg, " \t\"\\'") {
+			arg = `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(arg) + `"`
+		}
+		quoted[i] = arg
+	}
+	return strings.Join(quoted, " ")
+}
@@ -0,0 +1,447 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// maxInterfaceLen is the maximum length of an interface name, see IFNAMSIZ
+// in the kernel (16 including the terminating NUL)
+const maxInterfaceLen = 15
+
+// negatable is a rule parameter that can be inverted with "!".
+type negatable struct {
+	value  string
+	invert bool
+}
+
+// args returns the parameter as arguments for the given flag, or nothing if
+// it is unset.
+func (n *negatable) args(flag string) []string {
+	if n == nil {
+		return nil
+	}
+	if n.invert {
+		return []string{"!", flag, n.value}
+	}
+	return []string{flag, n.value}
+}
+
+// ruleMatch is a "-m module" match with its arguments.
+type ruleMatch struct {
+	module string
+	args   []string
+}
+
+// ports are the source or destination ports of a rule.
+type ports struct {
+	ranges []PortRange
+	invert bool
+	// multiport is set when the ports were given as a list
+	multiport bool
+}
+
+// Rule builds a rulespec, as accepted by Append, Insert, Exists and the
+// other functions taking a rulespec. It is created by NewRule and configured
+// by chaining calls, e.g.
+//
+//	NewRule().Protocol("tcp").DPort(22).Source("10.0.0.0/8").
+//		State("NEW").Comment("ssh").Jump("ACCEPT")
+//
+// Not inverts the parameter set by the following call. Errors are reported
+// by Args, which also checks the combination of parameters. The arguments
+// are generated in the form listed by "iptables -S", so that rules built
+// the same way compare equal to the listed rules.
+type Rule struct {
+	protocol    *negatable
+	source      *negatable
+	destination *negatable
+	in, out     *negatable
+
+	sports, dports *ports
+
+	matches []ruleMatch
+
+	target []string
+	isGoto bool
+
+	not  bool
+	errs []error
+}
+
+// NewRule returns an empty rule, matching every packet.
+func NewRule() *Rule {
+	return &Rule{}
+}
+
+// Not inverts the parameter set by the next call.
+func (r *Rule) Not() *Rule {
+	if r.not {
+		r.errorf("Not called twice")
+	}
+	r.not = true
+	return r
+}
+
+// takeNot returns and clears the pending Not.
+func (r *Rule) takeNot() bool {
+	not := r.not
+	r.not = false
+	return not
+}
+
+// noNot records an error if a Not is pending for what can't be inverted.
+func (r *Rule) noNot(what string) {
+	if r.takeNot() {
+		r.errorf("%s cannot be inverted", what)
+	}
+}
+
+func (r *Rule) errorf(format string, a ...interface{}) {
+	r.errs = append(r.errs, fmt.Errorf(format, a...))
+}
+
+// Protocol matches the protocol, e.g. "tcp", "udp" or "icmp".
+func (r *Rule) Protocol(protocol string) *Rule {
+	invert := r.takeNot()
+	if protocol == "" {
+		r.errorf("empty protocol")
+	}
+	if r.protocol != nil {
+		r.errorf("protocol set twice")
+	}
+	r.protocol = &negatable{value: strings.ToLower(protocol), invert: invert}
+	return r
+}
+
+// Source matches the source address or network, e.g. "10.0.0.1" or
+// "10.0.0.0/8".
+func (r *Rule) Source(cidr string) *Rule {
+	r.source = r.address("source", r.source, cidr)
+	return r
+}
+
+// Destination matches the destination address or network.
+func (r *Rule) Destination(cidr string) *Rule {
+	r.destination = r.address("destination", r.destination, cidr)
+	return r
+}
+
+// address validates and normalizes an address parameter the way iptables
+// lists it: the network address with its prefix length.
+func (r *Rule) address(what string, cur *negatable, cidr string) *negatable {
+	invert := r.takeNot()
+	if cur != nil {
+		r.errorf("%s set twice", what)
+	}
+	_, ipnet, err := net.ParseCIDR(appendSubnet(cidr))
+	if err != nil {
+		r.errorf("invalid %s %q", what, cidr)
+		return cur
+	}
+	return &negatable{value: ipnet.String(), invert: invert}
+}
+
+// InInterface matches the interface packets are received on. A trailing "+"
+// matches every interface starting with the name.
+func (r *Rule) InInterface(name string) *Rule {
+	r.in = r.iface("input interface", r.in, name)
+	return r
+}
+
+// OutInterface matches the interface packets are sent on.
+func (r *Rule) OutInterface(name string) *Rule {
+	r.out = r.iface("output interface", r.out, name)
+	return r
+}
+
+func (r *Rule) iface(what string, cur *negatable, name string) *negatable {
+	invert := r.takeNot()
+	if cur != nil {
+		r.errorf("%s set twice", what)
+	}
+	if name == "" || len(name) > maxInterfaceLen {
+		r.errorf("invalid %s %q", what, name)
+		return cur
+	}
+	return &negatable{value: name, invert: invert}
+}
+
+// SPort matches the source port.
+func (r *Rule) SPort(port int) *Rule {
+	return r.SPortRange(port, port)
+}
+
+// DPort matches the destination port.
+func (r *Rule) DPort(port int) *Rule {
+	return r.DPortRange(port, port)
+}
+
+// SPortRange matches the source ports from first to last, inclusive.
+func (r *Rule) SPortRange(first, last int) *Rule {
+	r.sports = r.portRanges("source ports", r.sports, false, [][2]int{{first, last}})
+	return r
+}
+
+// DPortRange matches the destination ports from first to last, inclusive.
+func (r *Rule) DPortRange(first, last int) *Rule {
+	r.dports = r.portRanges("destination ports", r.dports, false, [][2]int{{first, last}})
+	return r
+}
+
+// SPorts matches any of the given source ports, using the multiport match.
+func (r *Rule) SPorts(ports ...int) *Rule {
+	r.sports = r.portRanges("source ports", r.sports, true, singlePorts(ports))
+	return r
+}
+
+// DPorts matches any of the given destination ports, using the multiport
+// match.
+func (r *Rule) DPorts(ports ...int) *Rule {
+	r.dports = r.portRanges("destination ports", r.dports, true, singlePorts(ports))
+	return r
+}
+
+func singlePorts(ports []int) [][2]int {
+	ranges := make([][2]int, len(ports))
+	for i, port := range ports {
+		ranges[i] = [2]int{port, port}
+	}
+	return ranges
+}
+
+// maxMultiports is the maximum number of ports of a multiport match, see
+// XT_MULTI_PORTS in the kernel
+const maxMultiports = 15
+
+func (r *Rule) portRanges(what string, cur *ports, multiport bool, ranges [][2]int) *ports {
+	invert := r.takeNot()
+	if cur != nil {
+		r.errorf("%s set twice", what)
+	}
+	if len(ranges) == 0 || len(ranges) > maxMultiports {
+		r.errorf("invalid number of %s: %d", what, len(ranges))
+		return cur
+	}
+	p := &ports{invert: invert, multiport: multiport}
+	for _, pr := range ranges {
+		if pr[0] < 0 || pr[1] > 65535 || pr[0] > pr[1] {
+			r.errorf("invalid %s %d:%d", what, pr[0], pr[1])
+			return cur
+		}
+		p.ranges = append(p.ranges, PortRange{First: uint16(pr[0]), Last: uint16(pr[1])})
+	}
+	return p
+}
+
+// State matches the connection tracking states, e.g. "NEW" or
+// "ESTABLISHED", using the conntrack match.
+func (r *Rule) State(states ...string) *Rule {
+	invert := r.takeNot()
+	if len(states) == 0 {
+		r.errorf("no conntrack state given")
+		return r
+	}
+	return r.Conntrack(Conntrack{States: states, InvertStates: invert})
+}
+
+// Comment adds a comment to the rule.
+func (r *Rule) Comment(comment string) *Rule {
+	r.noNot("comment")
+	if comment == "" || len(comment) > maxCommentLen {
+		r.errorf("comment must be 1 to %d characters long", maxCommentLen)
+	}
+	return r.addMatch("comment", "--comment", comment)
+}
+
+// Match adds a match module with its arguments, for matches that have no
+// dedicated method, e.g. Match("mark", "--mark", "0x1").
+func (r *Rule) Match(module string, args ...string) *Rule {
+	r.noNot("match module")
+	if module == "" {
+		r.errorf("empty match module")
+	}
+	return r.addMatch(module, args...)
+}
+
+func (r *Rule) addMatch(module string, args ...string) *Rule {
+	r.matches = append(r.matches, ruleMatch{module: module, args: args})
+	return r
+}
+
+// Jump sets the target of the rule, with the target's arguments, e.g.
+// Jump("REJECT", "--reject-with", "tcp-reset").
+func (r *Rule) Jump(target string, args ...string) *Rule {
+	r.noNot("target")
+	return r.setTarget(target, false, args)
+}
+
+// Goto continues processing in the given user-defined chain. Unlike a jump,
+// returning from that chain continues in the chain that called this one.
+func (r *Rule) Goto(chain string) *Rule {
+	r.noNot("goto")
+	return r.setTarget(chain, true, nil)
+}
+
+func (r *Rule) setTarget(target string, isGoto bool, args []string) *Rule {
+	if target == "" {
+		r.errorf("empty target")
+	}
+	if r.target != nil {
+		r.errorf("target set twice")
+	}
+	r.target = append([]string{target}, args...)
+	r.isGoto = isGoto
+	return r
+}
+
+// portProtocols are the protocols whose match supports --sport and --dport.
+var portProtocols = map[string]bool{"tcp": true, "udp": true, "udplite": true, "sctp": true, "dccp": true}
+
+// Args validates the rule and returns its rulespec.
+func (r *Rule) Args() ([]string, error) {
+	if len(r.errs) > 0 {
+		return nil, r.errs[0]
+	}
+	if r.not {
+		return nil, fmt.Errorf("Not isn't followed by a parameter")
+	}
+	if r.source != nil && r.destination != nil && isIPv6(r.source.value) != isIPv6(r.destination.value) {
+		return nil, fmt.Errorf("source %s and destination %s are of different families", r.source.value, r.destination.value)
+	}
+
+	var args []string
+	args = append(args, r.source.args("-s")...)
+	args = append(args, r.destination.args("-d")...)
+	args = append(args, r.in.args("-i")...)
+	args = append(args, r.out.args("-o")...)
+	args = append(args, r.protocol.args("-p")...)
+
+	if r.sports != nil || r.dports != nil {
+		if r.protocol == nil || r.protocol.invert || !portProtocols[r.protocol.value] {
+			return nil, fmt.Errorf("ports require protocol tcp, udp, udplite, sctp or dccp")
+		}
+		portArgs, err := r.portArgs()
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, portArgs...)
+	}
+
+	for _, m := range r.matches {
+		args = append(args, "-m", m.module)
+		args = append(args, m.args...)
+	}
+
+	if r.target != nil {
+		flag := "-j"
+		if r.isGoto {
+			flag = "-g"
+		}
+		args = append(args, flag)
+		args = append(args, r.target...)
+	}
+	return args, nil
+}
+
+// portArgs returns the port matches: the protocol match for single ports or
+// ranges, followed by the multiport match for lists.
+func (r *Rule) portArgs() ([]string, error) {
+	var single, multi []string
+	for _, p := range []struct {
+		ports *ports
+		flag  string
+	}{{r.sports, "sport"}, {r.dports, "dport"}} {
+		if p.ports == nil {
+			continue
+		}
+		if !p.ports.multiport {
+			if p.ports.invert {
+				single = append(single, "!")
+			}
+			single = append(single, "--"+p.flag, p.ports.ranges[0].String())
+			continue
+		}
+		if r.protocol.value == "dccp" {
+			return nil, fmt.Errorf("multiport doesn't support protocol dccp")
+		}
+		list := make([]string, len(p.ports.ranges))
+		for i, pr := range p.ports.ranges {
+			list[i] = pr.String()
+		}
+		if p.ports.invert {
+			multi = append(multi, "!")
+		}
+		multi = append(multi, "--"+p.flag+"s", strings.Join(list, ","))
+	}
+
+	var args []string
+	if single != nil {
+		args = append(append(args, "-m", r.protocol.value), single...)
+	}
+	if multi != nil {
+		args = append(append(args, "-m", "multiport"), multi...)
+	}
+	return args, nil
+}
+
+// matchChains are the built-in chains match modules are restricted to.
+var matchChains = map[string][]string{
+	"owner":  {"OUTPUT", "POSTROUTING"},
+	"cgroup": {"INPUT", "OUTPUT", "POSTROUTING"},
+}
+
+// CheckChain returns an error if a match of the rule isn't valid in chain,
+// e.g. an owner match in INPUT. Since the chains a user-defined chain is
+// jumped into from aren't known, only built-in chains are checked.
+func (r *Rule) CheckChain(chain string) error {
+	if !isBuiltinChain(chain) {
+		return nil
+	}
+	for _, m := range r.matches {
+		if valid, ok := matchChains[m.module]; ok && !contains(valid, chain) {
+			return fmt.Errorf("%s match is not valid in chain %s, only in %s", m.module, chain, strings.Join(valid, ", "))
+		}
+	}
+	return nil
+}
+
+// checkRuleFamily returns an error if the addresses of r aren't of the
+// family of ipt.
+func (ipt *IPTables) checkRuleFamily(r *Rule) error {
+	for _, addr := range []*negatable{r.source, r.destination} {
+		if addr != nil && isIPv6(addr.value) != (ipt.proto == ProtocolIPv6) {
+			return fmt.Errorf("address %s doesn't match the family of %s", addr.value, getIptablesCommand(ipt.proto))
+		}
+	}
+	return nil
+}
+
+// String returns the rulespec as a single line, or the validation error.
+func (r *Rule) String() string {
+	args, err := r.Args()
+	if err != nil {
+		return "invalid rule: " + err.Error()
+	}
+	return joinRulespec(args)
+}
+
+// isIPv6 returns true if the address or network is an IPv6 one.
+func isIPv6(cidr string) bool {
+	return strings.IndexByte(cidr, ':') >= 0
+}
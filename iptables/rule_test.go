@@ -0,0 +1,174 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestRuleArgs(t *testing.T) {
+	testCases := []struct {
+		name    string
+		rule    *Rule
+		args    string
+		wantErr bool
+	}{
+		{
+			name: "ssh",
+			rule: NewRule().Protocol("tcp").DPort(22).Source("10.1.2.3/8").State("NEW").Comment("ssh access").Jump("ACCEPT"),
+			args: `-s 10.0.0.0/8 -p tcp -m tcp --dport 22 -m conntrack --ctstate NEW -m comment --comment "ssh access" -j ACCEPT`,
+		},
+		{
+			name: "parameters in any order",
+			rule: NewRule().Jump("DROP").DPort(53).OutInterface("eth0").Destination("2001:db8::1").Protocol("UDP"),
+			args: "-d 2001:db8::1/128 -o eth0 -p udp -m udp --dport 53 -j DROP",
+		},
+		{
+			name: "inverted",
+			rule: NewRule().Not().Source("10.0.0.1").Not().InInterface("lo").Protocol("tcp").Not().SPortRange(1000, 2000).Not().State("established", "related"),
+			args: "! -s 10.0.0.1/32 ! -i lo -p tcp -m tcp ! --sport 1000:2000 -m conntrack ! --ctstate RELATED,ESTABLISHED",
+		},
+		{
+			name: "multiport",
+			rule: NewRule().Protocol("tcp").SPort(1024).DPorts(80, 443).Match("mark", "--mark", "0x1").Goto("WEB"),
+			args: "-p tcp -m tcp --sport 1024 -m multiport --dports 80,443 -m mark --mark 0x1 -g WEB",
+		},
+		{
+			name: "target arguments",
+			rule: NewRule().Protocol("tcp").Jump("REJECT", "--reject-with", "tcp-reset"),
+			args: "-p tcp -j REJECT --reject-with tcp-reset",
+		},
+		{
+			name: "empty",
+			rule: NewRule(),
+			args: "",
+		},
+		{name: "port without protocol", rule: NewRule().DPort(22), wantErr: true},
+		{name: "port with icmp", rule: NewRule().Protocol("icmp").DPort(22), wantErr: true},
+		{name: "port with inverted protocol", rule: NewRule().Not().Protocol("tcp").DPort(22), wantErr: true},
+		{name: "invalid port", rule: NewRule().Protocol("tcp").DPort(65536), wantErr: true},
+		{name: "reversed range", rule: NewRule().Protocol("tcp").DPortRange(20, 10), wantErr: true},
+		{name: "ports set twice", rule: NewRule().Protocol("tcp").DPort(22).DPorts(80, 443), wantErr: true},
+		{name: "too many ports", rule: NewRule().Protocol("tcp").DPorts(1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16), wantErr: true},
+		{name: "invalid source", rule: NewRule().Source("10.0.0.300"), wantErr: true},
+		{name: "mixed families", rule: NewRule().Source("10.0.0.1").Destination("::1"), wantErr: true},
+		{name: "long interface", rule: NewRule().InInterface("abcdefghijklmnop"), wantErr: true},
+		{name: "unknown state", rule: NewRule().State("NEW", "BOGUS"), wantErr: true},
+		{name: "inverted comment", rule: NewRule().Not().Comment("x"), wantErr: true},
+		{name: "long comment", rule: NewRule().Comment(strings.Repeat("x", 256)), wantErr: true},
+		{name: "two targets", rule: NewRule().Jump("ACCEPT").Goto("X"), wantErr: true},
+		{name: "dangling not", rule: NewRule().Jump("ACCEPT").Not(), wantErr: true},
+	}
+
+	for _, tt := range testCases {
+		t.Run(tt.name, func(t *testing.T) {
+			args, err := tt.rule.Args()
+			if err == nil && tt.wantErr {
+				t.Fatalf("expected err, got %q", args)
+			} else if err != nil && !tt.wantErr {
+				t.Fatalf("unexpected err %s", err)
+			}
+			if tt.wantErr {
+				return
+			}
+			if got := joinRulespec(args); got != tt.args {
+				t.Fatalf("Args mismatch: \ngot  %s \nneed %s", got, tt.args)
+			}
+		})
+	}
+}
+
+func TestCheckChain(t *testing.T) {
+	owner := NewRule().SocketOwner(SocketOwner{UID: "1000"})
+	cgroup := NewRule().Cgroup("user.slice")
+	testCases := []struct {
+		rule    *Rule
+		chain   string
+		wantErr bool
+	}{
+		{owner, "OUTPUT", false},
+		{owner, "POSTROUTING", false},
+		{owner, "INPUT", true},
+		{owner, "PREROUTING", true},
+		{owner, "MY-CHAIN", false},
+		{cgroup, "INPUT", false},
+		{cgroup, "FORWARD", true},
+		{NewRule().Protocol("tcp"), "FORWARD", false},
+	}
+
+	for i, tt := range testCases {
+		t.Run(fmt.Sprint(i), func(t *testing.T) {
+			err := tt.rule.CheckChain(tt.chain)
+			if err == nil && tt.wantErr {
+				t.Fatal("expected err, got none")
+			} else if err != nil && !tt.wantErr {
+				t.Fatalf("unexpected err %s", err)
+			}
+		})
+	}
+}
+
+func TestRuleBuilder(t *testing.T) {
+	for i, ipt := range mustTestableIptables() {
+		t.Run(fmt.Sprint(i), func(t *testing.T) {
+			runRuleBuilderTests(t, ipt)
+		})
+	}
+}
+
+func runRuleBuilderTests(t *testing.T, ipt *IPTables) {
+	chain := randChain(t)
+	if err := ipt.NewChain("filter", chain); err != nil {
+		t.Fatalf("NewChain failed: %v", err)
+	}
+	defer func() {
+		if err := ipt.ClearAndDeleteChain("filter", chain); err != nil {
+			t.Fatalf("ClearAndDeleteChain failed: %v", err)
+		}
+	}()
+
+	source := "10.0.0.0/8"
+	if ipt.Proto() == ProtocolIPv6 {
+		source = "fd00::/8"
+	}
+	rule := NewRule().Protocol("tcp").DPort(22).Source(source).State("NEW").Comment("ssh").Jump("ACCEPT")
+	args, err := rule.Args()
+	if err != nil {
+		t.Fatalf("Args failed: %v", err)
+	}
+	if err := ipt.Append("filter", chain, args...); err != nil {
+		t.Fatalf("Append failed: %v", err)
+	}
+
+	exists, err := ipt.Exists("filter", chain, args...)
+	if err != nil {
+		t.Fatalf("Exists failed: %v", err)
+	}
+	if !exists {
+		t.Fatalf("Exists returned false for %q", args)
+	}
+
+	// the rule is listed exactly as built
+	state, err := ipt.chainState("filter", chain)
+	if err != nil {
+		t.Fatalf("chainState failed: %v", err)
+	}
+	if !reflect.DeepEqual(state.rules, [][]string{args}) {
+		t.Fatalf("listed rule mismatch: \ngot  %q \nneed %q", state.rules, [][]string{args})
+	}
+}
@@ -0,0 +1,47 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build go1.18
+// +build go1.18
+
+package iptables
+
+import (
+	"strings"
+	"testing"
+)
+
+// FuzzParseStatsListing checks that arbitrary listings never make the stats
+// parser panic. It is seeded with the outputs in testdata/stats.
+func FuzzParseStatsListing(f *testing.F) {
+	for _, data := range readStatsCorpus(f) {
+		f.Add(data)
+		for _, line := range strings.Split(data, "\n") {
+			f.Add(line)
+		}
+	}
+
+	ipt := &IPTables{}
+	f.Fuzz(func(t *testing.T, data string) {
+		chains, err := ipt.parseStatsListing(strings.Split(data, "\n"))
+		if err != nil {
+			return
+		}
+		for _, c := range chains {
+			if c.Rules == nil {
+				t.Fatalf("nil rules for chain %s", c.Chain)
+			}
+		}
+	})
+}
@@ -0,0 +1,143 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseStatLine(t *testing.T) {
+	testCases := []struct {
+		name string
+		in   string
+		out  []string
+		err  bool
+	}{
+		{
+			name: "plain",
+			in:   "     512    30720 ACCEPT     tcp  --  *      *       0.0.0.0/0            0.0.0.0/0            tcp dpt:22 state NEW /* allow ssh */",
+			out:  []string{"512", "30720", "ACCEPT", "tcp", "--", "*", "*", "0.0.0.0/0", "0.0.0.0/0", "tcp dpt:22 state NEW /* allow ssh */"},
+		},
+		{
+			name: "no target",
+			in:   "       7      420            all  --  eth+   *       10.0.0.0/8           0.0.0.0/0           ",
+			out:  []string{"7", "420", "", "all", "--", "eth+", "*", "10.0.0.0/8", "0.0.0.0/0", ""},
+		},
+		{
+			name: "overflowing counters",
+			in:   `12345678901 98765432109876 LOG        icmp --  *      *       0.0.0.0/0            0.0.0.0/0            limit: avg 3/min burst 5 LOG flags 0 level 4 prefix "ICMP: "`,
+			out:  []string{"12345678901", "98765432109876", "LOG", "icmp", "--", "*", "*", "0.0.0.0/0", "0.0.0.0/0", `limit: avg 3/min burst 5 LOG flags 0 level 4 prefix "ICMP: "`},
+		},
+		{
+			name: "negations",
+			in:   "       0        0 REJECT    !udp  !f  !eth0  *      !192.168.0.0/16       0.0.0.0/0           ",
+			out:  []string{"0", "0", "REJECT", "!udp", "!f", "!eth0", "*", "!192.168.0.0/16", "0.0.0.0/0", ""},
+		},
+		{
+			name: "empty ip6tables opt",
+			in:   "       0        0 ACCEPT     tcp      wg+    *      !2001:db8::/32        2001:db8:1::1        tcp dpt:443",
+			out:  []string{"0", "0", "ACCEPT", "tcp", "  ", "wg+", "*", "!2001:db8::/32", "2001:db8:1::1/128", "tcp dpt:443"},
+		},
+		{
+			name: "mapped IPv6 address",
+			in:   "       0        0 DROP       6    --  *      *       ::ffff:192.0.2.1     ::/0                 tcp dpt:25",
+			out:  []string{"0", "0", "DROP", "6", "--", "*", "*", "::ffff:192.0.2.1/128", "::/0", "tcp dpt:25"},
+		},
+		{
+			name: "empty",
+			in:   "",
+			err:  true,
+		},
+		{
+			name: "short",
+			in:   "       0        0 ACCEPT     all  --  *      *",
+			err:  true,
+		},
+		{
+			name: "column header",
+			in:   "    pkts      bytes target     prot opt in     out     source               destination         ",
+			err:  true,
+		},
+	}
+
+	for _, tt := range testCases {
+		t.Run(tt.name, func(t *testing.T) {
+			fields, err := parseStatLine(tt.in)
+			if err == nil && tt.err {
+				t.Fatal("expected err, got none")
+			} else if err != nil && !tt.err {
+				t.Fatalf("unexpected err %s", err)
+			}
+			if !reflect.DeepEqual(fields, tt.out) {
+				t.Fatalf("parseStatLine mismatch: \ngot  %#v \nneed %#v", fields, tt.out)
+			}
+		})
+	}
+}
+
+// readStatsCorpus returns the "iptables -L -n -v -x" outputs in
+// testdata/stats, keyed by file name.
+func readStatsCorpus(t testing.TB) map[string]string {
+	paths, err := filepath.Glob(filepath.Join("testdata", "stats", "*.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	corpus := map[string]string{}
+	for _, path := range paths {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		corpus[filepath.Base(path)] = string(data)
+	}
+	return corpus
+}
+
+func TestParseStatsCorpus(t *testing.T) {
+	corpus := readStatsCorpus(t)
+	if len(corpus) == 0 {
+		t.Fatal("empty stats corpus")
+	}
+
+	ipt := &IPTables{}
+	for name, data := range corpus {
+		t.Run(name, func(t *testing.T) {
+			lines := strings.Split(strings.TrimSuffix(data, "\n"), "\n")
+			chains, err := ipt.parseStatsListing(lines)
+			if err != nil {
+				t.Fatalf("parseStatsListing failed: %v", err)
+			}
+
+			rules := 0
+			for _, line := range lines {
+				fields := strings.Fields(line)
+				if len(fields) > 0 && isDigits(fields[0]) {
+					rules++
+				}
+			}
+			parsed := 0
+			for _, c := range chains {
+				parsed += len(c.Rules)
+			}
+			if parsed != rules {
+				t.Fatalf("expected %d rules, parsed %d", rules, parsed)
+			}
+		})
+	}
+}
@@ -0,0 +1,215 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables
+
+import "fmt"
+
+const (
+	tproxyPrefix       = "TPX-"
+	tproxyDivertPrefix = "TPX-DIV-"
+)
+
+// TransparentProxy intercepts packets in mangle PREROUTING and delivers
+// them to a local transparent proxy with TPROXY, as described in the
+// kernel's tproxy documentation. Packets of connections that already have a
+// transparent socket are diverted to a chain marking them, so that they
+// skip TPROXY. Delivering marked packets locally also requires policy
+// routing, which is left to the caller, e.g. for IPv4:
+//
+//	ip rule add fwmark 0x1/0x1 lookup 100
+//	ip route add local 0.0.0.0/0 dev lo table 100
+type TransparentProxy struct {
+	// Name identifies the chains of the proxy and must be unique.
+	Name string
+	// Port is the port the proxy listens on.
+	Port int
+	// Mark and Mask set the bits of Mask in the mark of intercepted
+	// packets to Mark. Mask defaults to 0xffffffff.
+	Mark uint32
+	Mask uint32
+	// Protocols are the intercepted protocols. They default to tcp.
+	Protocols []string
+	// Ports are the intercepted destination ports. All ports are
+	// intercepted if empty.
+	Ports []int
+	// InInterface restricts interception to the packets received on an
+	// interface.
+	InInterface string
+}
+
+// NewTransparentProxy returns a TransparentProxy for the proxy name,
+// listening on port and marking packets with mark. Nothing is changed until
+// Setup is called.
+func NewTransparentProxy(name string, port int, mark uint32) *TransparentProxy {
+	return &TransparentProxy{Name: name, Port: port, Mark: mark, Protocols: []string{"tcp"}}
+}
+
+// Chain returns the name of the chain applying TPROXY.
+func (tp *TransparentProxy) Chain() string {
+	return tproxyPrefix + chainHash(tp.Name, 16)
+}
+
+// DivertChain returns the name of the chain marking the packets of
+// connections to a transparent socket.
+func (tp *TransparentProxy) DivertChain() string {
+	return tproxyDivertPrefix + chainHash(tp.Name, 16)
+}
+
+func (tp *TransparentProxy) mask() uint32 {
+	if tp.Mask == 0 {
+		return 0xffffffff
+	}
+	return tp.Mask
+}
+
+// protocols returns the intercepted protocols.
+func (tp *TransparentProxy) protocols() []string {
+	if len(tp.Protocols) == 0 {
+		return []string{"tcp"}
+	}
+	return tp.Protocols
+}
+
+// match returns the rule matching the intercepted packets of protocol.
+func (tp *TransparentProxy) match(protocol string) *Rule {
+	r := NewRule()
+	if tp.InInterface != "" {
+		r.InInterface(tp.InInterface)
+	}
+	r.Protocol(protocol)
+	switch len(tp.Ports) {
+	case 0:
+	case 1:
+		r.DPort(tp.Ports[0])
+	default:
+		r.DPorts(tp.Ports...)
+	}
+	return r
+}
+
+// tproxyRules are the rules of the proxy for a family.
+type tproxyRules struct {
+	divert [][]string
+	tproxy [][]string
+	// jumps are the rules of mangle PREROUTING, jumps into the divert
+	// chain first
+	jumps [][]string
+}
+
+// rules returns the rules of the proxy for the family of ipt.
+func (tp *TransparentProxy) rules(ipt *IPTables) (*tproxyRules, error) {
+	if tp.Mark == 0 {
+		return nil, fmt.Errorf("transparent proxy requires a mark")
+	}
+	mark, err := ipt.MangleRulespec(tp.DivertChain(), nil, Mark{Value: tp.Mark, Mask: tp.mask()})
+	if err != nil {
+		return nil, err
+	}
+	rules := &tproxyRules{divert: [][]string{mark, {"-j", "ACCEPT"}}}
+
+	seen := map[string]bool{}
+	for _, protocol := range tp.protocols() {
+		if seen[protocol] {
+			return nil, fmt.Errorf("duplicate protocol %s", protocol)
+		}
+		seen[protocol] = true
+
+		socket, err := NewRule().Protocol(protocol).Socket(Socket{Transparent: true}).Jump(tp.DivertChain()).Args()
+		if err != nil {
+			return nil, err
+		}
+		rules.jumps = append(rules.jumps, socket)
+
+		rule, err := ipt.MangleRulespec("PREROUTING", tp.match(protocol), TProxy{Port: tp.Port, Mark: tp.Mark, Mask: tp.mask()})
+		if err != nil {
+			return nil, err
+		}
+		rules.tproxy = append(rules.tproxy, rule)
+	}
+	rules.jumps = append(rules.jumps, []string{"-j", tp.Chain()})
+	return rules, nil
+}
+
+// Setup installs the rules of the proxy for the family of each of ipts, in
+// a single iptables-restore per family. It is idempotent: rules already
+// installed keep their counters, and the jumps from mangle PREROUTING are
+// kept next to each other, the jumps into the divert chain first, so that
+// packets of transparent connections never reach TPROXY. They are appended
+// if missing.
+func (tp *TransparentProxy) Setup(ipts ...*IPTables) error {
+	for _, ipt := range ipts {
+		rules, err := tp.rules(ipt)
+		if err != nil {
+			return err
+		}
+		ops, err := ipt.rewriteChainOps("mangle", tp.DivertChain(), rules.divert)
+		if err != nil {
+			return err
+		}
+		tproxyOps, err := ipt.rewriteChainOps("mangle", tp.Chain(), rules.tproxy)
+		if err != nil {
+			return err
+		}
+		ops = append(ops, tproxyOps...)
+
+		state, err := ipt.chainState("mangle", "PREROUTING")
+		if err != nil {
+			return err
+		}
+		ops = append(ops, planRuleBlock("mangle", "PREROUTING", rules.jumps, 0, state)...)
+
+		if err := ipt.restore(restoreScript(ops), false); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Teardown removes the rules and chains of the proxy for the family of
+// each of ipts. It is not an error if they don't exist.
+func (tp *TransparentProxy) Teardown(ipts ...*IPTables) error {
+	chains := []string{tp.DivertChain(), tp.Chain()}
+	for _, ipt := range ipts {
+		state, err := ipt.chainState("mangle", "PREROUTING")
+		if err != nil {
+			return err
+		}
+		var ops []Operation
+		for i := len(state.rules) - 1; i >= 0; i-- {
+			if target, _ := ruleTarget(state.rules[i]); contains(chains, target) {
+				ops = append(ops, Operation{Kind: OpDeleteRule, Table: "mangle", Chain: "PREROUTING", Position: i + 1, Rulespec: state.rules[i]})
+			}
+		}
+		for _, chain := range chains {
+			exists, err := ipt.ChainExists("mangle", chain)
+			if err != nil {
+				return err
+			}
+			if exists {
+				ops = append(ops,
+					Operation{Kind: opFlushChain, Table: "mangle", Chain: chain},
+					Operation{Kind: opDeleteChain, Table: "mangle", Chain: chain},
+				)
+			}
+		}
+		if len(ops) == 0 {
+			continue
+		}
+		if err := ipt.restore(restoreScript(ops), false); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,136 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+func TestTransparentProxyRules(t *testing.T) {
+	tp := NewTransparentProxy("sidecar", 15001, 0x1)
+	tp.Mask = 0x1
+	tp.Protocols = []string{"tcp", "udp"}
+	tp.Ports = []int{80, 443}
+	tp.InInterface = "eth0"
+
+	rules, err := tp.rules(&IPTables{proto: ProtocolIPv6})
+	if err != nil {
+		t.Fatalf("rules failed: %v", err)
+	}
+	render := func(rules [][]string) []string {
+		var out []string
+		for _, rule := range rules {
+			out = append(out, joinRulespec(rule))
+		}
+		return out
+	}
+
+	divert := []string{"-j MARK --set-xmark 0x1/0x1", "-j ACCEPT"}
+	if got := render(rules.divert); !reflect.DeepEqual(got, divert) {
+		t.Fatalf("divert rules mismatch: \ngot  %q \nneed %q", got, divert)
+	}
+	tproxy := []string{
+		"-i eth0 -p tcp -m multiport --dports 80,443 -j TPROXY --on-port 15001 --on-ip :: --tproxy-mark 0x1/0x1",
+		"-i eth0 -p udp -m multiport --dports 80,443 -j TPROXY --on-port 15001 --on-ip :: --tproxy-mark 0x1/0x1",
+	}
+	if got := render(rules.tproxy); !reflect.DeepEqual(got, tproxy) {
+		t.Fatalf("tproxy rules mismatch: \ngot  %q \nneed %q", got, tproxy)
+	}
+	jumps := []string{
+		"-p tcp -m socket --transparent -j " + tp.DivertChain(),
+		"-p udp -m socket --transparent -j " + tp.DivertChain(),
+		"-j " + tp.Chain(),
+	}
+	if got := render(rules.jumps); !reflect.DeepEqual(got, jumps) {
+		t.Fatalf("jumps mismatch: \ngot  %q \nneed %q", got, jumps)
+	}
+
+	for name, bad := range map[string]*TransparentProxy{
+		"no mark":            {Name: "x", Port: 1},
+		"invalid port":       {Name: "x", Port: 70000, Mark: 1},
+		"duplicate protocol": {Name: "x", Port: 1, Mark: 1, Protocols: []string{"tcp", "tcp"}},
+		"icmp":               {Name: "x", Port: 1, Mark: 1, Protocols: []string{"icmp"}},
+	} {
+		if _, err := bad.rules(&IPTables{proto: ProtocolIPv4}); err == nil {
+			t.Fatalf("expected err for %s, got none", name)
+		}
+	}
+}
+
+func TestTransparentProxy(t *testing.T) {
+	for i, ipt := range mustTestableIptables() {
+		t.Run(fmt.Sprint(i), func(t *testing.T) {
+			runTransparentProxyTests(t, ipt)
+		})
+	}
+}
+
+func runTransparentProxyTests(t *testing.T, ipt *IPTables) {
+	tp := NewTransparentProxy(randChain(t), 15001, 0x1)
+	tp.Ports = []int{80}
+
+	// setting up twice leaves a single copy of every rule
+	for i := 0; i < 2; i++ {
+		if err := tp.Setup(ipt); err != nil {
+			t.Fatalf("Setup failed: %v", err)
+		}
+	}
+	rules, err := tp.rules(ipt)
+	if err != nil {
+		t.Fatalf("rules failed: %v", err)
+	}
+	for chain, need := range map[string][][]string{tp.DivertChain(): rules.divert, tp.Chain(): rules.tproxy} {
+		state, err := ipt.chainState("mangle", chain)
+		if err != nil {
+			t.Fatalf("chainState failed: %v", err)
+		}
+		if !reflect.DeepEqual(state.rules, need) {
+			t.Fatalf("rules of %s mismatch: \ngot  %q \nneed %q", chain, state.rules, need)
+		}
+	}
+
+	// a lost divert jump is restored ahead of the TPROXY jump
+	if err := ipt.Delete("mangle", "PREROUTING", rules.jumps[0]...); err != nil {
+		t.Fatalf("Delete failed: %v", err)
+	}
+	if err := tp.Setup(ipt); err != nil {
+		t.Fatalf("Setup failed: %v", err)
+	}
+	state, err := ipt.chainState("mangle", "PREROUTING")
+	if err != nil {
+		t.Fatalf("chainState failed: %v", err)
+	}
+	if ops := planRuleBlock("mangle", "PREROUTING", rules.jumps, 0, state); len(ops) != 0 {
+		t.Fatalf("PREROUTING jumps not in place: %v", ops)
+	}
+
+	if err := tp.Teardown(ipt); err != nil {
+		t.Fatalf("Teardown failed: %v", err)
+	}
+	for _, chain := range []string{tp.DivertChain(), tp.Chain()} {
+		exists, err := ipt.ChainExists("mangle", chain)
+		if err != nil {
+			t.Fatalf("ChainExists failed: %v", err)
+		}
+		if exists {
+			t.Fatalf("Teardown left chain %s", chain)
+		}
+	}
+	if err := tp.Teardown(ipt); err != nil {
+		t.Fatalf("second Teardown failed: %v", err)
+	}
+}
@@ -0,0 +1,203 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RuleKey identifies a rule across samples. Rules have no identity of their
+// own, so a rule is identified by everything listed for it except its
+// counters. Identical rules in the same chain are told apart by their
+// occurrence number, starting at 0.
+type RuleKey struct {
+	Table      string
+	Chain      string
+	Rule       string
+	Occurrence int
+}
+
+// statIdentity returns the canonical identity of the rule of a statistic.
+func statIdentity(s Stat) string {
+	cidr := func(n *InvertibleIPNet) string {
+		if n == nil {
+			return ""
+		}
+		return n.String()
+	}
+	return strings.Join([]string{
+		s.Target, s.Protocol, s.Opt, s.Input, s.Output,
+		cidr(s.Source), cidr(s.Destination), s.Options,
+	}, " ")
+}
+
+// CounterDelta is the change of the counters of a rule between two samples.
+type CounterDelta struct {
+	Key  RuleKey
+	Stat Stat
+	// Packets and Bytes are the counter increases since the previous sample.
+	// After a reset, they are the current counters.
+	Packets uint64
+	Bytes   uint64
+	// PacketRate and ByteRate are the increases per second.
+	PacketRate float64
+	ByteRate   float64
+	// Interval is the time elapsed since the previous sample.
+	Interval time.Duration
+	// New is set if the rule wasn't part of the previous sample. Its deltas
+	// and rates are zero.
+	New bool
+	// Reset is set if the counters went down since the previous sample,
+	// e.g. because the counters were zeroed or the chain was flushed and
+	// the rule recreated.
+	Reset bool
+}
+
+// CounterReport is the result of recording a sample.
+type CounterReport struct {
+	Deltas []CounterDelta
+	// Removed lists the rules of the previous sample that are gone.
+	Removed []RuleKey
+}
+
+type counterSample struct {
+	packets, bytes uint64
+	time           time.Time
+}
+
+// CounterTracker keeps the previous counter samples of chains to compute
+// per-rule deltas and rates. It is safe for concurrent use.
+type CounterTracker struct {
+	mu     sync.Mutex
+	chains map[tableChain]map[RuleKey]counterSample
+}
+
+// NewCounterTracker returns an empty CounterTracker.
+func NewCounterTracker() *CounterTracker {
+	return &CounterTracker{chains: map[tableChain]map[RuleKey]counterSample{}}
+}
+
+// Observe records the statistics of table/chain, as returned by
+// StructuredStats, sampled at time t.
+func (c *CounterTracker) Observe(table, chain string, stats []Stat, t time.Time) CounterReport {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.observe(table, chain, stats, t)
+}
+
+// ObserveTable records the statistics of every chain of table, as returned
+// by TableStats, sampled at time t. Chains of the previous sample that are
+// missing are reported as removed.
+func (c *CounterTracker) ObserveTable(table string, stats map[string]*ChainStats, t time.Time) CounterReport {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var report CounterReport
+	for tc, prev := range c.chains {
+		if tc.table != table {
+			continue
+		}
+		if _, ok := stats[tc.chain]; !ok {
+			for key := range prev {
+				report.Removed = append(report.Removed, key)
+			}
+			delete(c.chains, tc)
+		}
+	}
+
+	chains := make([]string, 0, len(stats))
+	for chain := range stats {
+		chains = append(chains, chain)
+	}
+	sort.Strings(chains)
+	for _, chain := range chains {
+		r := c.observe(table, chain, stats[chain].Rules, t)
+		report.Deltas = append(report.Deltas, r.Deltas...)
+		report.Removed = append(report.Removed, r.Removed...)
+	}
+	sortRuleKeys(report.Removed)
+	return report
+}
+
+func (c *CounterTracker) observe(table, chain string, stats []Stat, t time.Time) CounterReport {
+	tc := tableChain{table, chain}
+	prev := c.chains[tc]
+	cur := make(map[RuleKey]counterSample, len(stats))
+	occurrences := map[string]int{}
+
+	var report CounterReport
+	for _, stat := range stats {
+		identity := statIdentity(stat)
+		key := RuleKey{Table: table, Chain: chain, Rule: identity, Occurrence: occurrences[identity]}
+		occurrences[identity]++
+		cur[key] = counterSample{stat.Packets, stat.Bytes, t}
+
+		delta := CounterDelta{Key: key, Stat: stat}
+		last, ok := prev[key]
+		switch {
+		case !ok:
+			delta.New = true
+		case stat.Packets < last.packets || stat.Bytes < last.bytes:
+			delta.Reset = true
+			delta.Packets, delta.Bytes = stat.Packets, stat.Bytes
+		default:
+			delta.Packets, delta.Bytes = stat.Packets-last.packets, stat.Bytes-last.bytes
+		}
+		if ok {
+			delta.Interval = t.Sub(last.time)
+			if secs := delta.Interval.Seconds(); secs > 0 {
+				delta.PacketRate = float64(delta.Packets) / secs
+				delta.ByteRate = float64(delta.Bytes) / secs
+			}
+		}
+		report.Deltas = append(report.Deltas, delta)
+	}
+
+	for key := range prev {
+		if _, ok := cur[key]; !ok {
+			report.Removed = append(report.Removed, key)
+		}
+	}
+	sortRuleKeys(report.Removed)
+
+	c.chains[tc] = cur
+	return report
+}
+
+// Forget drops the samples of table/chain.
+func (c *CounterTracker) Forget(table, chain string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.chains, tableChain{table, chain})
+}
+
+func sortRuleKeys(keys []RuleKey) {
+	sort.Slice(keys, func(i, j int) bool {
+		a, b := keys[i], keys[j]
+		if a.Table != b.Table {
+			return a.Table < b.Table
+		}
+		if a.Chain != b.Chain {
+			return a.Chain < b.Chain
+		}
+		if a.Rule != b.Rule {
+			return a.Rule < b.Rule
+		}
+		return a.Occurrence < b.Occurrence
+	})
+}
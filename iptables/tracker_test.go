@@ -0,0 +1,69 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCounterTracker(t *testing.T) {
+	anywhere, _ := ParseInvertibleNet("0.0.0.0/0")
+	ssh := Stat{Target: "ACCEPT", Protocol: "tcp", Opt: "--", Input: "*", Output: "*", Source: anywhere, Destination: anywhere, Options: "tcp dpt:22"}
+	drop := Stat{Target: "DROP", Protocol: "all", Opt: "--", Input: "*", Output: "*", Source: anywhere, Destination: anywhere}
+	with := func(s Stat, packets, bytes uint64) Stat {
+		s.Packets, s.Bytes = packets, bytes
+		return s
+	}
+
+	tracker := NewCounterTracker()
+	start := time.Unix(1700000000, 0)
+
+	report := tracker.Observe("filter", "INPUT", []Stat{with(ssh, 10, 1000), with(drop, 5, 500), with(drop, 1, 100)}, start)
+	if len(report.Deltas) != 3 || len(report.Removed) != 0 {
+		t.Fatalf("unexpected first report: %#v", report)
+	}
+	for _, d := range report.Deltas {
+		if !d.New {
+			t.Fatalf("expected rule to be new: %#v", d)
+		}
+	}
+	if report.Deltas[2].Key.Occurrence != 1 {
+		t.Fatalf("expected second DROP rule to have occurrence 1, got %d", report.Deltas[2].Key.Occurrence)
+	}
+
+	report = tracker.Observe("filter", "INPUT", []Stat{with(ssh, 30, 3000), with(drop, 2, 200)}, start.Add(10*time.Second))
+	if len(report.Deltas) != 2 {
+		t.Fatalf("expected 2 deltas, got %#v", report.Deltas)
+	}
+	d := report.Deltas[0]
+	if d.New || d.Reset || d.Packets != 20 || d.Bytes != 2000 || d.PacketRate != 2 || d.ByteRate != 200 || d.Interval != 10*time.Second {
+		t.Fatalf("unexpected delta for ssh rule: %#v", d)
+	}
+	d = report.Deltas[1]
+	if !d.Reset || d.Packets != 2 || d.Bytes != 200 {
+		t.Fatalf("expected reset for drop rule: %#v", d)
+	}
+	if len(report.Removed) != 1 || report.Removed[0].Occurrence != 1 {
+		t.Fatalf("expected second drop rule to be removed, got %#v", report.Removed)
+	}
+
+	report = tracker.ObserveTable("filter", map[string]*ChainStats{
+		"FORWARD": {Chain: "FORWARD", Rules: []Stat{with(drop, 0, 0)}},
+	}, start.Add(20*time.Second))
+	if len(report.Removed) != 2 || len(report.Deltas) != 1 || !report.Deltas[0].New {
+		t.Fatalf("unexpected table report: %#v", report)
+	}
+}
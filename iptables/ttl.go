@@ -0,0 +1,164 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// expiryCommentPrefix prefixes the expiry comment of rules added with
+// AppendWithTTL. It is followed by the expiry time in seconds since the epoch.
+const expiryCommentPrefix = "expires="
+
+// defaultReapInterval is the interval of a Reaper without a valid Interval.
+const defaultReapInterval = time.Minute
+
+// ExpiredRule is a rule removed because its TTL elapsed.
+type ExpiredRule struct {
+	Table string
+	Chain string
+	// Rulespec is the rule as listed, including its expiry comment.
+	Rulespec []string
+	Expires  time.Time
+}
+
+// AppendWithTTL appends rulespec to specified table/chain, tagged with a
+// comment recording when the rule expires. Since the expiry is stored in
+// the rule itself, it survives restarts of the calling process. Expired
+// rules are removed by ReapExpired or a Reaper.
+func (ipt *IPTables) AppendWithTTL(table, chain string, ttl time.Duration, rulespec ...string) error {
+	if ttl <= 0 {
+		return fmt.Errorf("invalid TTL %v", ttl)
+	}
+	expires := time.Now().Add(ttl).Unix()
+	return ipt.Append(table, chain, withComment(rulespec, expiryCommentPrefix+strconv.FormatInt(expires, 10))...)
+}
+
+// ReapExpired deletes the rules of table/chain whose expiry is at or before
+// now, and returns them. Rules that disappear while being reaped are
+// skipped.
+func (ipt *IPTables) ReapExpired(table, chain string, now time.Time) ([]ExpiredRule, error) {
+	state, err := ipt.chainState(table, chain)
+	if err != nil {
+		return nil, err
+	}
+
+	var reaped []ExpiredRule
+	for _, rule := range state.rules {
+		expires, ok := ruleExpiry(rule)
+		if !ok || expires.After(now) {
+			continue
+		}
+		if err := ipt.Delete(table, chain, rule...); err != nil {
+			if eerr, ok := err.(*Error); ok && eerr.IsNotExist() {
+				continue
+			}
+			return reaped, err
+		}
+		reaped = append(reaped, ExpiredRule{Table: table, Chain: chain, Rulespec: rule, Expires: expires})
+	}
+	return reaped, nil
+}
+
+// ruleExpiry returns the expiry time recorded in a rule by AppendWithTTL.
+func ruleExpiry(rulespec []string) (time.Time, bool) {
+	for i := 0; i+1 < len(rulespec); i++ {
+		if rulespec[i] != "--comment" || !strings.HasPrefix(rulespec[i+1], expiryCommentPrefix) {
+			continue
+		}
+		secs, err := strconv.ParseInt(strings.TrimPrefix(rulespec[i+1], expiryCommentPrefix), 10, 64)
+		if err != nil {
+			continue
+		}
+		return time.Unix(secs, 0), true
+	}
+	return time.Time{}, false
+}
+
+// Reaper periodically removes expired rules from a set of chains.
+type Reaper struct {
+	ipt    *IPTables
+	chains []tableChain
+
+	// Interval is the time between two scans. It defaults to a minute if
+	// not positive.
+	Interval time.Duration
+	// OnRemove, if set, is called for every rule removed.
+	OnRemove func(ExpiredRule)
+	// OnError, if set, is called when scanning a chain fails.
+	OnError func(error)
+}
+
+// NewReaper returns a Reaper scanning the given chains of table every
+// interval. More chains can be added with Watch before calling Run.
+func (ipt *IPTables) NewReaper(interval time.Duration, table string, chains ...string) *Reaper {
+	r := &Reaper{ipt: ipt, Interval: interval}
+	for _, chain := range chains {
+		r.Watch(table, chain)
+	}
+	return r
+}
+
+// Watch adds table/chain to the chains scanned by the reaper.
+func (r *Reaper) Watch(table, chain string) {
+	r.chains = append(r.chains, tableChain{table, chain})
+}
+
+// Reap scans every watched chain once. A failure to scan one chain doesn't
+// prevent the others from being scanned; the first error is returned.
+func (r *Reaper) Reap() error {
+	var firstErr error
+	now := time.Now()
+	for _, tc := range r.chains {
+		reaped, err := r.ipt.ReapExpired(tc.table, tc.chain, now)
+		if r.OnRemove != nil {
+			for _, rule := range reaped {
+				r.OnRemove(rule)
+			}
+		}
+		if err != nil {
+			if r.OnError != nil {
+				r.OnError(err)
+			}
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+	return firstErr
+}
+
+// Run scans the watched chains every Interval until ctx is done. It is
+// meant to be run in its own goroutine.
+func (r *Reaper) Run(ctx context.Context) {
+	interval := r.Interval
+	if interval <= 0 {
+		interval = defaultReapInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		_ = r.Reap()
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,111 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestRuleExpiry(t *testing.T) {
+	expires, ok := ruleExpiry([]string{"-s", "192.0.2.1/32", "-m", "comment", "--comment", "expires=1700000000", "-j", "DROP"})
+	if !ok {
+		t.Fatal("ruleExpiry didn't find the expiry")
+	}
+	if !expires.Equal(time.Unix(1700000000, 0)) {
+		t.Fatalf("expected expiry 1700000000, got %v", expires.Unix())
+	}
+
+	for _, spec := range [][]string{
+		{"-j", "DROP"},
+		{"-m", "comment", "--comment", "expires=soon", "-j", "DROP"},
+		{"-m", "comment", "--comment", "app:expires=1", "-j", "DROP"},
+	} {
+		if _, ok := ruleExpiry(spec); ok {
+			t.Fatalf("ruleExpiry found an expiry in %v", spec)
+		}
+	}
+}
+
+func TestReaperInterval(t *testing.T) {
+	// a reaper without an interval falls back to the default instead of
+	// panicking
+	for _, interval := range []time.Duration{0, -time.Second} {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		r := (&IPTables{}).NewReaper(interval, "filter")
+		r.Run(ctx)
+	}
+}
+
+func TestReapExpired(t *testing.T) {
+	for i, ipt := range mustTestableIptables() {
+		t.Run(fmt.Sprint(i), func(t *testing.T) {
+			runReapExpiredTests(t, ipt)
+		})
+	}
+}
+
+func runReapExpiredTests(t *testing.T, ipt *IPTables) {
+	chain := randChain(t)
+	if err := ipt.NewChain("filter", chain); err != nil {
+		t.Fatalf("NewChain failed: %v", err)
+	}
+	defer func() {
+		if err := ipt.ClearAndDeleteChain("filter", chain); err != nil {
+			t.Fatalf("ClearAndDeleteChain failed: %v", err)
+		}
+	}()
+
+	if err := ipt.AppendWithTTL("filter", chain, time.Minute, "-p", "tcp", "-j", "DROP"); err != nil {
+		t.Fatalf("AppendWithTTL failed: %v", err)
+	}
+	if err := ipt.AppendWithTTL("filter", chain, time.Hour, "-p", "udp", "-j", "DROP"); err != nil {
+		t.Fatalf("AppendWithTTL failed: %v", err)
+	}
+	if err := ipt.Append("filter", chain, "-j", "RETURN"); err != nil {
+		t.Fatalf("Append failed: %v", err)
+	}
+
+	var removed []ExpiredRule
+	r := ipt.NewReaper(time.Second, "filter", chain)
+	r.OnRemove = func(rule ExpiredRule) {
+		removed = append(removed, rule)
+	}
+	if err := r.Reap(); err != nil {
+		t.Fatalf("Reap failed: %v", err)
+	}
+	if len(removed) != 0 {
+		t.Fatalf("Reap removed unexpired rules: %v", removed)
+	}
+
+	reaped, err := ipt.ReapExpired("filter", chain, time.Now().Add(2*time.Minute))
+	if err != nil {
+		t.Fatalf("ReapExpired failed: %v", err)
+	}
+	if len(reaped) != 1 || reaped[0].Rulespec[1] != "tcp" {
+		t.Fatalf("expected the tcp rule to be reaped, got %v", reaped)
+	}
+
+	rules, err := ipt.List("filter", chain)
+	if err != nil {
+		t.Fatalf("List failed: %v", err)
+	}
+	if len(rules) != 3 {
+		t.Fatalf("expected chain and 2 rules to remain, got %#v", rules)
+	}
+}
@@ -0,0 +1,373 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// RuleCounters are the counters of a rule in a CounterSnapshot.
+type RuleCounters struct {
+	// Rule identifies the rule within its chain: the rulespec for snapshots
+	// parsed from iptables-save output, or the listed columns for snapshots
+	// taken from statistics.
+	Rule    string `json:"rule"`
+	Target  string `json:"target,omitempty"`
+	Packets uint64 `json:"pkts"`
+	Bytes   uint64 `json:"bytes"`
+}
+
+// ChainCounters are the counters of a chain in a CounterSnapshot.
+type ChainCounters struct {
+	// Policy is empty for user-defined chains.
+	Policy        string         `json:"policy,omitempty"`
+	PolicyPackets uint64         `json:"policy_pkts"`
+	PolicyBytes   uint64         `json:"policy_bytes"`
+	Rules         []RuleCounters `json:"rules"`
+}
+
+// CounterSnapshot holds the counters of every chain of a table at a point
+// in time.
+type CounterSnapshot struct {
+	Time   time.Time                 `json:"time"`
+	Table  string                    `json:"table"`
+	Chains map[string]*ChainCounters `json:"chains"`
+}
+
+// NewCounterSnapshot returns a snapshot of the statistics of table, as
+// returned by TableStats, taken at time t.
+func NewCounterSnapshot(table string, stats map[string]*ChainStats, t time.Time) *CounterSnapshot {
+	snap := &CounterSnapshot{Time: t, Table: table, Chains: make(map[string]*ChainCounters, len(stats))}
+	for chain, cs := range stats {
+		c := &ChainCounters{Policy: cs.Policy, PolicyPackets: cs.PolicyPackets, PolicyBytes: cs.PolicyBytes}
+		for _, s := range cs.Rules {
+			c.Rules = append(c.Rules, RuleCounters{Rule: statIdentity(s), Target: s.Target, Packets: s.Packets, Bytes: s.Bytes})
+		}
+		snap.Chains[chain] = c
+	}
+	return snap
+}
+
+// SnapshotCounters returns a snapshot of the counters of table, taken now.
+func (ipt *IPTables) SnapshotCounters(table string) (*CounterSnapshot, error) {
+	stats, err := ipt.TableStats(table)
+	if err != nil {
+		return nil, err
+	}
+	return NewCounterSnapshot(table, stats, time.Now()), nil
+}
+
+// saveCountersRegex matches the "[packets:bytes]" counters of
+// "iptables-save -c" output.
+var saveCountersRegex = regexp.MustCompile(`^\[([0-9]+):([0-9]+)\]$`)
+
+// ParseSaveCounters parses the output of "iptables-save -c", taken at time
+// t, into one snapshot per table.
+func ParseSaveCounters(r io.Reader, t time.Time) ([]*CounterSnapshot, error) {
+	var (
+		snaps []*CounterSnapshot
+		cur   *CounterSnapshot
+	)
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, 1024*1024)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		switch {
+		case line == "" || strings.HasPrefix(line, "#") || line == "COMMIT":
+			continue
+		case strings.HasPrefix(line, "*"):
+			cur = &CounterSnapshot{Time: t, Table: line[1:], Chains: map[string]*ChainCounters{}}
+			snaps = append(snaps, cur)
+			continue
+		case cur == nil:
+			return nil, fmt.Errorf("line outside of a table: %q", line)
+		}
+
+		args, err := splitRulespec(line)
+		if err != nil {
+			return nil, err
+		}
+		switch {
+		case strings.HasPrefix(line, ":") && len(args) == 3:
+			// :CHAIN POLICY [packets:bytes]
+			packets, bytes, err := parseSaveCounters(args[2])
+			if err != nil {
+				return nil, err
+			}
+			c := &ChainCounters{}
+			if args[1] != "-" {
+				c.Policy, c.PolicyPackets, c.PolicyBytes = args[1], packets, bytes
+			}
+			cur.Chains[args[0][1:]] = c
+		case len(args) >= 3 && args[1] == "-A":
+			// [packets:bytes] -A CHAIN rulespec
+			packets, bytes, err := parseSaveCounters(args[0])
+			if err != nil {
+				return nil, err
+			}
+			c, ok := cur.Chains[args[2]]
+			if !ok {
+				return nil, fmt.Errorf("rule for undeclared chain %s: %q", args[2], line)
+			}
+			target, _ := ruleTarget(args[3:])
+			c.Rules = append(c.Rules, RuleCounters{Rule: joinRulespec(args[3:]), Target: target, Packets: packets, Bytes: bytes})
+		default:
+			return nil, fmt.Errorf("could not parse line %q", line)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return snaps, nil
+}
+
+func parseSaveCounters(s string) (uint64, uint64, error) {
+	groups := saveCountersRegex.FindStringSubmatch(s)
+	if groups == nil {
+		return 0, 0, fmt.Errorf("could not parse counters %q", s)
+	}
+	packets, err := strconv.ParseUint(groups[1], 10, 64)
+	if err != nil {
+		return 0, 0, fmt.Errorf("could not parse packets: %v", err)
+	}
+	bytes, err := strconv.ParseUint(groups[2], 10, 64)
+	if err != nil {
+		return 0, 0, fmt.Errorf("could not parse bytes: %v", err)
+	}
+	return packets, bytes, nil
+}
+
+// UnusedRule is a rule whose packet counter didn't grow.
+type UnusedRule struct {
+	Table    string `json:"table"`
+	Chain    string `json:"chain"`
+	Position int    `json:"position"`
+	Rule     string `json:"rule"`
+	Target   string `json:"target,omitempty"`
+	// Since is the time of the first sample the rule was seen in.
+	Since time.Time `json:"since"`
+}
+
+// UnusedChain is a user-defined chain that no packet jumped into.
+type UnusedChain struct {
+	Table string `json:"table"`
+	Chain string `json:"chain"`
+	// References is the number of rules jumping into the chain. If zero,
+	// the chain is unreachable.
+	References int `json:"references"`
+}
+
+// UnusedPolicy is the policy of a built-in chain that no packet hit.
+type UnusedPolicy struct {
+	Table  string `json:"table"`
+	Chain  string `json:"chain"`
+	Policy string `json:"policy"`
+}
+
+// UsageReport lists the rules, chains and policies that didn't match any
+// packet over a window.
+type UsageReport struct {
+	Start          time.Time      `json:"start"`
+	End            time.Time      `json:"end"`
+	UnusedRules    []UnusedRule   `json:"unused_rules"`
+	UnusedChains   []UnusedChain  `json:"unused_chains"`
+	UnusedPolicies []UnusedPolicy `json:"unused_policies"`
+}
+
+// AnalyzeUsage compares counter snapshots taken over a window and reports
+// the rules whose packet counter didn't grow, the user-defined chains no
+// packet jumped into and the policies no packet hit. Snapshots may cover
+// several tables; the snapshots of a table must all come from the same
+// source (statistics or iptables-save). The last snapshot of each table
+// defines the rules reported on. Rules seen in a single snapshot are not
+// reported, as nothing can be said about their growth.
+//
+// Counters that went down between two snapshots, e.g. because they were
+// zeroed, count as having grown by their latest value.
+func AnalyzeUsage(snaps []*CounterSnapshot) (*UsageReport, error) {
+	if len(snaps) < 2 {
+		return nil, fmt.Errorf("at least two snapshots are needed, got %d", len(snaps))
+	}
+
+	byTable := map[string][]*CounterSnapshot{}
+	var tables []string
+	for _, s := range snaps {
+		if _, ok := byTable[s.Table]; !ok {
+			tables = append(tables, s.Table)
+		}
+		byTable[s.Table] = append(byTable[s.Table], s)
+	}
+	sort.Strings(tables)
+
+	report := &UsageReport{
+		UnusedRules:    []UnusedRule{},
+		UnusedChains:   []UnusedChain{},
+		UnusedPolicies: []UnusedPolicy{},
+	}
+	for _, table := range tables {
+		ts := byTable[table]
+		sort.SliceStable(ts, func(i, j int) bool { return ts[i].Time.Before(ts[j].Time) })
+		if report.Start.IsZero() || ts[0].Time.Before(report.Start) {
+			report.Start = ts[0].Time
+		}
+		if end := ts[len(ts)-1].Time; end.After(report.End) {
+			report.End = end
+		}
+		analyzeTable(report, ts)
+	}
+	return report, nil
+}
+
+// ruleSeen is the first sample of a rule.
+type ruleSeen struct {
+	packets uint64
+	time    time.Time
+}
+
+// analyzeTable adds the unused rules, chains and policies of one table,
+// whose snapshots are sorted by time, to report.
+func analyzeTable(report *UsageReport, snaps []*CounterSnapshot) {
+	last := snaps[len(snaps)-1]
+
+	// the first sample of every rule and policy, and the previous sample to
+	// detect resets
+	first := map[RuleKey]ruleSeen{}
+	growth := map[RuleKey]uint64{}
+	prev := map[RuleKey]uint64{}
+	for _, snap := range snaps {
+		for chain, c := range snap.Chains {
+			for _, r := range ruleKeys(snap.Table, chain, c) {
+				key, packets := r.key, r.packets
+				if _, ok := first[key]; !ok {
+					first[key] = ruleSeen{packets, snap.Time}
+				} else if p := prev[key]; packets < p {
+					growth[key] += packets
+				} else {
+					growth[key] += packets - p
+				}
+				prev[key] = packets
+			}
+		}
+	}
+
+	chains := make([]string, 0, len(last.Chains))
+	for chain := range last.Chains {
+		chains = append(chains, chain)
+	}
+	sort.Strings(chains)
+
+	// packets jumping into each chain, and the number of jumps
+	jumped := map[string]uint64{}
+	references := map[string]int{}
+	for _, chain := range chains {
+		for _, r := range ruleKeys(last.Table, chain, last.Chains[chain]) {
+			if r.target == "" {
+				continue
+			}
+			references[r.target]++
+			if first[r.key].time.Equal(last.Time) {
+				// new rule, it started from zero
+				jumped[r.target] += r.packets
+			} else {
+				jumped[r.target] += growth[r.key]
+			}
+		}
+	}
+
+	for _, chain := range chains {
+		c := last.Chains[chain]
+		if c.Policy != "" {
+			key := RuleKey{Table: last.Table, Chain: chain, Rule: policyRule}
+			if !first[key].time.Equal(last.Time) && growth[key] == 0 {
+				report.UnusedPolicies = append(report.UnusedPolicies, UnusedPolicy{Table: last.Table, Chain: chain, Policy: c.Policy})
+			}
+		} else if jumped[chain] == 0 {
+			report.UnusedChains = append(report.UnusedChains, UnusedChain{Table: last.Table, Chain: chain, References: references[chain]})
+		}
+
+		for i, r := range ruleKeys(last.Table, chain, c)[:len(c.Rules)] {
+			seen := first[r.key]
+			if seen.time.Equal(last.Time) || growth[r.key] != 0 {
+				continue
+			}
+			report.UnusedRules = append(report.UnusedRules, UnusedRule{
+				Table:    last.Table,
+				Chain:    chain,
+				Position: i + 1,
+				Rule:     c.Rules[i].Rule,
+				Target:   r.target,
+				Since:    seen.time,
+			})
+		}
+	}
+}
+
+// policyRule is the RuleKey.Rule of the policy of a chain.
+const policyRule = "-P"
+
+type keyedRule struct {
+	key     RuleKey
+	target  string
+	packets uint64
+}
+
+// ruleKeys returns the keys and packet counters of the policy of a built-in
+// chain, if any, and then of its rules.
+func ruleKeys(table, chain string, c *ChainCounters) []keyedRule {
+	var rules []keyedRule
+	occurrences := map[string]int{}
+	for _, r := range c.Rules {
+		key := RuleKey{Table: table, Chain: chain, Rule: r.Rule, Occurrence: occurrences[r.Rule]}
+		occurrences[r.Rule]++
+		rules = append(rules, keyedRule{key: key, target: r.Target, packets: r.Packets})
+	}
+	if c.Policy != "" {
+		rules = append(rules, keyedRule{key: RuleKey{Table: table, Chain: chain, Rule: policyRule}, packets: c.PolicyPackets})
+	}
+	return rules
+}
+
+// WriteTable writes the report as aligned text tables, for terminals.
+func (r *UsageReport) WriteTable(w io.Writer) error {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(tw, "Window: %s - %s\n\n", r.Start.Format(time.RFC3339), r.End.Format(time.RFC3339))
+
+	fmt.Fprintf(tw, "Unused rules (%d)\n", len(r.UnusedRules))
+	fmt.Fprintln(tw, "TABLE\tCHAIN\tPOS\tTARGET\tRULE")
+	for _, u := range r.UnusedRules {
+		fmt.Fprintf(tw, "%s\t%s\t%d\t%s\t%s\n", u.Table, u.Chain, u.Position, u.Target, u.Rule)
+	}
+
+	fmt.Fprintf(tw, "\nChains never jumped into (%d)\n", len(r.UnusedChains))
+	fmt.Fprintln(tw, "TABLE\tCHAIN\tREFERENCES")
+	for _, u := range r.UnusedChains {
+		fmt.Fprintf(tw, "%s\t%s\t%d\n", u.Table, u.Chain, u.References)
+	}
+
+	fmt.Fprintf(tw, "\nPolicies never hit (%d)\n", len(r.UnusedPolicies))
+	fmt.Fprintln(tw, "TABLE\tCHAIN\tPOLICY")
+	for _, u := range r.UnusedPolicies {
+		fmt.Fprintf(tw, "%s\t%s\t%s\n", u.Table, u.Chain, u.Policy)
+	}
+	return tw.Flush()
+}
@@ -0,0 +1,163 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseSaveCounters(t *testing.T) {
+	save := `# Generated by iptables-save v1.8.7
+*filter
+:INPUT DROP [12:720]
+:FORWARD ACCEPT [0:0]
+:MYAPP - [0:0]
+[5:300] -A INPUT -p tcp -m comment --comment "ssh access" -j ACCEPT
+[0:0] -A INPUT -j MYAPP
+COMMIT
+*nat
+:PREROUTING ACCEPT [1:60]
+COMMIT
+`
+	start := time.Unix(1000, 0)
+	snaps, err := ParseSaveCounters(strings.NewReader(save), start)
+	if err != nil {
+		t.Fatalf("ParseSaveCounters failed: %v", err)
+	}
+
+	expected := []*CounterSnapshot{
+		{
+			Time:  start,
+			Table: "filter",
+			Chains: map[string]*ChainCounters{
+				"INPUT": {Policy: "DROP", PolicyPackets: 12, PolicyBytes: 720, Rules: []RuleCounters{
+					{Rule: `-p tcp -m comment --comment "ssh access" -j ACCEPT`, Target: "ACCEPT", Packets: 5, Bytes: 300},
+					{Rule: "-j MYAPP", Target: "MYAPP"},
+				}},
+				"FORWARD": {Policy: "ACCEPT"},
+				"MYAPP":   {},
+			},
+		},
+		{
+			Time:   start,
+			Table:  "nat",
+			Chains: map[string]*ChainCounters{"PREROUTING": {Policy: "ACCEPT", PolicyPackets: 1, PolicyBytes: 60}},
+		},
+	}
+	if !reflect.DeepEqual(snaps, expected) {
+		t.Fatalf("ParseSaveCounters mismatch: \ngot  %#v \nneed %#v", snaps, expected)
+	}
+
+	for _, bad := range []string{
+		":INPUT ACCEPT [0:0]\n",
+		"*filter\n[1:2] -A MISSING -j ACCEPT\n",
+		"*filter\n:INPUT ACCEPT [x:0]\n",
+	} {
+		if _, err := ParseSaveCounters(strings.NewReader(bad), start); err == nil {
+			t.Fatalf("expected err parsing %q, got none", bad)
+		}
+	}
+}
+
+func TestAnalyzeUsage(t *testing.T) {
+	start := time.Unix(1000, 0)
+	end := start.Add(time.Hour)
+	snapshot := func(t time.Time, ssh, jump, drop, policy uint64, extra ...RuleCounters) *CounterSnapshot {
+		return &CounterSnapshot{
+			Time:  t,
+			Table: "filter",
+			Chains: map[string]*ChainCounters{
+				"INPUT": {Policy: "DROP", PolicyPackets: policy, Rules: append([]RuleCounters{
+					{Rule: "-p tcp --dport 22 -j ACCEPT", Target: "ACCEPT", Packets: ssh},
+					{Rule: "-j MYAPP", Target: "MYAPP", Packets: jump},
+				}, extra...)},
+				"MYAPP": {Rules: []RuleCounters{
+					{Rule: "-s 10.0.0.1/32 -j DROP", Target: "DROP", Packets: drop},
+				}},
+				"OLD": {},
+			},
+		}
+	}
+
+	report, err := AnalyzeUsage([]*CounterSnapshot{
+		// out of order on purpose
+		snapshot(end, 50, 7, 7, 3, RuleCounters{Rule: "-j LOG", Target: "LOG"}),
+		snapshot(start, 10, 7, 2, 3),
+	})
+	if err != nil {
+		t.Fatalf("AnalyzeUsage failed: %v", err)
+	}
+
+	expected := &UsageReport{
+		Start: start,
+		End:   end,
+		UnusedRules: []UnusedRule{
+			{Table: "filter", Chain: "INPUT", Position: 2, Rule: "-j MYAPP", Target: "MYAPP", Since: start},
+		},
+		UnusedChains: []UnusedChain{
+			{Table: "filter", Chain: "MYAPP", References: 1},
+			{Table: "filter", Chain: "OLD"},
+		},
+		UnusedPolicies: []UnusedPolicy{
+			{Table: "filter", Chain: "INPUT", Policy: "DROP"},
+		},
+	}
+	if !reflect.DeepEqual(report, expected) {
+		t.Fatalf("AnalyzeUsage mismatch: \ngot  %#v \nneed %#v", report, expected)
+	}
+
+	// zeroed counters count as growth
+	report, err = AnalyzeUsage([]*CounterSnapshot{
+		snapshot(start, 10, 7, 2, 3),
+		snapshot(end, 5, 0, 0, 0),
+	})
+	if err != nil {
+		t.Fatalf("AnalyzeUsage failed: %v", err)
+	}
+	if len(report.UnusedRules) != 2 || report.UnusedRules[0].Chain != "INPUT" || report.UnusedRules[1].Chain != "MYAPP" {
+		t.Fatalf("AnalyzeUsage after reset returned wrong unused rules: %#v", report.UnusedRules)
+	}
+
+	if _, err := AnalyzeUsage([]*CounterSnapshot{snapshot(start, 0, 0, 0, 0)}); err == nil {
+		t.Fatal("expected err with a single snapshot, got none")
+	}
+
+	var b bytes.Buffer
+	if err := expected.WriteTable(&b); err != nil {
+		t.Fatalf("WriteTable failed: %v", err)
+	}
+	table := `Window: ` + start.Format(time.RFC3339) + ` - ` + end.Format(time.RFC3339) + `
+
+Unused rules (1)
+TABLE   CHAIN  POS  TARGET  RULE
+filter  INPUT  2    MYAPP   -j MYAPP
+
+Chains never jumped into (2)
+TABLE   CHAIN  REFERENCES
+filter  MYAPP  1
+filter  OLD    0
+
+Policies never hit (1)
+TABLE   CHAIN  POLICY
+filter  INPUT  DROP
+`
+	if b.String() != table {
+		t.Fatalf("WriteTable mismatch: \ngot  %s \nneed %s", b.String(), table)
+	}
+}